@@ -0,0 +1,80 @@
+/* Firecracker-task-driver is a task driver for Hashicorp's nomad that allows
+ * to create microvms using AWS Firecracker vmm
+ * Copyright (C) 2019  Carlos Neira cneirabustos@gmail.com
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ */
+
+package firevm
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	firecracker "github.com/firecracker-microvm/firecracker-go-sdk"
+	models "github.com/firecracker-microvm/firecracker-go-sdk/client/models"
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+// defaultBalloonStatsInterval is how often the guest reports its memory to
+// the balloon device, firecracker takes whole seconds.
+const defaultBalloonStatsInterval = 5 * time.Second
+
+var guestMemStats = []string{"RSS", "Cache", "Usage", "Swap"}
+
+// guestStatsFunc returns the memory statistics the guest reports through
+// the balloon device.
+type guestStatsFunc func(ctx context.Context) (models.BalloonStats, error)
+
+// statsInterval returns the polling interval of the balloon statistics.
+func (b BalloonConfig) statsInterval() (time.Duration, error) {
+	if b.StatsInterval == "" {
+		return defaultBalloonStatsInterval, nil
+	}
+	d, err := time.ParseDuration(b.StatsInterval)
+	if err != nil || d < time.Second {
+		return 0, fmt.Errorf("invalid balloon stats_interval %q, must be a duration of at least 1s", b.StatsInterval)
+	}
+	return d, nil
+}
+
+// validate checks the balloon against the memory of the guest.
+func (b BalloonConfig) validate(memMB int64) error {
+	if b.AmountMB < 0 || b.AmountMB >= memMB {
+		return fmt.Errorf("invalid balloon amount_mb %d, the guest has %dMB", b.AmountMB, memMB)
+	}
+	_, err := b.statsInterval()
+	return err
+}
+
+// balloonHandler adds the balloon device before the guest boots, with its
+// statistics enabled.
+func (b BalloonConfig) balloonHandler() firecracker.Handler {
+	interval, _ := b.statsInterval()
+	return firecracker.NewCreateBalloonHandler(b.AmountMB, b.DeflateOnOOM, int64(interval/time.Second))
+}
+
+// mergeGuestMemory replaces the memory usage of the firecracker process,
+// inflated for good by the page cache of the guest, with what the guest
+// uses. The swap of the process is kept.
+func mergeGuestMemory(ms *drivers.MemoryStats, stats models.BalloonStats) bool {
+	if stats.TotalMemory == 0 {
+		// the guest has no balloon driver or hasn't reported yet
+		return false
+	}
+	used := stats.TotalMemory - stats.FreeMemory
+	ms.Usage = uint64(used)
+	ms.Cache = uint64(stats.DiskCaches)
+	if used > stats.DiskCaches {
+		ms.RSS = uint64(used - stats.DiskCaches)
+	} else {
+		ms.RSS = 0
+	}
+	ms.Measured = guestMemStats
+	return true
+}
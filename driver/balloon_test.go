@@ -0,0 +1,83 @@
+/* Firecracker-task-driver is a task driver for Hashicorp's nomad that allows
+ * to create microvms using AWS Firecracker vmm
+ * Copyright (C) 2019  Carlos Neira cneirabustos@gmail.com
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ */
+
+package firevm
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	models "github.com/firecracker-microvm/firecracker-go-sdk/client/models"
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+func TestMergeGuestMemory(t *testing.T) {
+	process := drivers.MemoryStats{RSS: 900 * mib, Swap: 10 * mib, Measured: firecrackerMemStats}
+	cases := []struct {
+		name   string
+		stats  models.BalloonStats
+		merged bool
+		want   drivers.MemoryStats
+	}{
+		{
+			name:  "not reported",
+			stats: models.BalloonStats{FreeMemory: 100 * mib},
+			want:  process,
+		},
+		{
+			name:   "page cache",
+			stats:  models.BalloonStats{TotalMemory: 1024 * mib, FreeMemory: 624 * mib, DiskCaches: 300 * mib},
+			merged: true,
+			want:   drivers.MemoryStats{RSS: 100 * mib, Cache: 300 * mib, Usage: 400 * mib, Swap: 10 * mib, Measured: guestMemStats},
+		},
+		{
+			name:   "caches above the used memory",
+			stats:  models.BalloonStats{TotalMemory: 1024 * mib, FreeMemory: 824 * mib, DiskCaches: 300 * mib},
+			merged: true,
+			want:   drivers.MemoryStats{RSS: 0, Cache: 300 * mib, Usage: 200 * mib, Swap: 10 * mib, Measured: guestMemStats},
+		},
+	}
+	for _, c := range cases {
+		ms := process
+		if merged := mergeGuestMemory(&ms, c.stats); merged != c.merged {
+			t.Errorf("%s: got merged=%v, want %v", c.name, merged, c.merged)
+		}
+		if !reflect.DeepEqual(ms, c.want) {
+			t.Errorf("%s: got %+v, want %+v", c.name, ms, c.want)
+		}
+	}
+}
+
+func TestBalloonValidate(t *testing.T) {
+	cases := []struct {
+		balloon  BalloonConfig
+		interval time.Duration
+		ok       bool
+	}{
+		{BalloonConfig{}, defaultBalloonStatsInterval, true},
+		{BalloonConfig{AmountMB: 256, StatsInterval: "1s"}, time.Second, true},
+		{BalloonConfig{StatsInterval: "2m"}, 2 * time.Minute, true},
+		{BalloonConfig{AmountMB: 1024}, 0, false},
+		{BalloonConfig{AmountMB: -1}, 0, false},
+		{BalloonConfig{StatsInterval: "500ms"}, 0, false},
+		{BalloonConfig{StatsInterval: "often"}, 0, false},
+	}
+	for _, c := range cases {
+		err := c.balloon.validate(1024)
+		if (err == nil) != c.ok {
+			t.Errorf("%+v: got error %v, want ok=%v", c.balloon, err, c.ok)
+		}
+		if interval, err := c.balloon.statsInterval(); c.ok && (err != nil || interval != c.interval) {
+			t.Errorf("%+v: got interval %v, %v, want %v", c.balloon, interval, err, c.interval)
+		}
+	}
+}
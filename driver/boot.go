@@ -0,0 +1,284 @@
+/* Firecracker-task-driver is a task driver for Hashicorp's nomad that allows
+ * to create microvms using AWS Firecracker vmm
+ * Copyright (C) 2019  Carlos Neira cneirabustos@gmail.com
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ */
+
+package firevm
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	firecracker "github.com/firecracker-microvm/firecracker-go-sdk"
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+const (
+	// phases of a boot, also the reasons of the start failures
+	phaseValidate      = "validate"
+	phaseImage         = "image"
+	phaseNetwork       = "network"
+	phaseVMM           = "vmm"
+	phaseAPI           = "api"
+	phaseInstanceStart = "instance_start"
+	phaseGuest         = "guest"
+	phaseShutdown      = "shutdown"
+	phaseCleanup       = "cleanup"
+
+	// consoleTailLines is how many lines of the serial console the failure
+	// events carry.
+	consoleTailLines = 10
+
+	// consoleWatchTime is how long the serial console is read after the
+	// instance start when the task sets no ready_marker.
+	consoleWatchTime = 2 * time.Minute
+
+	bootPhaseHandlerName = "firevm.BootPhase"
+
+	// noNetworkChosen is the address of a micro-vm without network.
+	noNetworkChosen = "No network chosen"
+)
+
+var phaseNames = map[string]string{
+	phaseValidate:      "Validating the task config",
+	phaseImage:         "Preparing the images",
+	phaseNetwork:       "Setting up the network",
+	phaseVMM:           "Launching firecracker",
+	phaseAPI:           "Configuring the micro-vm",
+	phaseInstanceStart: "Starting the instance",
+	phaseGuest:         "Waiting for the guest",
+	phaseShutdown:      "Shutting down",
+	phaseCleanup:       "Cleaning up",
+}
+
+// emitPhaseEvent sends the task event ending a phase, annotated with the
+// phase and its duration.
+func (d *Driver) emitPhaseEvent(cfg *drivers.TaskConfig, phase, msg string, took time.Duration) {
+	took = took.Round(time.Millisecond)
+	err := d.eventer.EmitEvent(&drivers.TaskEvent{
+		TaskID:    cfg.ID,
+		AllocID:   cfg.AllocID,
+		TaskName:  cfg.Name,
+		Timestamp: time.Now(),
+		Message:   fmt.Sprintf("%s (took %s)", msg, took),
+		Annotations: map[string]string{
+			"phase":    phase,
+			"duration": took.String(),
+		},
+	})
+	if err != nil {
+		d.logger.Warn("failed to emit task event", "task_id", cfg.ID, "error", err)
+	}
+}
+
+// bootPhases tracks the phase of a starting micro-vm and emits an event as
+// each one ends. The boot of a recovered task only emits its failure, the
+// recovery is reported by a single event.
+type bootPhases struct {
+	d         *Driver
+	cfg       *drivers.TaskConfig
+	recovered bool
+	phase     string
+	start     time.Time
+	console   *consoleTail
+}
+
+func (d *Driver) newBootPhases(cfg *drivers.TaskConfig, recovered bool) *bootPhases {
+	return &bootPhases{d: d, cfg: cfg, recovered: recovered, phase: phaseValidate, start: time.Now()}
+}
+
+// next ends the current phase with msg and starts phase.
+func (b *bootPhases) next(phase, msg string) {
+	if !b.recovered {
+		b.d.emitPhaseEvent(b.cfg, b.phase, msg, time.Since(b.start))
+	}
+	b.phase, b.start = phase, time.Now()
+}
+
+// done ends the current phase with msg, it is the last one of the boot.
+func (b *bootPhases) done(msg string) {
+	if !b.recovered {
+		b.d.emitPhaseEvent(b.cfg, b.phase, msg, time.Since(b.start))
+	}
+}
+
+// watchGuest emits the readiness of the guest in the background when the
+// start doesn't wait for it, or the exit of the micro-vm during the boot.
+// Nothing is emitted when neither comes within consoleWatchTime.
+func (b *bootPhases) watchGuest() {
+	if b.console == nil {
+		return
+	}
+	defer b.console.close()
+	if b.console.wait(consoleWatchTime) {
+		b.done("Guest ready")
+		return
+	}
+	select {
+	case <-b.console.done:
+		b.done(b.withConsole("Micro-vm exited during boot"))
+	default:
+	}
+}
+
+// failed emits the failure of the current phase with the last lines the
+// guest printed.
+func (b *bootPhases) failed(err error) {
+	msg := fmt.Sprintf("%s failed: %v", phaseNames[b.phase], err)
+	b.d.emitPhaseEvent(b.cfg, b.phase, b.withConsole(msg), time.Since(b.start))
+	if !b.recovered {
+		startFailed(b.phase)
+	}
+}
+
+// withConsole appends the last lines of the serial console to msg.
+func (b *bootPhases) withConsole(msg string) string {
+	if tail := b.console.tail(); tail != "" {
+		msg += "\nLast lines of the serial console:\n" + tail
+	}
+	return msg
+}
+
+// networkReady is the message ending the network phase.
+func networkReady(ip, ip6 string) string {
+	if ip == noNetworkChosen {
+		return "Network ready: no network chosen"
+	}
+	if ip6 != "" {
+		return fmt.Sprintf("Network ready: %s %s", ip, ip6)
+	}
+	return "Network ready: " + ip
+}
+
+// handler returns an sdk handler moving to phase with msg.
+func (b *bootPhases) handler(phase string, msg func(m *firecracker.Machine) string) firecracker.Handler {
+	return firecracker.Handler{
+		Name: bootPhaseHandlerName + "." + phase,
+		Fn: func(ctx context.Context, m *firecracker.Machine) error {
+			b.next(phase, msg(m))
+			return nil
+		},
+	}
+}
+
+// checkArtifacts checks the kernel and the root drive of the micro-vm are
+// there before anything is set up for it.
+func checkArtifacts(opts *options) error {
+	if _, err := os.Stat(opts.FcKernelImage); err != nil {
+		return fmt.Errorf("kernel image: %v", err)
+	}
+	if _, err := os.Stat(opts.FcRootDrivePath); err != nil {
+		return fmt.Errorf("root drive: %v", err)
+	}
+	return nil
+}
+
+// readyTimeout returns how long a start waits for the ready marker of the
+// guest, zero when it doesn't wait.
+func (tc TaskConfig) readyTimeout() (time.Duration, error) {
+	if tc.ReadyTimeout == "" {
+		return 0, nil
+	}
+	if tc.ReadyMarker == "" {
+		return 0, fmt.Errorf("ready_timeout needs a ready_marker")
+	}
+	d, err := time.ParseDuration(tc.ReadyTimeout)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid ready_timeout %q, must be a positive duration", tc.ReadyTimeout)
+	}
+	return d, nil
+}
+
+// consoleTail reads the serial console of a booting micro-vm, keeping its
+// last lines and looking for the ready marker of the task. It stops once
+// the guest is ready or after a while, the console is then left to users.
+type consoleTail struct {
+	file   *os.File
+	marker string
+	ready  chan struct{}
+	done   chan struct{}
+
+	lock  sync.Mutex
+	lines []string
+}
+
+// watchConsole opens the serial console pty before firecracker writes to it.
+func watchConsole(pty, marker string) (*consoleTail, error) {
+	f, err := os.OpenFile(pty, os.O_RDONLY|syscall.O_NOCTTY, 0)
+	if err != nil {
+		return nil, fmt.Errorf("Fail to open the serial console: %v", err)
+	}
+	c := &consoleTail{file: f, marker: marker, ready: make(chan struct{}), done: make(chan struct{})}
+	go c.read()
+	return c, nil
+}
+
+func (c *consoleTail) read() {
+	defer close(c.done)
+	scanner := bufio.NewScanner(c.file)
+	found := false
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if line == "" {
+			continue
+		}
+		c.lock.Lock()
+		c.lines = append(c.lines, line)
+		if len(c.lines) > consoleTailLines {
+			c.lines = c.lines[1:]
+		}
+		c.lock.Unlock()
+		if !found && c.marker != "" && strings.Contains(line, c.marker) {
+			found = true
+			close(c.ready)
+		}
+	}
+}
+
+// tail returns the last lines read from the console.
+func (c *consoleTail) tail() string {
+	if c == nil {
+		return ""
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return strings.Join(c.lines, "\n")
+}
+
+// wait waits for the ready marker, the end of the console or the timeout,
+// whichever comes first. ready tells whether the marker was seen.
+func (c *consoleTail) wait(timeout time.Duration) (ready bool) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-c.ready:
+		return true
+	case <-c.done:
+		select {
+		case <-c.ready:
+			return true
+		default:
+			return false
+		}
+	case <-timer.C:
+		return false
+	}
+}
+
+func (c *consoleTail) close() {
+	if c != nil {
+		c.file.Close()
+	}
+}
@@ -0,0 +1,93 @@
+/* Firecracker-task-driver is a task driver for Hashicorp's nomad that allows
+ * to create microvms using AWS Firecracker vmm
+ * Copyright (C) 2019  Carlos Neira cneirabustos@gmail.com
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ */
+
+package firevm
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	metrics "github.com/armon/go-metrics"
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+func TestBootPhasesRecovered(t *testing.T) {
+	inm := metrics.NewInmemSink(time.Minute, time.Minute)
+	metrics.NewGlobal(metrics.DefaultConfig("test"), inm)
+
+	cases := []struct {
+		recovered bool
+		events    []string
+		failures  int
+	}{
+		{false, []string{phaseValidate, phaseImage, phaseNetwork}, 1},
+		// only the failure is reported, and not in the metrics
+		{true, []string{phaseNetwork}, 0},
+	}
+	for _, c := range cases {
+		d := NewFirecrackerDriver(hclog.NewNullLogger()).(*Driver)
+		ctx, cancel := context.WithCancel(context.Background())
+		events, err := d.TaskEvents(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg := &drivers.TaskConfig{ID: "task", AllocID: "alloc", Name: "web"}
+
+		// the eventer waits on its consumers, events are read as they come
+		collected := make(chan []string)
+		go func() {
+			var got []string
+			for {
+				select {
+				case ev := <-events:
+					got = append(got, ev.Annotations["phase"])
+				case <-time.After(200 * time.Millisecond):
+					collected <- got
+					return
+				}
+			}
+		}()
+
+		before := startFailures(inm)
+		boot := d.newBootPhases(cfg, c.recovered)
+		boot.next(phaseImage, "Validated the task config and artifacts")
+		boot.next(phaseNetwork, "Prepared the images")
+		boot.failed(errors.New("no tap"))
+
+		got := <-collected
+		cancel()
+		d.signalShutdown()
+
+		if strings.Join(got, ",") != strings.Join(c.events, ",") {
+			t.Errorf("recovered=%v: got events of phases %v, want %v", c.recovered, got, c.events)
+		}
+		if n := startFailures(inm) - before; n != c.failures {
+			t.Errorf("recovered=%v: got %d start failures, want %d", c.recovered, n, c.failures)
+		}
+	}
+}
+
+// startFailures returns the start failures counted so far.
+func startFailures(inm *metrics.InmemSink) int {
+	n := 0
+	for _, interval := range inm.Data() {
+		for name, c := range interval.Counters {
+			if strings.Contains(name, "start_failed") {
+				n += c.Count
+			}
+		}
+	}
+	return n
+}
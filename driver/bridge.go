@@ -0,0 +1,317 @@
+/* Firecracker-task-driver is a task driver for Hashicorp's nomad that allows
+ * to create microvms using AWS Firecracker vmm
+ * Copyright (C) 2019  Carlos Neira cneirabustos@gmail.com
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ */
+
+package firevm
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net"
+	"os"
+
+	"github.com/hashicorp/nomad/plugins/drivers"
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	// bridgeNetworkName selects the built-in bridge networking instead of
+	// a CNI network.
+	bridgeNetworkName = "bridge"
+
+	defaultBridgeName = "fcbr0"
+	defaultIPAMDir    = "/var/lib/firecracker-task-driver/ipam"
+)
+
+// bridgeNetwork is the tap device and address of a task attached to the
+// plugin bridge.
+type bridgeNetwork struct {
+	Tap     string
+	IP      net.IPNet
+	Gateway net.IP
+}
+
+// nic returns the static network config of the guest interface.
+func (b *bridgeNetwork) nic() Nic {
+	return Nic{
+		Ip:        b.IP.String(),
+		Gateway:   b.Gateway.String(),
+		Interface: b.Tap,
+	}
+}
+
+// subnet parses the bridge subnet and gateway of the plugin config,
+// the gateway defaults to the first address of the subnet.
+func (c BridgeConfig) subnet() (*net.IPNet, net.IP, error) {
+	if c.Subnet == "" {
+		return nil, nil, errBridgeNotConfigured
+	}
+	_, subnet, err := net.ParseCIDR(c.Subnet)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Fail to parse bridge subnet: %v", err)
+	}
+	gateway := nextIP(subnet.IP)
+	if c.Gateway != "" {
+		if gateway = net.ParseIP(c.Gateway); gateway == nil || !subnet.Contains(gateway) {
+			return nil, nil, fmt.Errorf("bridge gateway %s is not in %s", c.Gateway, subnet)
+		}
+	}
+	return subnet, gateway, nil
+}
+
+func (c BridgeConfig) name() string {
+	if c.Name == "" {
+		return defaultBridgeName
+	}
+	return c.Name
+}
+
+func (c BridgeConfig) ipamDir() string {
+	if c.IPAMDir == "" {
+		return defaultIPAMDir
+	}
+	return c.IPAMDir
+}
+
+// tapName returns the tap device of a task, derived from the task id so it
+// can be found again after a plugin restart.
+func tapName(cfg *drivers.TaskConfig) string {
+	h := fnv.New32a()
+	h.Write([]byte(cfg.ID))
+	return fmt.Sprintf("fc%08x", h.Sum32())
+}
+
+// setupBridgeNetwork creates the bridge when needed, leases an address to
+// the task and creates its tap device attached to the bridge.
+func (d *Driver) setupBridgeNetwork(cfg *drivers.TaskConfig) (*bridgeNetwork, error) {
+	return d.attachToBridge(cfg.ID, tapName(cfg))
+}
+
+// teardownBridgeNetwork removes the tap device of the task and releases its
+// address. The bridge and the nat rules are shared and left in place.
+func (d *Driver) teardownBridgeNetwork(cfg *drivers.TaskConfig) error {
+	return d.detachFromBridge(cfg.ID, tapName(cfg))
+}
+
+// attachToBridge leases an address to owner and attaches the tap to the
+// bridge, creating both when needed.
+func (d *Driver) attachToBridge(owner, tap string) (*bridgeNetwork, error) {
+	conf := d.config.Bridge
+	subnet, gateway, err := conf.subnet()
+	if err != nil {
+		return nil, err
+	}
+
+	bridge, err := ensureBridge(conf.name(), subnet, gateway)
+	if err != nil {
+		return nil, err
+	}
+	if conf.NAT {
+		if err := setupMasquerade(conf.name(), subnet); err != nil {
+			return nil, err
+		}
+	}
+
+	ip, err := newIPAM(conf.ipamDir(), subnet, gateway).allocate(owner)
+	if err != nil {
+		return nil, fmt.Errorf("Fail to allocate an address for the task: %v", err)
+	}
+	b := &bridgeNetwork{
+		Tap:     tap,
+		IP:      net.IPNet{IP: ip, Mask: subnet.Mask},
+		Gateway: gateway,
+	}
+
+	if err := createTap(b.Tap, bridge); err != nil {
+		d.detachFromBridge(owner, tap)
+		return nil, err
+	}
+	return b, nil
+}
+
+// detachFromBridge deletes the tap and releases the address of owner.
+func (d *Driver) detachFromBridge(owner, tap string) error {
+	if link, err := netlink.LinkByName(tap); err == nil {
+		if err := netlink.LinkDel(link); err != nil {
+			return fmt.Errorf("Fail to delete tap device: %v", err)
+		}
+	}
+	subnet, gateway, err := d.config.Bridge.subnet()
+	if err != nil {
+		return err
+	}
+	return newIPAM(d.config.Bridge.ipamDir(), subnet, gateway).release(owner)
+}
+
+// ensureBridge returns the bridge, creating it with the gateway address
+// when it doesn't exist.
+func ensureBridge(name string, subnet *net.IPNet, gateway net.IP) (netlink.Link, error) {
+	link, err := netlink.LinkByName(name)
+	if _, ok := err.(netlink.LinkNotFoundError); ok {
+		br := &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: name}}
+		if err := netlink.LinkAdd(br); err != nil && !os.IsExist(err) {
+			return nil, fmt.Errorf("Fail to create bridge %s: %v", name, err)
+		}
+		link, err = netlink.LinkByName(name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Fail to look up bridge %s: %v", name, err)
+	}
+	if _, ok := link.(*netlink.Bridge); !ok {
+		return nil, fmt.Errorf("%s is not a bridge", name)
+	}
+
+	addr := &netlink.Addr{IPNet: &net.IPNet{IP: gateway, Mask: subnet.Mask}}
+	if err := netlink.AddrReplace(link, addr); err != nil {
+		return nil, fmt.Errorf("Fail to set the address of bridge %s: %v", name, err)
+	}
+	if err := netlink.LinkSetUp(link); err != nil {
+		return nil, fmt.Errorf("Fail to bring up bridge %s: %v", name, err)
+	}
+	return link, nil
+}
+
+// createTap creates the persistent tap device firecracker attaches to and
+// adds it to the bridge, if any. A tap left by a previous run of the task
+// is reused.
+func createTap(name string, bridge netlink.Link) error {
+	link, err := netlink.LinkByName(name)
+	if _, ok := err.(netlink.LinkNotFoundError); ok {
+		tap := &netlink.Tuntap{
+			LinkAttrs: netlink.LinkAttrs{Name: name},
+			Mode:      netlink.TUNTAP_MODE_TAP,
+			Flags:     netlink.TUNTAP_ONE_QUEUE | netlink.TUNTAP_NO_PI | netlink.TUNTAP_VNET_HDR,
+			Queues:    1,
+		}
+		if err := netlink.LinkAdd(tap); err != nil {
+			return fmt.Errorf("Fail to create tap device %s: %v", name, err)
+		}
+		// the tap is persistent, firecracker opens it again
+		for _, f := range tap.Fds {
+			f.Close()
+		}
+		link, err = netlink.LinkByName(name)
+	}
+	if err != nil {
+		return fmt.Errorf("Fail to look up tap device %s: %v", name, err)
+	}
+
+	if bridge != nil {
+		if err := netlink.LinkSetMaster(link, bridge); err != nil {
+			return fmt.Errorf("Fail to attach %s to the bridge: %v", name, err)
+		}
+	}
+	if err := netlink.LinkSetUp(link); err != nil {
+		return fmt.Errorf("Fail to bring up tap device %s: %v", name, err)
+	}
+	return nil
+}
+
+// setupMasquerade lets guests reach the outside world through the host,
+// the rules are only added once. Only traffic from the bridge subnet going
+// out of the uplinks is forwarded, guests can't reach the other networks
+// of the host.
+func setupMasquerade(bridge string, subnet *net.IPNet) error {
+	if err := os.WriteFile("/proc/sys/net/ipv4/ip_forward", []byte("1"), 0644); err != nil {
+		return fmt.Errorf("Fail to enable ip forwarding: %v", err)
+	}
+	links, err := uplinks()
+	if err != nil {
+		return fmt.Errorf("Fail to set up nat for the bridge: %v", err)
+	}
+
+	// rules of older versions accepting everything from the bridge
+	for _, rule := range legacyMasqueradeRules(bridge, subnet) {
+		if iptables("-C", rule) == nil {
+			if err := iptables("-D", rule); err != nil {
+				return fmt.Errorf("Fail to remove old nat rule of the bridge: %v", err)
+			}
+		}
+	}
+	for _, rule := range masqueradeRules(bridge, subnet, links) {
+		if iptables("-C", rule) == nil {
+			continue
+		}
+		if err := iptables("-A", rule); err != nil {
+			return fmt.Errorf("Fail to set up nat for the bridge: %v", err)
+		}
+	}
+	return nil
+}
+
+// masqueradeRules are the iptables rules of the bridge nat, as table, chain
+// and rule spec.
+func masqueradeRules(bridge string, subnet *net.IPNet, uplinks []string) [][]string {
+	var rules [][]string
+	for _, uplink := range uplinks {
+		rules = append(rules,
+			[]string{"-t", "nat", "POSTROUTING", "-s", subnet.String(), "-o", uplink, "-j", "MASQUERADE"},
+			[]string{"-t", "filter", "FORWARD", "-i", bridge, "-s", subnet.String(), "-o", uplink, "-j", "ACCEPT"},
+			[]string{"-t", "filter", "FORWARD", "-i", uplink, "-o", bridge, "-d", subnet.String(), "-m", "conntrack", "--ctstate", "RELATED,ESTABLISHED", "-j", "ACCEPT"},
+		)
+	}
+	return rules
+}
+
+func legacyMasqueradeRules(bridge string, subnet *net.IPNet) [][]string {
+	return [][]string{
+		{"-t", "nat", "POSTROUTING", "-s", subnet.String(), "!", "-o", bridge, "-j", "MASQUERADE"},
+		{"-t", "filter", "FORWARD", "-i", bridge, "-j", "ACCEPT"},
+		{"-t", "filter", "FORWARD", "-o", bridge, "-m", "conntrack", "--ctstate", "RELATED,ESTABLISHED", "-j", "ACCEPT"},
+	}
+}
+
+// iptables runs an iptables command (-C, -A or -D) on a rule.
+func iptables(command string, rule []string) error {
+	table, chain, spec := rule[:2], rule[2], rule[3:]
+	args := append(append(append([]string{"-w"}, table...), command, chain), spec...)
+	return runCmd("iptables", args...)
+}
+
+// uplinks returns the interfaces the ipv4 default routes go through.
+func uplinks() ([]string, error) {
+	routes, err := netlink.RouteList(nil, netlink.FAMILY_V4)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	seen := map[int]bool{}
+	add := func(index int) error {
+		if index == 0 || seen[index] {
+			return nil
+		}
+		seen[index] = true
+		link, err := netlink.LinkByIndex(index)
+		if err != nil {
+			return err
+		}
+		names = append(names, link.Attrs().Name)
+		return nil
+	}
+	for _, r := range routes {
+		if r.Dst != nil {
+			if ones, _ := r.Dst.Mask.Size(); ones != 0 {
+				continue
+			}
+		}
+		if err := add(r.LinkIndex); err != nil {
+			return nil, err
+		}
+		for _, nh := range r.MultiPath {
+			if err := add(nh.LinkIndex); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("no ipv4 default route")
+	}
+	return names, nil
+}
@@ -0,0 +1,88 @@
+/* Firecracker-task-driver is a task driver for Hashicorp's nomad that allows
+ * to create microvms using AWS Firecracker vmm
+ * Copyright (C) 2019  Carlos Neira cneirabustos@gmail.com
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ */
+
+package firevm
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/testutils"
+	"github.com/vishvananda/netlink"
+)
+
+func TestMasqueradeRules(t *testing.T) {
+	_, subnet, _ := net.ParseCIDR("172.26.64.0/20")
+	rules := masqueradeRules("fcbr0", subnet, []string{"eth0"})
+	want := [][]string{
+		{"-t", "nat", "POSTROUTING", "-s", "172.26.64.0/20", "-o", "eth0", "-j", "MASQUERADE"},
+		{"-t", "filter", "FORWARD", "-i", "fcbr0", "-s", "172.26.64.0/20", "-o", "eth0", "-j", "ACCEPT"},
+		{"-t", "filter", "FORWARD", "-i", "eth0", "-o", "fcbr0", "-d", "172.26.64.0/20", "-m", "conntrack", "--ctstate", "RELATED,ESTABLISHED", "-j", "ACCEPT"},
+	}
+	if !reflect.DeepEqual(rules, want) {
+		t.Errorf("got %v, want %v", rules, want)
+	}
+	if rules := masqueradeRules("fcbr0", subnet, nil); len(rules) != 0 {
+		t.Errorf("got %v without uplinks", rules)
+	}
+}
+
+// TestBridgeInNetNS sets up the bridge and a tap inside a throwaway network
+// namespace, it needs CAP_NET_ADMIN.
+func TestBridgeInNetNS(t *testing.T) {
+	netns, err := testutils.NewNS()
+	if err != nil {
+		t.Skipf("can't create a network namespace: %v", err)
+	}
+	defer testutils.UnmountNS(netns)
+	defer netns.Close()
+
+	_, subnet, _ := net.ParseCIDR("172.26.64.0/20")
+	gateway := net.ParseIP("172.26.64.1")
+	err = netns.Do(func(ns.NetNS) error {
+		bridge, err := ensureBridge("fcbr0", subnet, gateway)
+		if err != nil {
+			return err
+		}
+		// a second run finds the bridge it created
+		if bridge, err = ensureBridge("fcbr0", subnet, gateway); err != nil {
+			return err
+		}
+		addrs, err := netlink.AddrList(bridge, netlink.FAMILY_V4)
+		if err != nil {
+			return err
+		}
+		if len(addrs) != 1 || addrs[0].IPNet.String() != "172.26.64.1/20" {
+			t.Errorf("bridge addresses %v, want 172.26.64.1/20", addrs)
+		}
+
+		if err := createTap("fc00000001", bridge); err != nil {
+			return err
+		}
+		// the tap is reused when the task restarts
+		if err := createTap("fc00000001", bridge); err != nil {
+			return err
+		}
+		tap, err := netlink.LinkByName("fc00000001")
+		if err != nil {
+			return err
+		}
+		if tap.Attrs().MasterIndex != bridge.Attrs().Index {
+			t.Errorf("tap is not attached to the bridge")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
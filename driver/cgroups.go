@@ -0,0 +1,272 @@
+/* Firecracker-task-driver is a task driver for Hashicorp's nomad that allows
+ * to create microvms using AWS Firecracker vmm
+ * Copyright (C) 2019  Carlos Neira cneirabustos@gmail.com
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ */
+
+package firevm
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	firecracker "github.com/firecracker-microvm/firecracker-go-sdk"
+	"github.com/hashicorp/nomad/client/lib/cgroupslib"
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+const (
+	joinCgroupHandlerName = "fcdriver.JoinCgroup"
+
+	// vmmCgroupName is the child of the task cgroups the vmm runs in, the
+	// files of the task cgroups belong to nomad.
+	vmmCgroupName = "firecracker"
+)
+
+// vmCgroup is the set of cgroups nomad created for the task. The vmm joins
+// a child of them as soon as it starts so the guest memory and vcpus are
+// accounted to the task, under the limits nomad sets on the task cgroups.
+type vmCgroup struct {
+	Mode cgroupslib.Mode
+
+	// Paths are the task cgroups by controller, v2 has a single unified
+	// cgroup stored under "".
+	Paths map[string]string
+}
+
+// cgroupLimit is a value written to a cgroup controller file.
+type cgroupLimit struct {
+	controller string
+	file       string
+	value      string
+}
+
+// taskCgroup returns the cgroups of the task under parent, the
+// cgroup_parent of the nomad client, nil when cgroups are not available on
+// the host.
+func taskCgroup(cfg *drivers.TaskConfig, parent string) *vmCgroup {
+	mode := cgroupslib.GetMode()
+	if mode == cgroupslib.OFF || cfg.Resources == nil {
+		return nil
+	}
+	if parent == "" {
+		parent = cgroupslib.NomadCgroupParent
+	}
+
+	paths := cgroupPaths(mode, cgroupslib.GetDefaultRoot(), parent, cfg.AllocID, cfg.Name, len(reservedCores(cfg)) > 0)
+	// nomad tells where the cpuset of the task is when it knows
+	if cfg.Resources.LinuxResources != nil && cfg.Resources.LinuxResources.CpusetCgroupPath != "" {
+		if mode == cgroupslib.CG2 {
+			paths[""] = cfg.Resources.LinuxResources.CpusetCgroupPath
+		} else {
+			paths["cpuset"] = cfg.Resources.LinuxResources.CpusetCgroupPath
+		}
+	}
+	return &vmCgroup{Mode: mode, Paths: paths}
+}
+
+// cgroupPaths returns the cgroups nomad creates for a task, laid out the way
+// the nomad client does under its cgroup parent. Tasks with reserved cores
+// have a cpuset of their own in the reserve partition, the others share the
+// cpuset of the share partition on v1.
+func cgroupPaths(mode cgroupslib.Mode, root, parent, allocID, task string, reservedCores bool) map[string]string {
+	partition := "share"
+	if reservedCores {
+		partition = "reserve"
+	}
+	scope := cgroupslib.ScopeCG1(allocID, task)
+
+	if mode == cgroupslib.CG2 {
+		return map[string]string{"": filepath.Join(root, parent, partition+".slice", scope+".scope")}
+	}
+	cpuset := filepath.Join(root, "cpuset", parent, partition)
+	if reservedCores {
+		cpuset = filepath.Join(cpuset, scope)
+	}
+	return map[string]string{
+		"freezer": filepath.Join(root, "freezer", parent, scope),
+		"cpu":     filepath.Join(root, "cpu", parent, scope),
+		"memory":  filepath.Join(root, "memory", parent, scope),
+		"cpuset":  cpuset,
+	}
+}
+
+// path returns the cgroup of the vmm for the given controller.
+func (c *vmCgroup) path(controller string) string {
+	if c.Mode == cgroupslib.CG2 {
+		return filepath.Join(c.Paths[""], vmmCgroupName)
+	}
+	return filepath.Join(c.Paths[controller], vmmCgroupName)
+}
+
+// join moves the vmm into a child of the task cgroups and applies the cpu
+// and memory limits of the task to it. The memory ceiling is the guest
+// memory plus the vmm overhead, capped to the memory reserved for the task.
+// The memory of the vmm is allocated on numaNode when it isn't negative.
+func (c *vmCgroup) join(pid int, res *drivers.LinuxResources, memoryMB, overheadMB int64, numaNode int) error {
+	limit := (memoryMB + overheadMB) * mib
+	if res.MemoryLimitBytes > 0 && res.MemoryLimitBytes < limit {
+		limit = res.MemoryLimitBytes
+	}
+
+	var limits []cgroupLimit
+	if c.Mode == cgroupslib.CG2 {
+		limits = append(limits,
+			cgroupLimit{"memory", "memory.max", strconv.FormatInt(limit, 10)},
+			cgroupLimit{"memory", "memory.oom.group", "1"},
+		)
+		if res.CPUShares > 0 {
+			limits = append(limits, cgroupLimit{"cpu", "cpu.weight", strconv.FormatInt(cpuWeight(res.CPUShares), 10)})
+		}
+		if res.CPUQuota > 0 {
+			limits = append(limits, cgroupLimit{"cpu", "cpu.max", fmt.Sprintf("%d %d", res.CPUQuota, res.CPUPeriod)})
+		}
+	} else {
+		limits = append(limits, cgroupLimit{"memory", "memory.limit_in_bytes", strconv.FormatInt(limit, 10)})
+		if res.CPUShares > 0 {
+			limits = append(limits, cgroupLimit{"cpu", "cpu.shares", strconv.FormatInt(res.CPUShares, 10)})
+		}
+		if res.CPUQuota > 0 {
+			limits = append(limits,
+				cgroupLimit{"cpu", "cpu.cfs_period_us", strconv.FormatInt(res.CPUPeriod, 10)},
+				cgroupLimit{"cpu", "cpu.cfs_quota_us", strconv.FormatInt(res.CPUQuota, 10)},
+			)
+		}
+	}
+
+	if err := c.create(numaNode >= 0); err != nil {
+		return err
+	}
+	if numaNode >= 0 {
+		limits = append(limits, cgroupLimit{"cpuset", "cpuset.mems", strconv.Itoa(numaNode)})
+	}
+	for _, l := range limits {
+		if err := os.WriteFile(filepath.Join(c.path(l.controller), l.file), []byte(l.value), 0644); err != nil {
+			return fmt.Errorf("Fail to set %s to %s: %v", l.file, l.value, err)
+		}
+	}
+	for controller := range c.Paths {
+		p := c.path(controller)
+		if err := os.WriteFile(filepath.Join(p, "cgroup.procs"), []byte(strconv.Itoa(pid)), 0644); err != nil {
+			return fmt.Errorf("Fail to move firecracker into cgroup %s: %v", p, err)
+		}
+	}
+	return nil
+}
+
+// create creates the cgroups of the vmm under the task cgroups. On v2 the
+// controllers are delegated to the child, the cpuset one only when the
+// memory is bound to a node. On v1 a cpuset child starts with the cpus and
+// memory nodes of its parent. A cgroup still holding the vmm of a previous
+// run is refused, both would share its memory limit.
+func (c *vmCgroup) create(cpuset bool) error {
+	delegate := "+cpu +memory"
+	if cpuset {
+		delegate += " +cpuset"
+	}
+	// nomad creates the task cgroups before starting the task, make sure
+	// they exist when the driver runs on an older client.
+	for controller, parent := range c.Paths {
+		if err := os.MkdirAll(parent, 0755); err != nil {
+			return fmt.Errorf("Fail to create cgroup %s: %v", parent, err)
+		}
+		if c.Mode == cgroupslib.CG2 {
+			if err := os.WriteFile(filepath.Join(parent, "cgroup.subtree_control"), []byte(delegate), 0644); err != nil {
+				return fmt.Errorf("Fail to delegate the controllers of %s: %v", parent, err)
+			}
+		}
+		if err := os.MkdirAll(c.path(controller), 0755); err != nil {
+			return fmt.Errorf("Fail to create cgroup %s: %v", c.path(controller), err)
+		}
+		if procs, err := os.ReadFile(filepath.Join(c.path(controller), "cgroup.procs")); err == nil && len(bytes.TrimSpace(procs)) > 0 {
+			return fmt.Errorf("%w: %s", errCgroupInUse, c.path(controller))
+		}
+		if c.Mode == cgroupslib.CG1 && controller == "cpuset" {
+			for _, file := range []string{"cpuset.cpus", "cpuset.mems"} {
+				value, err := os.ReadFile(filepath.Join(parent, file))
+				if err != nil {
+					return fmt.Errorf("Fail to read %s of %s: %v", file, parent, err)
+				}
+				if err := os.WriteFile(filepath.Join(c.path(controller), file), value, 0644); err != nil {
+					return fmt.Errorf("Fail to set %s of %s: %v", file, c.path(controller), err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// remove removes the cgroups of the vmm once it exited, nomad can't remove
+// the task cgroups while they have children.
+func (c *vmCgroup) remove() error {
+	if c == nil {
+		return nil
+	}
+	for controller := range c.Paths {
+		if err := os.Remove(c.path(controller)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("Fail to remove cgroup %s: %v", c.path(controller), err)
+		}
+	}
+	return nil
+}
+
+// oomKilled reports whether the kernel killed the vmm because the task went
+// over its memory limit.
+func (c *vmCgroup) oomKilled() bool {
+	if c == nil {
+		return false
+	}
+	file := "memory.events"
+	if c.Mode == cgroupslib.CG1 {
+		file = "memory.oom_control"
+	}
+	f, err := os.Open(filepath.Join(c.path("memory"), file))
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[0] == "oom_kill" {
+			n, _ := strconv.ParseInt(fields[1], 10, 64)
+			return n > 0
+		}
+	}
+	return false
+}
+
+// joinCgroupHandler moves the vmm into its cgroups right after it started,
+// before the guest memory is allocated.
+func (c *vmCgroup) joinCgroupHandler(res *drivers.LinuxResources, memoryMB, overheadMB int64, numaNode int) firecracker.Handler {
+	return firecracker.Handler{
+		Name: joinCgroupHandlerName,
+		Fn: func(ctx context.Context, m *firecracker.Machine) error {
+			pid, err := m.PID()
+			if err != nil {
+				return err
+			}
+			return c.join(pid, res, memoryMB, overheadMB, numaNode)
+		},
+	}
+}
+
+// cpuWeight converts cpu shares to a cgroup v2 cpu.weight the way runc does.
+func cpuWeight(shares int64) int64 {
+	if shares < 2 {
+		shares = 2
+	}
+	return 1 + ((shares-2)*9999)/262142
+}
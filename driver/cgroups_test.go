@@ -0,0 +1,198 @@
+/* Firecracker-task-driver is a task driver for Hashicorp's nomad that allows
+ * to create microvms using AWS Firecracker vmm
+ * Copyright (C) 2019  Carlos Neira cneirabustos@gmail.com
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ */
+
+package firevm
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/hashicorp/nomad/client/lib/cgroupslib"
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+func TestCgroupPaths(t *testing.T) {
+	alloc := "590983f4-499a-380f-420e-e5be4d5f46d9"
+	cases := []struct {
+		name     string
+		mode     cgroupslib.Mode
+		parent   string
+		reserved bool
+		want     map[string]string
+	}{
+		{"v2 shared cores", cgroupslib.CG2, "nomad.slice", false, map[string]string{
+			"": "/sys/fs/cgroup/nomad.slice/share.slice/" + alloc + ".web.scope",
+		}},
+		{"v2 reserved cores", cgroupslib.CG2, "custom.slice", true, map[string]string{
+			"": "/sys/fs/cgroup/custom.slice/reserve.slice/" + alloc + ".web.scope",
+		}},
+		{"v1 shared cores", cgroupslib.CG1, "/nomad", false, map[string]string{
+			"freezer": "/sys/fs/cgroup/freezer/nomad/" + alloc + ".web",
+			"cpu":     "/sys/fs/cgroup/cpu/nomad/" + alloc + ".web",
+			"memory":  "/sys/fs/cgroup/memory/nomad/" + alloc + ".web",
+			"cpuset":  "/sys/fs/cgroup/cpuset/nomad/share",
+		}},
+		{"v1 reserved cores", cgroupslib.CG1, "/custom", true, map[string]string{
+			"freezer": "/sys/fs/cgroup/freezer/custom/" + alloc + ".web",
+			"cpu":     "/sys/fs/cgroup/cpu/custom/" + alloc + ".web",
+			"memory":  "/sys/fs/cgroup/memory/custom/" + alloc + ".web",
+			"cpuset":  "/sys/fs/cgroup/cpuset/custom/reserve/" + alloc + ".web",
+		}},
+	}
+	for _, c := range cases {
+		got := cgroupPaths(c.mode, "/sys/fs/cgroup", c.parent, alloc, "web", c.reserved)
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: got %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestCPUWeight(t *testing.T) {
+	cases := []struct {
+		shares int64
+		weight int64
+	}{
+		{0, 1},
+		{2, 1},
+		{1024, 39},
+		{262144, 10000},
+	}
+	for _, c := range cases {
+		if got := cpuWeight(c.shares); got != c.weight {
+			t.Errorf("cpuWeight(%d) = %d, want %d", c.shares, got, c.weight)
+		}
+	}
+}
+
+func TestCgroupJoin(t *testing.T) {
+	res := &drivers.LinuxResources{CPUShares: 1024, CPUQuota: 50000, CPUPeriod: 100000, MemoryLimitBytes: 300 * mib}
+	cases := []struct {
+		name       string
+		mode       cgroupslib.Mode
+		controller []string
+		numaNode   int
+		files      map[string]string
+	}{
+		{"v2", cgroupslib.CG2, []string{""}, -1, map[string]string{
+			"memory.max":       "314572800",
+			"memory.oom.group": "1",
+			"cpu.weight":       "39",
+			"cpu.max":          "50000 100000",
+			"cgroup.procs":     "4242",
+		}},
+		{"v2 numa bound", cgroupslib.CG2, []string{""}, 1, map[string]string{
+			"cpuset.mems": "1",
+		}},
+		{"v1", cgroupslib.CG1, []string{"cpu", "memory", "cpuset"}, -1, map[string]string{
+			"memory/firecracker/memory.limit_in_bytes": "314572800",
+			"cpu/firecracker/cpu.shares":               "1024",
+			"cpu/firecracker/cpu.cfs_quota_us":         "50000",
+			"cpu/firecracker/cpu.cfs_period_us":        "100000",
+			"cpuset/firecracker/cpuset.cpus":           "0-3",
+			"cpuset/firecracker/cgroup.procs":          "4242",
+		}},
+	}
+	for _, c := range cases {
+		root := t.TempDir()
+		cg := &vmCgroup{Mode: c.mode, Paths: map[string]string{}}
+		for _, controller := range c.controller {
+			cg.Paths[controller] = filepath.Join(root, controller)
+		}
+		if c.mode == cgroupslib.CG1 {
+			os.MkdirAll(cg.Paths["cpuset"], 0755)
+			os.WriteFile(filepath.Join(cg.Paths["cpuset"], "cpuset.cpus"), []byte("0-3"), 0644)
+			os.WriteFile(filepath.Join(cg.Paths["cpuset"], "cpuset.mems"), []byte("0"), 0644)
+		}
+
+		// the guest memory plus the overhead is capped by the task limit
+		if err := cg.join(4242, res, 512, 64, c.numaNode); err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		for file, want := range c.files {
+			path := filepath.Join(root, file)
+			if c.mode == cgroupslib.CG2 {
+				path = filepath.Join(cg.path(""), file)
+			}
+			got, err := os.ReadFile(path)
+			if err != nil || string(got) != want {
+				t.Errorf("%s: %s is %q (%v), want %q", c.name, file, got, err, want)
+			}
+		}
+		if c.mode == cgroupslib.CG2 {
+			want := "+cpu +memory"
+			if c.numaNode >= 0 {
+				want += " +cpuset"
+			}
+			if got, _ := os.ReadFile(filepath.Join(cg.Paths[""], "cgroup.subtree_control")); string(got) != want {
+				t.Errorf("%s: delegated %q, want %q", c.name, got, want)
+			}
+		}
+
+		if err := cg.remove(); err == nil {
+			// a fake cgroup keeps its files, only an empty one is removed
+			t.Errorf("%s: removed a cgroup with files", c.name)
+		}
+	}
+}
+
+func TestCgroupInUse(t *testing.T) {
+	root := t.TempDir()
+	cg := &vmCgroup{Mode: cgroupslib.CG2, Paths: map[string]string{"": root}}
+	if err := os.MkdirAll(cg.path(""), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// the vmm of the previous run still runs in the cgroup
+	os.WriteFile(filepath.Join(cg.path(""), "cgroup.procs"), []byte("4242\n"), 0644)
+	if err := cg.create(false); !errors.Is(err, errCgroupInUse) {
+		t.Errorf("got error %v, want %v", err, errCgroupInUse)
+	}
+
+	os.WriteFile(filepath.Join(cg.path(""), "cgroup.procs"), nil, 0644)
+	if err := cg.create(false); err != nil {
+		t.Errorf("empty cgroup refused: %v", err)
+	}
+}
+
+func TestOOMKilled(t *testing.T) {
+	cases := []struct {
+		mode   cgroupslib.Mode
+		file   string
+		events string
+		killed bool
+	}{
+		{cgroupslib.CG2, "memory.events", "low 0\nhigh 0\nmax 3\noom 1\noom_kill 1\n", true},
+		{cgroupslib.CG2, "memory.events", "low 0\nhigh 0\nmax 0\noom 0\noom_kill 0\n", false},
+		{cgroupslib.CG1, "memory.oom_control", "oom_kill_disable 0\nunder_oom 0\noom_kill 2\n", true},
+		{cgroupslib.CG1, "memory.oom_control", "", false},
+	}
+	for _, c := range cases {
+		root := t.TempDir()
+		controller := ""
+		if c.mode == cgroupslib.CG1 {
+			controller = "memory"
+		}
+		cg := &vmCgroup{Mode: c.mode, Paths: map[string]string{controller: root}}
+		os.MkdirAll(cg.path("memory"), 0755)
+		os.WriteFile(filepath.Join(cg.path("memory"), c.file), []byte(c.events), 0644)
+		if got := cg.oomKilled(); got != c.killed {
+			t.Errorf("%s %q: got killed=%v, want %v", c.file, c.events, got, c.killed)
+		}
+	}
+	var none *vmCgroup
+	if none.oomKilled() {
+		t.Error("oom kill without cgroup")
+	}
+}
@@ -0,0 +1,120 @@
+/* Firecracker-task-driver is a task driver for Hashicorp's nomad that allows
+ * to create microvms using AWS Firecracker vmm
+ * Copyright (C) 2019  Carlos Neira cneirabustos@gmail.com
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ */
+
+package firevm
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/containernetworking/cni/libcni"
+)
+
+const (
+	// cniDelAttempts and cniDelBackoff bound the retries of CNI DEL, the
+	// backoff doubles after every attempt.
+	cniDelAttempts = 5
+	cniDelBackoff  = 500 * time.Millisecond
+)
+
+// cniAttachment is what CNI DEL needs to release an interface. It is kept in
+// the task state so the interface is deleted with the config and result it
+// was added with, even when the config changed on disk or the plugin
+// restarted since.
+type cniAttachment struct {
+	Network     string
+	ConfList    []byte
+	Result      []byte
+	ContainerID string
+	IfName      string
+	Args        [][2]string
+	CacheDir    string
+}
+
+func newCNIAttachment(list *libcni.NetworkConfigList, rt *libcni.RuntimeConf, cacheDir string) *cniAttachment {
+	return &cniAttachment{
+		Network:     list.Name,
+		ConfList:    list.Bytes,
+		ContainerID: rt.ContainerID,
+		IfName:      rt.IfName,
+		Args:        rt.Args,
+		CacheDir:    cacheDir,
+	}
+}
+
+func (a *cniAttachment) runtimeConf(netns string) *libcni.RuntimeConf {
+	// DEL still has to run when the namespace is gone, after a reboot, so
+	// the plugins release the addresses they leased.
+	if _, err := os.Stat(netns); err != nil {
+		netns = ""
+	}
+	return &libcni.RuntimeConf{
+		ContainerID: a.ContainerID,
+		NetNS:       netns,
+		IfName:      a.IfName,
+		Args:        a.Args,
+	}
+}
+
+// del runs CNI DEL for the attachment, retrying with backoff as plugins fail
+// on transient errors like a locked iptables.
+func (a *cniAttachment) del(ctx context.Context, netns string) error {
+	list, err := libcni.ConfListFromBytes(a.ConfList)
+	if err != nil {
+		return fmt.Errorf("Fail to parse the config of cni network %s: %v", a.Network, err)
+	}
+	cni := libcni.NewCNIConfigWithCacheDir([]string{cniBinDir}, a.CacheDir, nil)
+	rt := a.runtimeConf(netns)
+
+	backoff := cniDelBackoff
+	for attempt := 1; ; attempt++ {
+		if err = a.delOnce(ctx, cni, list, rt); err == nil {
+			return nil
+		}
+		if attempt == cniDelAttempts {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+	return fmt.Errorf("Fail to delete cni network %s after %d attempts: %v", a.Network, cniDelAttempts, err)
+}
+
+// delOnce runs DEL with the result libcni cached on ADD or, when the cache
+// is gone, the result kept in the attachment: plugins like host-local need
+// it to find the address to release.
+func (a *cniAttachment) delOnce(ctx context.Context, cni *libcni.CNIConfig, list *libcni.NetworkConfigList, rt *libcni.RuntimeConf) error {
+	cached, err := cni.GetNetworkListCachedResult(list, rt)
+	if (err == nil && cached != nil) || len(a.Result) == 0 {
+		return cni.DelNetworkList(ctx, list, rt)
+	}
+	for i := len(list.Plugins) - 1; i >= 0; i-- {
+		conf, err := libcni.InjectConf(list.Plugins[i], map[string]interface{}{
+			"name":       list.Name,
+			"cniVersion": list.CNIVersion,
+			"prevResult": json.RawMessage(a.Result),
+		})
+		if err != nil {
+			return err
+		}
+		if err := cni.DelNetwork(ctx, conf, rt); err != nil {
+			return fmt.Errorf("plugin %s failed (delete): %v", conf.Network.Type, err)
+		}
+	}
+	return nil
+}
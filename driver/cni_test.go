@@ -0,0 +1,99 @@
+/* Firecracker-task-driver is a task driver for Hashicorp's nomad that allows
+ * to create microvms using AWS Firecracker vmm
+ * Copyright (C) 2019  Carlos Neira cneirabustos@gmail.com
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ */
+
+package firevm
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+func TestTaskStateRoundTrip(t *testing.T) {
+	_, ip, _ := net.ParseCIDR("10.22.0.5/16")
+	_, ip6, _ := net.ParseCIDR("fd00:22::5/64")
+	state := TaskState{
+		TaskConfig: &drivers.TaskConfig{ID: "task", AllocID: "alloc"},
+		StartedAt:  time.Now().Round(time.Millisecond).UTC(),
+		Network: &vmNetwork{
+			NetNS: "/var/run/netns/alloc",
+			Interfaces: []netInterface{{
+				Name:   "eth0",
+				IfName: "veth0",
+				Tap:    "tap0",
+				Mac:    "02:fc:00:00:00:01",
+				CNI: &cniAttachment{
+					Network:     "default",
+					ConfList:    []byte(`{"cniVersion":"1.0.0","name":"default","plugins":[{"type":"ptp"}]}`),
+					Result:      []byte(`{"cniVersion":"1.0.0","ips":[{"address":"10.22.0.5/16"}]}`),
+					ContainerID: "alloc",
+					IfName:      "veth0",
+					Args:        [][2]string{{"IgnoreUnknown", "true"}},
+					CacheDir:    "/var/lib/cni",
+				},
+				guestAddrs: guestAddrs{IP: ip, Gateway: net.ParseIP("10.22.0.1"), IP6: ip6},
+			}},
+		},
+		Egress: &vmEgress{Table: "fc-task", Devices: []egressDevice{{Name: "tap0"}}},
+		RunDir: runtimeDir("/run/firecracker/alloc-task"),
+	}
+
+	handle := &drivers.TaskHandle{Version: taskHandleVersion}
+	if err := handle.SetDriverState(&state); err != nil {
+		t.Fatalf("set driver state: %v", err)
+	}
+	var got TaskState
+	if err := handle.GetDriverState(&got); err != nil {
+		t.Fatalf("get driver state: %v", err)
+	}
+
+	want, gotIface := state.Network.Interfaces[0], got.Network.Interfaces[0]
+	if !reflect.DeepEqual(gotIface.CNI, want.CNI) {
+		t.Errorf("cni attachment: got %+v, want %+v", gotIface.CNI, want.CNI)
+	}
+	if gotIface.Tap != want.Tap || gotIface.IfName != want.IfName || got.Network.NetNS != state.Network.NetNS {
+		t.Errorf("interface: got %+v, want %+v", gotIface, want)
+	}
+	if gotIface.IP.String() != ip.String() || gotIface.IP6.String() != ip6.String() {
+		t.Errorf("addresses: got %v %v, want %v %v", gotIface.IP, gotIface.IP6, ip, ip6)
+	}
+	if !reflect.DeepEqual(got.Egress, state.Egress) {
+		t.Errorf("egress: got %+v, want %+v", got.Egress, state.Egress)
+	}
+	if got.RunDir != state.RunDir || !got.StartedAt.Equal(state.StartedAt) {
+		t.Errorf("got run dir %s started %v, want %s %v", got.RunDir, got.StartedAt, state.RunDir, state.StartedAt)
+	}
+}
+
+func TestCNIRuntimeConf(t *testing.T) {
+	a := &cniAttachment{ContainerID: "alloc", IfName: "veth0", Args: [][2]string{{"K", "V"}}}
+	netns := t.TempDir()
+
+	for _, tc := range []struct {
+		netns string
+		want  string
+	}{
+		{netns, netns},
+		// DEL still runs without the namespace, to release the leases
+		{netns + "/gone", ""},
+	} {
+		rt := a.runtimeConf(tc.netns)
+		if rt.NetNS != tc.want {
+			t.Errorf("netns %s: got %q, want %q", tc.netns, rt.NetNS, tc.want)
+		}
+		if rt.ContainerID != a.ContainerID || rt.IfName != a.IfName || !reflect.DeepEqual(rt.Args, a.Args) {
+			t.Errorf("runtime conf %+v does not match attachment %+v", rt, a)
+		}
+	}
+}
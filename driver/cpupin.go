@@ -0,0 +1,186 @@
+/* Firecracker-task-driver is a task driver for Hashicorp's nomad that allows
+ * to create microvms using AWS Firecracker vmm
+ * Copyright (C) 2019  Carlos Neira cneirabustos@gmail.com
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ */
+
+package firevm
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/nomad/plugins/drivers"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// vcpuThreadPrefix is the name firecracker gives its vcpu threads,
+	// followed by the vcpu index.
+	vcpuThreadPrefix = "fc_vcpu "
+
+	numaNodesDir = "/sys/devices/system/node"
+)
+
+// reservedCores returns the cores reserved for the task with
+// resources { cores = N }, nil when it only reserves cpu shares.
+func reservedCores(cfg *drivers.TaskConfig) []int {
+	if cfg.Resources == nil || cfg.Resources.NomadResources == nil {
+		return nil
+	}
+	var cores []int
+	for _, c := range cfg.Resources.NomadResources.Cpu.ReservedCores {
+		cores = append(cores, int(c))
+	}
+	return cores
+}
+
+// pinVcpus pins each vcpu thread of the firecracker process to one of the
+// reserved cores and every other thread (vmm, api) to the cores left
+// shared, within the cpus the process is allowed on.
+func pinVcpus(pid int, cores []int) error {
+	if len(cores) == 0 {
+		return nil
+	}
+
+	var allowed unix.CPUSet
+	if err := unix.SchedGetaffinity(pid, &allowed); err != nil {
+		return fmt.Errorf("Fail to read the firecracker cpu affinity: %v", err)
+	}
+	shared := sharedCores(allowed, cores)
+
+	tasks, err := os.ReadDir(fmt.Sprintf("/proc/%d/task", pid))
+	if err != nil {
+		return fmt.Errorf("Fail to list firecracker threads: %v", err)
+	}
+	for _, t := range tasks {
+		tid, err := strconv.Atoi(t.Name())
+		if err != nil {
+			continue
+		}
+		name := threadName(pid, tid)
+		if name == "" {
+			// the thread exited meanwhile
+			continue
+		}
+
+		set := shared
+		if strings.HasPrefix(name, vcpuThreadPrefix) {
+			n, err := strconv.Atoi(strings.TrimPrefix(name, vcpuThreadPrefix))
+			if err != nil {
+				continue
+			}
+			set = cpuSet(cores[n%len(cores)])
+		}
+		if err := unix.SchedSetaffinity(tid, &set); err != nil {
+			return fmt.Errorf("Fail to pin thread %q: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// sharedCores returns the cores allowed minus the cores reserved for the
+// task. The allowed cores are the ones of the task cpuset when the vmm runs
+// in the task cgroups, nothing is left then and the vmm threads share the
+// allowed cores with the vcpus.
+func sharedCores(allowed unix.CPUSet, reserved []int) unix.CPUSet {
+	set := allowed
+	for _, c := range reserved {
+		set.Clear(c)
+	}
+	if set.Count() == 0 {
+		return allowed
+	}
+	return set
+}
+
+func cpuSet(cores ...int) unix.CPUSet {
+	var set unix.CPUSet
+	for _, c := range cores {
+		set.Set(c)
+	}
+	return set
+}
+
+// numaNodeOf returns the numa node all of the cores belong to.
+func numaNodeOf(cores []int) (int, error) {
+	nodes, err := filepath.Glob(filepath.Join(numaNodesDir, "node[0-9]*"))
+	if err != nil || len(nodes) == 0 {
+		return 0, fmt.Errorf("Fail to read numa topology: no node found in %s", numaNodesDir)
+	}
+
+	found := -1
+	for _, n := range nodes {
+		node, err := strconv.Atoi(strings.TrimPrefix(filepath.Base(n), "node"))
+		if err != nil {
+			continue
+		}
+		list, err := os.ReadFile(filepath.Join(n, "cpulist"))
+		if err != nil {
+			return 0, err
+		}
+		cpus, err := parseCPUList(strings.TrimSpace(string(list)))
+		if err != nil {
+			return 0, err
+		}
+		in := 0
+		for _, c := range cores {
+			if cpus[c] {
+				in++
+			}
+		}
+		switch {
+		case in == 0:
+		case in == len(cores):
+			found = node
+		default:
+			return 0, fmt.Errorf("reserved cores %v span several numa nodes", cores)
+		}
+	}
+	if found < 0 {
+		return 0, fmt.Errorf("reserved cores %v don't belong to any numa node", cores)
+	}
+	return found, nil
+}
+
+// parseCPUList parses a kernel cpu list such as 0-3,8,10-11.
+func parseCPUList(list string) (map[int]bool, error) {
+	cpus := map[int]bool{}
+	if list == "" {
+		return cpus, nil
+	}
+	for _, r := range strings.Split(list, ",") {
+		bounds := strings.SplitN(r, "-", 2)
+		lo, err := strconv.Atoi(bounds[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid cpu list %q", list)
+		}
+		hi := lo
+		if len(bounds) == 2 {
+			if hi, err = strconv.Atoi(bounds[1]); err != nil {
+				return nil, fmt.Errorf("invalid cpu list %q", list)
+			}
+		}
+		for c := lo; c <= hi; c++ {
+			cpus[c] = true
+		}
+	}
+	return cpus, nil
+}
+
+// threadName returns the name of a thread of pid, empty when it exited.
+func threadName(pid, tid int) string {
+	comm, err := os.ReadFile(fmt.Sprintf("/proc/%d/task/%d/comm", pid, tid))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(comm))
+}
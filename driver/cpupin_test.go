@@ -0,0 +1,62 @@
+/* Firecracker-task-driver is a task driver for Hashicorp's nomad that allows
+ * to create microvms using AWS Firecracker vmm
+ * Copyright (C) 2019  Carlos Neira cneirabustos@gmail.com
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ */
+
+package firevm
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSharedCores(t *testing.T) {
+	cases := []struct {
+		name     string
+		allowed  []int
+		reserved []int
+		want     []int
+	}{
+		{"host affinity", []int{0, 1, 2, 3}, []int{2, 3}, []int{0, 1}},
+		{"task cpuset", []int{2, 3}, []int{2, 3}, []int{2, 3}},
+		{"all reserved", []int{0, 1}, []int{0, 1}, []int{0, 1}},
+	}
+	for _, c := range cases {
+		got := sharedCores(cpuSet(c.allowed...), c.reserved)
+		if got != cpuSet(c.want...) {
+			t.Errorf("%s: sharedCores(%v, %v) has %d cpus, want %v", c.name, c.allowed, c.reserved, got.Count(), c.want)
+		}
+	}
+}
+
+func TestParseCPUList(t *testing.T) {
+	cases := []struct {
+		list string
+		want map[int]bool
+		err  bool
+	}{
+		{list: "", want: map[int]bool{}},
+		{list: "3", want: map[int]bool{3: true}},
+		{list: "0-2,8,10-11", want: map[int]bool{0: true, 1: true, 2: true, 8: true, 10: true, 11: true}},
+		{list: "a-b", err: true},
+		{list: "1-x", err: true},
+	}
+	for _, c := range cases {
+		got, err := parseCPUList(c.list)
+		if c.err {
+			if err == nil {
+				t.Errorf("parseCPUList(%q) = %v, want an error", c.list, got)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, c.want) {
+			t.Errorf("parseCPUList(%q) = %v, %v, want %v", c.list, got, err, c.want)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+/* Firecracker-task-driver is a task driver for Hashicorp's nomad that allows
+ * to create microvms using AWS Firecracker vmm
+ * Copyright (C) 2019  Carlos Neira cneirabustos@gmail.com
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ */
+
+package firevm
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+
+	firecracker "github.com/firecracker-microvm/firecracker-go-sdk"
+)
+
+const (
+	setCPUConfigHandlerName = "fcdriver.SetCPUConfig"
+
+	cpuTemplateNone = "None"
+
+	// neoverseV1Part is the arm cpu part number of the graviton3 cores the
+	// V1N1 template is made for.
+	neoverseV1Part = "0xd40"
+)
+
+// staticCPUTemplates are the templates built into firecracker, by the cpu
+// vendor able to run them.
+var staticCPUTemplates = map[string][]string{
+	"GenuineIntel": {"C3", "T2", "T2CL", "T2S"},
+	"AuthenticAMD": {"T2A"},
+	neoverseV1Part: {"V1N1"},
+}
+
+// cpuTemplate is the template selected by a task, either a static
+// template name or the content of a custom template file.
+type cpuTemplate struct {
+	Static string
+	Custom json.RawMessage
+}
+
+// resolveCPUTemplate looks up the template of the task. Cputype names a
+// static template or a custom one stored as <name>.json in the plugin
+// cpu_template_dir, jobs never read template files from elsewhere.
+func resolveCPUTemplate(dir string, taskConfig TaskConfig) (cpuTemplate, error) {
+	name := taskConfig.Cputype
+	if name == "" || name == cpuTemplateNone {
+		return cpuTemplate{}, nil
+	}
+	if isStaticCPUTemplate(name) {
+		for _, t := range hostStaticCPUTemplates() {
+			if t == name {
+				return cpuTemplate{Static: name}, nil
+			}
+		}
+		return cpuTemplate{}, fmt.Errorf("CPU template %s can't run on this host", name)
+	}
+	if dir == "" || strings.ContainsRune(name, filepath.Separator) {
+		return cpuTemplate{}, fmt.Errorf("unknown CPU template %s", name)
+	}
+	path := filepath.Join(dir, name+".json")
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return cpuTemplate{}, fmt.Errorf("unknown CPU template %s", name)
+	}
+	custom, err := readCPUTemplate(path)
+	if err != nil {
+		return cpuTemplate{}, err
+	}
+	return cpuTemplate{Custom: custom}, nil
+}
+
+func readCPUTemplate(path string) (json.RawMessage, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Fail to read CPU template: %v", err)
+	}
+	var tmpl map[string]json.RawMessage
+	if err := json.Unmarshal(data, &tmpl); err != nil {
+		return nil, fmt.Errorf("Fail to parse CPU template %s: %v", path, err)
+	}
+	return json.RawMessage(data), nil
+}
+
+// setCPUConfigHandler loads a custom cpu template before the machine is
+// configured.
+func setCPUConfigHandler(tmpl json.RawMessage) firecracker.Handler {
+	return firecracker.Handler{
+		Name: setCPUConfigHandlerName,
+		Fn: func(ctx context.Context, m *firecracker.Machine) error {
+			return putAPI(ctx, m.Cfg.SocketPath, "/cpu-config", tmpl)
+		},
+	}
+}
+
+func isStaticCPUTemplate(name string) bool {
+	for _, templates := range staticCPUTemplates {
+		for _, t := range templates {
+			if t == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// hostStaticCPUTemplates returns the static templates the host cpu can run.
+func hostStaticCPUTemplates() []string {
+	f, err := os.Open("/proc/cpuinfo")
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), ":")
+		if !ok {
+			continue
+		}
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		if (key == "vendor_id" && runtime.GOARCH == "amd64") || (key == "CPU part" && runtime.GOARCH == "arm64") {
+			return staticCPUTemplates[value]
+		}
+	}
+	return nil
+}
+
+// hostCPUTemplates lists the static templates supported by the host cpu
+// followed by the custom templates of dir.
+func hostCPUTemplates(dir string) []string {
+	templates := append([]string{}, hostStaticCPUTemplates()...)
+	if dir == "" {
+		return templates
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+	var custom []string
+	for _, f := range files {
+		if _, err := readCPUTemplate(f); err == nil {
+			custom = append(custom, strings.TrimSuffix(filepath.Base(f), ".json"))
+		}
+	}
+	sort.Strings(custom)
+	return append(templates, custom...)
+}
+
+// smtEnabled reports whether the guest gets simultaneous multithreading.
+// It is off unless the task sets DisableHt = false, and firecracker only
+// supports it on x86_64.
+func smtEnabled(taskConfig TaskConfig) bool {
+	return taskConfig.DisableHt != nil && !*taskConfig.DisableHt && runtime.GOARCH == "amd64"
+}
@@ -0,0 +1,162 @@
+/* Firecracker-task-driver is a task driver for Hashicorp's nomad that allows
+ * to create microvms using AWS Firecracker vmm
+ * Copyright (C) 2019  Carlos Neira cneirabustos@gmail.com
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ */
+
+package firevm
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+const (
+	// dnsDriveID is the drive holding the generated resolv.conf and hosts
+	dnsDriveID        = "nomad_dns"
+	dnsDriveMountPath = "/run/nomad-dns"
+)
+
+// guestDNS is the resolver config of the guest.
+type guestDNS struct {
+	Servers  []string `json:"servers,omitempty"`
+	Searches []string `json:"searches,omitempty"`
+	Options  []string `json:"options,omitempty"`
+}
+
+// extraHost is an extra_hosts entry, host:ip like docker's.
+type extraHost struct {
+	Host string `json:"host"`
+	IP   string `json:"ip"`
+}
+
+func (d guestDNS) empty() bool {
+	return len(d.Servers) == 0 && len(d.Searches) == 0 && len(d.Options) == 0
+}
+
+// taskDNS returns the dns block nomad gives the task.
+func taskDNS(cfg *drivers.TaskConfig) guestDNS {
+	if cfg.DNS == nil {
+		return guestDNS{}
+	}
+	return guestDNS{
+		Servers:  cfg.DNS.Servers,
+		Searches: cfg.DNS.Searches,
+		Options:  cfg.DNS.Options,
+	}
+}
+
+// kernelNameservers returns the first two ipv4 servers, the most the
+// kernel ip= argument takes.
+func (d guestDNS) kernelNameservers() []string {
+	var servers []string
+	for _, s := range d.Servers {
+		if ip := net.ParseIP(s); ip != nil && ip.To4() != nil && len(servers) < 2 {
+			servers = append(servers, s)
+		}
+	}
+	return servers
+}
+
+// resolvConf renders the config in resolv.conf(5) format.
+func (d guestDNS) resolvConf() string {
+	var b strings.Builder
+	for _, s := range d.Servers {
+		fmt.Fprintf(&b, "nameserver %s\n", s)
+	}
+	if len(d.Searches) > 0 {
+		fmt.Fprintf(&b, "search %s\n", strings.Join(d.Searches, " "))
+	}
+	if len(d.Options) > 0 {
+		fmt.Fprintf(&b, "options %s\n", strings.Join(d.Options, " "))
+	}
+	return b.String()
+}
+
+// parseExtraHosts parses the extra_hosts entries, the address may be ipv6
+// as the host name ends at the first colon.
+func parseExtraHosts(entries []string) ([]extraHost, error) {
+	var hosts []extraHost
+	for _, e := range entries {
+		parts := strings.SplitN(e, ":", 2)
+		if len(parts) != 2 || parts[0] == "" || net.ParseIP(parts[1]) == nil {
+			return nil, fmt.Errorf("invalid extra_hosts entry %q, must be host:ip", e)
+		}
+		hosts = append(hosts, extraHost{Host: parts[0], IP: parts[1]})
+	}
+	return hosts, nil
+}
+
+// hostsFile renders the loopback entries and the extra hosts in hosts(5)
+// format.
+func hostsFile(hosts []extraHost) string {
+	var b strings.Builder
+	b.WriteString("127.0.0.1\tlocalhost\n")
+	b.WriteString("::1\tlocalhost ip6-localhost ip6-loopback\n")
+	for _, h := range hosts {
+		fmt.Fprintf(&b, "%s\t%s\n", h.IP, h.Host)
+	}
+	return b.String()
+}
+
+// prepareDNSDrive packs the generated resolv.conf and hosts into a read-only
+// drive the guest finds through the mount hints.
+func prepareDNSDrive(cfg *drivers.TaskConfig, dns guestDNS, hosts []extraHost) (taskDirDrive, error) {
+	imageDir, err := taskImageDir(cfg)
+	if err != nil {
+		return taskDirDrive{}, err
+	}
+	t := taskDirDrive{
+		ID:        dnsDriveID,
+		Name:      "dns",
+		HostDir:   filepath.Join(imageDir, "dns"),
+		MountPath: dnsDriveMountPath,
+		Image:     filepath.Join(imageDir, "dns."+taskDirFormatExt4),
+		Format:    taskDirFormatExt4,
+		ReadOnly:  true,
+	}
+	if err := os.MkdirAll(t.HostDir, 0755); err != nil {
+		return t, err
+	}
+	files := map[string]string{
+		"resolv.conf": dns.resolvConf(),
+		"hosts":       hostsFile(hosts),
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(t.HostDir, name), []byte(content), 0644); err != nil {
+			return t, err
+		}
+	}
+	if err := t.build(); err != nil {
+		return t, fmt.Errorf("Fail to pack the dns drive: %v", err)
+	}
+	return t, nil
+}
+
+// guestDNS returns the resolver config of the guest: nomad's dns block when
+// the task has one, otherwise the nameservers of the network, so the guest
+// gets the same config whatever the network backend.
+func (opts *options) guestDNS() guestDNS {
+	if !opts.FcDNS.empty() {
+		return opts.FcDNS
+	}
+	if len(opts.FcNicConfig.Nameservers) > 0 {
+		return guestDNS{Servers: opts.FcNicConfig.Nameservers}
+	}
+	for _, iface := range opts.FcInterfaces {
+		if !iface.DNS.empty() {
+			return iface.DNS
+		}
+	}
+	return guestDNS{}
+}
@@ -0,0 +1,136 @@
+/* Firecracker-task-driver is a task driver for Hashicorp's nomad that allows
+ * to create microvms using AWS Firecracker vmm
+ * Copyright (C) 2019  Carlos Neira cneirabustos@gmail.com
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ */
+
+package firevm
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+func TestParseExtraHosts(t *testing.T) {
+	cases := []struct {
+		entries []string
+		want    []extraHost
+		ok      bool
+	}{
+		{nil, nil, true},
+		{[]string{"db:10.0.0.5"}, []extraHost{{Host: "db", IP: "10.0.0.5"}}, true},
+		{[]string{"db6:fd00::5", "cache:10.0.0.6"}, []extraHost{{Host: "db6", IP: "fd00::5"}, {Host: "cache", IP: "10.0.0.6"}}, true},
+		{[]string{"db"}, nil, false},
+		{[]string{":10.0.0.5"}, nil, false},
+		{[]string{"db:"}, nil, false},
+		{[]string{"db:db.example.com"}, nil, false},
+	}
+	for _, c := range cases {
+		got, err := parseExtraHosts(c.entries)
+		if (err == nil) != c.ok || !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%v: got %+v, %v, want %+v, ok=%v", c.entries, got, err, c.want, c.ok)
+		}
+	}
+}
+
+func TestHostsFile(t *testing.T) {
+	got := hostsFile([]extraHost{{Host: "db", IP: "10.0.0.5"}, {Host: "db6", IP: "fd00::5"}})
+	want := "127.0.0.1\tlocalhost\n" +
+		"::1\tlocalhost ip6-localhost ip6-loopback\n" +
+		"10.0.0.5\tdb\n" +
+		"fd00::5\tdb6\n"
+	if got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestResolvConf(t *testing.T) {
+	cases := []struct {
+		name string
+		dns  guestDNS
+		want string
+	}{
+		{"empty", guestDNS{}, ""},
+		{"servers", guestDNS{Servers: []string{"10.0.0.53", "fd00::53"}}, "nameserver 10.0.0.53\nnameserver fd00::53\n"},
+		{
+			"full",
+			guestDNS{Servers: []string{"10.0.0.53"}, Searches: []string{"service.consul", "example.com"}, Options: []string{"ndots:2", "edns0"}},
+			"nameserver 10.0.0.53\nsearch service.consul example.com\noptions ndots:2 edns0\n",
+		},
+	}
+	for _, c := range cases {
+		if got := c.dns.resolvConf(); got != c.want {
+			t.Errorf("%s: got %q, want %q", c.name, got, c.want)
+		}
+	}
+}
+
+func TestKernelNameservers(t *testing.T) {
+	dns := guestDNS{Servers: []string{"fd00::53", "10.0.0.53", "dns.example.com", "10.0.0.54", "10.0.0.55"}}
+	want := []string{"10.0.0.53", "10.0.0.54"}
+	if got := dns.kernelNameservers(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestGuestDNS(t *testing.T) {
+	task := guestDNS{Servers: []string{"10.0.0.53"}, Searches: []string{"service.consul"}}
+	cni := guestDNS{Servers: []string{"10.22.0.1"}}
+	cases := []struct {
+		name string
+		opts options
+		want guestDNS
+	}{
+		{"none", options{}, guestDNS{}},
+		{"nomad dns block", options{FcDNS: task, FcNicConfig: Nic{Nameservers: []string{"1.1.1.1"}}}, task},
+		{"nic nameservers", options{FcNicConfig: Nic{Nameservers: []string{"1.1.1.1"}}}, guestDNS{Servers: []string{"1.1.1.1"}}},
+		{"cni result", options{FcInterfaces: []netInterface{{Name: "eth0"}, {Name: "eth1", DNS: cni}}}, cni},
+	}
+	for _, c := range cases {
+		if got := c.opts.guestDNS(); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: got %+v, want %+v", c.name, got, c.want)
+		}
+	}
+
+	cfg := &drivers.TaskConfig{DNS: &drivers.DNSConfig{Servers: []string{"10.0.0.53"}, Options: []string{"ndots:2"}}}
+	if got := taskDNS(cfg); !reflect.DeepEqual(got, guestDNS{Servers: []string{"10.0.0.53"}, Options: []string{"ndots:2"}}) {
+		t.Errorf("got %+v from the nomad dns block", got)
+	}
+	if got := taskDNS(&drivers.TaskConfig{}); !got.empty() {
+		t.Errorf("got %+v without a nomad dns block", got)
+	}
+}
+
+func TestPrepareDNSDrive(t *testing.T) {
+	if _, err := exec.LookPath("mkfs.ext4"); err != nil {
+		t.Skip("mkfs.ext4 is not installed")
+	}
+	cfg := &drivers.TaskConfig{AllocDir: t.TempDir(), Name: "web"}
+	dns := guestDNS{Servers: []string{"10.0.0.53"}}
+	drive, err := prepareDNSDrive(cfg, dns, []extraHost{{Host: "db", IP: "10.0.0.5"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if drive.ID != dnsDriveID || drive.MountPath != dnsDriveMountPath || !drive.ReadOnly {
+		t.Errorf("got drive %+v", drive)
+	}
+	for name, want := range map[string]string{"resolv.conf": dns.resolvConf(), "hosts": hostsFile([]extraHost{{Host: "db", IP: "10.0.0.5"}})} {
+		b, err := os.ReadFile(filepath.Join(drive.HostDir, name))
+		if err != nil || string(b) != want {
+			t.Errorf("%s: got %q, %v, want %q", name, b, err, want)
+		}
+	}
+	if ok, err := isExt4(drive.Image); !ok || err != nil {
+		t.Errorf("dns drive is not ext4: %v", err)
+	}
+}
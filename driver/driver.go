@@ -23,10 +23,12 @@ package firevm
 import (
 	"context"
 	"fmt"
+	"strings"
+	"sync"
 	"time"
 
+	metrics "github.com/armon/go-metrics"
 	hclog "github.com/hashicorp/go-hclog"
-	"github.com/hashicorp/nomad/client/lib/cpustats"
 	"github.com/hashicorp/nomad/drivers/shared/eventer"
 	"github.com/hashicorp/nomad/plugins/base"
 	"github.com/hashicorp/nomad/plugins/drivers"
@@ -55,6 +57,43 @@ var (
 		Name:              pluginName,
 	}
 
+	// configSpec is the hcl specification returned by the ConfigSchema RPC
+	configSpec = hclspec.NewObject(map[string]*hclspec.Spec{
+		"nomad_address":         hclspec.NewAttr("nomad_address", "string", false),
+		"nomad_token":           hclspec.NewAttr("nomad_token", "string", false),
+		"nomad_ca_cert":         hclspec.NewAttr("nomad_ca_cert", "string", false),
+		"nomad_client_cert":     hclspec.NewAttr("nomad_client_cert", "string", false),
+		"nomad_client_key":      hclspec.NewAttr("nomad_client_key", "string", false),
+		"nomad_tls_server_name": hclspec.NewAttr("nomad_tls_server_name", "string", false),
+		"persistent_disk_dir":   hclspec.NewAttr("persistent_disk_dir", "string", false),
+		"cgroup_parent":         hclspec.NewAttr("cgroup_parent", "string", false),
+		"cpu_template_dir":      hclspec.NewAttr("cpu_template_dir", "string", false),
+		"runtime_dir":           hclspec.NewAttr("runtime_dir", "string", false),
+		"allow_host_log_paths":  hclspec.NewAttr("allow_host_log_paths", "bool", false),
+		"bridge": hclspec.NewBlock("bridge", false, hclspec.NewObject(map[string]*hclspec.Spec{
+			"name":     hclspec.NewAttr("name", "string", false),
+			"subnet":   hclspec.NewAttr("subnet", "string", true),
+			"gateway":  hclspec.NewAttr("gateway", "string", false),
+			"nat":      hclspec.NewAttr("nat", "bool", false),
+			"ipam_dir": hclspec.NewAttr("ipam_dir", "string", false),
+		})),
+		"gc": hclspec.NewBlock("gc", false, hclspec.NewObject(map[string]*hclspec.Spec{
+			"disabled":     hclspec.NewAttr("disabled", "bool", false),
+			"interval":     hclspec.NewAttr("interval", "string", false),
+			"grace_period": hclspec.NewAttr("grace_period", "string", false),
+			"dry_run":      hclspec.NewAttr("dry_run", "bool", false),
+		})),
+		"telemetry": hclspec.NewBlock("telemetry", false, hclspec.NewObject(map[string]*hclspec.Spec{
+			"prometheus_address": hclspec.NewAttr("prometheus_address", "string", false),
+			"statsd_address":     hclspec.NewAttr("statsd_address", "string", false),
+			"statsite_address":   hclspec.NewAttr("statsite_address", "string", false),
+		})),
+		"vmm_overhead_mb": hclspec.NewDefault(
+			hclspec.NewAttr("vmm_overhead_mb", "number", false),
+			hclspec.NewLiteral("32"),
+		),
+	})
+
 	// taskConfigSpec is the hcl specification for the driver config section of
 	// a task within a job. It is returned in the TaskConfigSchema RPC
 	taskConfigSpec = hclspec.NewObject(map[string]*hclspec.Spec{
@@ -69,20 +108,91 @@ var (
 		"Firecracker": hclspec.NewAttr("Firecracker", "string", false),
 		"Log":         hclspec.NewAttr("Log", "string", false),
 		"DisableHt":   hclspec.NewAttr("DisableHt", "bool", false),
+		"NumaBind":    hclspec.NewAttr("NumaBind", "bool", false),
+		"HugePages":   hclspec.NewAttr("HugePages", "string", false),
 		"Nic": hclspec.NewBlock("Nic", false, hclspec.NewObject(map[string]*hclspec.Spec{
 			"Ip":          hclspec.NewAttr("Ip", "string", true),
 			"Gateway":     hclspec.NewAttr("Gateway", "string", true),
 			"Interface":   hclspec.NewAttr("Interface", "string", true),
 			"Nameservers": hclspec.NewAttr("Nameservers", "list(string)", true),
+			"Ip6":         hclspec.NewAttr("Ip6", "string", false),
+			"Gateway6":    hclspec.NewAttr("Gateway6", "string", false),
+		})),
+		"TaskDirs": hclspec.NewBlock("TaskDirs", false, hclspec.NewObject(map[string]*hclspec.Spec{
+			"Dirs":      hclspec.NewAttr("Dirs", "list(string)", true),
+			"Format":    hclspec.NewAttr("Format", "string", false),
+			"SyncAlloc": hclspec.NewAttr("SyncAlloc", "bool", false),
+		})),
+		"RootfsSizeMB": hclspec.NewAttr("RootfsSizeMB", "number", false),
+		"GrowRootfs":   hclspec.NewAttr("GrowRootfs", "bool", false),
+		"scratch_disk": hclspec.NewBlockList("scratch_disk", hclspec.NewObject(map[string]*hclspec.Spec{
+			"size_mb": hclspec.NewAttr("size_mb", "number", true),
+			"fs_type": hclspec.NewDefault(
+				hclspec.NewAttr("fs_type", "string", false),
+				hclspec.NewLiteral(`"ext4"`),
+			),
+			"label": hclspec.NewAttr("label", "string", false),
 		})),
+		"persistent_disk": hclspec.NewBlockList("persistent_disk", hclspec.NewObject(map[string]*hclspec.Spec{
+			"name":    hclspec.NewAttr("name", "string", true),
+			"size_mb": hclspec.NewAttr("size_mb", "number", true),
+			"fs_type": hclspec.NewDefault(
+				hclspec.NewAttr("fs_type", "string", false),
+				hclspec.NewLiteral(`"ext4"`),
+			),
+			"read_only": hclspec.NewAttr("read_only", "bool", false),
+		})),
+		"log_level":            hclspec.NewAttr("log_level", "string", false),
+		"log_max_files":        hclspec.NewAttr("log_max_files", "number", false),
+		"log_max_file_size_mb": hclspec.NewAttr("log_max_file_size_mb", "number", false),
+		"extra_hosts":          hclspec.NewAttr("extra_hosts", "list(string)", false),
+		"dns_drive":            hclspec.NewAttr("dns_drive", "bool", false),
+		"network_interface": hclspec.NewBlockList("network_interface", hclspec.NewObject(map[string]*hclspec.Spec{
+			"type":           hclspec.NewAttr("type", "string", true),
+			"network":        hclspec.NewAttr("network", "string", false),
+			"args":           hclspec.NewAttr("args", "map(string)", false),
+			"tap":            hclspec.NewAttr("tap", "string", false),
+			"ip":             hclspec.NewAttr("ip", "string", false),
+			"gateway":        hclspec.NewAttr("gateway", "string", false),
+			"ip6":            hclspec.NewAttr("ip6", "string", false),
+			"gateway6":       hclspec.NewAttr("gateway6", "string", false),
+			"mac":            hclspec.NewAttr("mac", "string", false),
+			"mac_from_alloc": hclspec.NewAttr("mac_from_alloc", "bool", false),
+			"mtu":            hclspec.NewAttr("mtu", "number", false),
+			"rx_bandwidth":   hclspec.NewAttr("rx_bandwidth", "number", false),
+			"tx_bandwidth":   hclspec.NewAttr("tx_bandwidth", "number", false),
+			"rx_ops":         hclspec.NewAttr("rx_ops", "number", false),
+			"tx_ops":         hclspec.NewAttr("tx_ops", "number", false),
+			"allow_mmds":     hclspec.NewAttr("allow_mmds", "bool", false),
+		})),
+		"egress": hclspec.NewBlock("egress", false, hclspec.NewObject(map[string]*hclspec.Spec{
+			"allow": hclspec.NewBlockList("allow", hclspec.NewObject(map[string]*hclspec.Spec{
+				"cidr":     hclspec.NewAttr("cidr", "string", true),
+				"protocol": hclspec.NewAttr("protocol", "string", false),
+				"ports":    hclspec.NewAttr("ports", "list(string)", false),
+			})),
+		})),
+		"balloon": hclspec.NewBlock("balloon", false, hclspec.NewObject(map[string]*hclspec.Spec{
+			"amount_mb":      hclspec.NewAttr("amount_mb", "number", false),
+			"deflate_on_oom": hclspec.NewAttr("deflate_on_oom", "bool", false),
+			"stats_interval": hclspec.NewAttr("stats_interval", "string", false),
+		})),
+		"ports":         hclspec.NewAttr("ports", "list(string)", false),
+		"ready_marker":  hclspec.NewAttr("ready_marker", "string", false),
+		"ready_timeout": hclspec.NewAttr("ready_timeout", "string", false),
 	})
 
 	// capabilities is returned by the Capabilities RPC and indicates what
 	// optional features this driver supports
 	capabilities = &drivers.Capabilities{
-		SendSignals: false,
-		Exec:        false,
-		FSIsolation: drivers.FSIsolationImage,
+		SendSignals:  false,
+		Exec:         false,
+		FSIsolation:  drivers.FSIsolationImage,
+		MountConfigs: drivers.MountConfigSupportAll,
+		NetIsolationModes: []drivers.NetIsolationMode{
+			drivers.NetIsolationModeHost,
+			drivers.NetIsolationModeGroup,
+		},
 	}
 )
 
@@ -110,16 +220,157 @@ type Driver struct {
 
 	// logger will log to the Nomad agent
 	logger hclog.Logger
+
+	// gcLock guards the config of the running garbage collector, stopGC
+	// stops it and waits for its sweep to end
+	gcLock sync.Mutex
+	gc     *GCConfig
+	stopGC func()
+
+	// telemetry is the config the metric sinks were set up with, nil until
+	// a setup succeeded. stopTelemetry stops the prometheus listener and
+	// the gauges, prom is the sink of the prometheus endpoint when enabled
+	telemetryLock sync.Mutex
+	telemetry     *TelemetryConfig
+	stopTelemetry func()
+	prom          *promSink
 }
 
 // Config is the driver configuration set by the SetConfig RPC call
 type Config struct {
+	// NomadAddress is the http address of the local nomad agent, used to
+	// look up allocation details the task config doesn't carry.
+	NomadAddress string `codec:"nomad_address"`
+
+	// NomadToken is the ACL token used against the local agent when the
+	// task doesn't expose its workload identity.
+	NomadToken string `codec:"nomad_token"`
+
+	// The TLS files and server name used against an https agent, they
+	// default to the NOMAD_CACERT, NOMAD_CLIENT_CERT, NOMAD_CLIENT_KEY and
+	// NOMAD_TLS_SERVER_NAME variables of the nomad cli.
+	NomadCACert        string `codec:"nomad_ca_cert"`
+	NomadClientCert    string `codec:"nomad_client_cert"`
+	NomadClientKey     string `codec:"nomad_client_key"`
+	NomadTLSServerName string `codec:"nomad_tls_server_name"`
+
+	// PersistentDiskDir holds the named persistent disks, they are only
+	// available when it is set.
+	PersistentDiskDir string `codec:"persistent_disk_dir"`
+
+	// CgroupParent is the cgroup_parent of the nomad client, when it isn't
+	// the default one.
+	CgroupParent string `codec:"cgroup_parent"`
+
+	// CPUTemplateDir holds custom cpu templates, named <Cputype>.json.
+	CPUTemplateDir string `codec:"cpu_template_dir"`
+
+	// Bridge configures the built-in bridge network used by tasks with
+	// Network = "bridge".
+	Bridge BridgeConfig `codec:"bridge"`
+
+	// RuntimeDir is the root of the per-task runtime directories,
+	// /run/nomad-firecracker when it is empty.
+	RuntimeDir string `codec:"runtime_dir"`
+
+	// AllowHostLogPaths lets tasks write the firecracker log anywhere on the
+	// host with Log, not only in alloc/logs.
+	AllowHostLogPaths bool `codec:"allow_host_log_paths"`
+
+	// GC tunes the garbage collector of orphaned micro-vms and resources.
+	GC GCConfig `codec:"gc"`
+
+	// Telemetry sets where the metrics of the plugin and micro-vms go.
+	Telemetry TelemetryConfig `codec:"telemetry"`
+
+	// VMMOverheadMB is the memory of the task reservation left to the
+	// firecracker process when sizing the guest.
+	VMMOverheadMB int64 `codec:"vmm_overhead_mb"`
 }
 type Nic struct {
-	Ip          string // CIDR
+	Ip          string // CIDR, ipv4 or ipv6
 	Gateway     string
 	Interface   string
 	Nameservers []string
+	Ip6         string // second address of a dual-stack nic
+	Gateway6    string
+}
+
+// BridgeConfig is the linux bridge the taps of the micro-vms are attached
+// to, with the subnet their addresses are leased from.
+type BridgeConfig struct {
+	Name    string `codec:"name"`
+	Subnet  string `codec:"subnet"`
+	Gateway string `codec:"gateway"`
+	NAT     bool   `codec:"nat"`
+	IPAMDir string `codec:"ipam_dir"`
+}
+
+// NetworkInterface is a guest interface backed by a CNI network, an
+// existing tap device or the plugin bridge. Rates are per second, in bytes
+// for the bandwidth.
+type NetworkInterface struct {
+	Type         string            `codec:"type"` // cni, tap or bridge
+	Network      string            `codec:"network"`
+	Args         map[string]string `codec:"args"`
+	Tap          string            `codec:"tap"`
+	IP           string            `codec:"ip"` // CIDR, ipv4 or ipv6
+	Gateway      string            `codec:"gateway"`
+	IP6          string            `codec:"ip6"` // second address of a dual-stack interface
+	Gateway6     string            `codec:"gateway6"`
+	Mac          string            `codec:"mac"`
+	MacFromAlloc bool              `codec:"mac_from_alloc"`
+	MTU          int               `codec:"mtu"`
+	RxBandwidth  int64             `codec:"rx_bandwidth"`
+	TxBandwidth  int64             `codec:"tx_bandwidth"`
+	RxOps        int64             `codec:"rx_ops"`
+	TxOps        int64             `codec:"tx_ops"`
+	AllowMMDS    bool              `codec:"allow_mmds"`
+}
+
+// BalloonConfig is the balloon device of the micro-vm, the guest reports its
+// memory usage through it.
+type BalloonConfig struct {
+	AmountMB      int64  `codec:"amount_mb"`
+	DeflateOnOOM  bool   `codec:"deflate_on_oom"`
+	StatsInterval string `codec:"stats_interval"`
+}
+
+// EgressPolicy restricts what the micro-vm can reach, the traffic no allow
+// rule matches is dropped.
+type EgressPolicy struct {
+	Allow []EgressRule `codec:"allow"`
+}
+
+// EgressRule allows the traffic to a CIDR, optionally only for a protocol
+// and ports or port ranges like "8500-8502".
+type EgressRule struct {
+	CIDR     string   `codec:"cidr"`
+	Protocol string   `codec:"protocol"` // tcp, udp, icmp or any
+	Ports    []string `codec:"ports"`
+}
+
+// TaskDirs selects the task directories (local, secrets, alloc) exposed to
+// the micro-vm as drives.
+type TaskDirs struct {
+	Dirs      []string
+	Format    string // ext4 or raw
+	SyncAlloc bool
+}
+
+// ScratchDisk is a throwaway data disk created for the task
+type ScratchDisk struct {
+	SizeMB int64  `codec:"size_mb"`
+	FsType string `codec:"fs_type"` // ext4, xfs or raw
+	Label  string `codec:"label"`
+}
+
+// PersistentDisk is a named disk reattached to every allocation of the job
+type PersistentDisk struct {
+	Name     string `codec:"name"`
+	SizeMB   int64  `codec:"size_mb"`
+	FsType   string `codec:"fs_type"` // ext4, xfs or raw
+	ReadOnly bool   `codec:"read_only"`
 }
 
 // TaskConfig is the driver configuration of a task within a job
@@ -135,7 +386,35 @@ type TaskConfig struct {
 	Mem         uint64   `codec:"Mem"`
 	Firecracker string   `codec:"Firecracker"`
 	Log         string   `code:"Log"`
-	DisableHt   bool     `code:"DisableHt"`
+	DisableHt   *bool    `code:"DisableHt"` // unset keeps hyperthreading off
+	NumaBind    bool     `codec:"NumaBind"`
+	HugePages   string   `codec:"HugePages"`
+
+	TaskDirs TaskDirs `codec:"TaskDirs"`
+
+	RootfsSizeMB int64         `codec:"RootfsSizeMB"`
+	GrowRootfs   bool          `codec:"GrowRootfs"`
+	ScratchDisks []ScratchDisk `codec:"scratch_disk"`
+
+	PersistentDisks []PersistentDisk `codec:"persistent_disk"`
+
+	NetworkInterfaces []NetworkInterface `codec:"network_interface"`
+
+	ExtraHosts []string `codec:"extra_hosts"` // host:ip
+	DNSDrive   bool     `codec:"dns_drive"`
+
+	Egress *EgressPolicy `codec:"egress"`
+
+	Ports []string `codec:"ports"` // port labels forwarded in a group network
+
+	LogLevel         string `codec:"log_level"` // Error, Warning, Info or Debug
+	LogMaxFiles      int    `codec:"log_max_files"`
+	LogMaxFileSizeMB int64  `codec:"log_max_file_size_mb"`
+
+	Balloon *BalloonConfig `codec:"balloon"`
+
+	ReadyMarker  string `codec:"ready_marker"`
+	ReadyTimeout string `codec:"ready_timeout"`
 }
 
 // TaskState is the state which is encoded in the handle returned in
@@ -145,6 +424,20 @@ type TaskState struct {
 	TaskConfig    *drivers.TaskConfig
 	ContainerName string
 	StartedAt     time.Time
+
+	// Network and Egress are what the host side of the micro-vm network
+	// is torn down from, CNI configs and results included.
+	Network *vmNetwork
+	Egress  *vmEgress
+
+	// what a recovered task reattaches to when its micro-vm still runs
+	RunDir          runtimeDir
+	TaskDirs        []taskDirDrive
+	ScratchDisks    []scratchDrive
+	PersistentDisks []persistentDrive
+	Cgroup          *vmCgroup
+	Bridge          *bridgeNetwork
+	Group           *groupNetwork
 }
 
 func NewFirecrackerDriver(logger hclog.Logger) drivers.DriverPlugin {
@@ -165,7 +458,7 @@ func (d *Driver) PluginInfo() (*base.PluginInfoResponse, error) {
 }
 
 func (d *Driver) ConfigSchema() (*hclspec.Spec, error) {
-	return nil, nil
+	return configSpec, nil
 }
 
 func (d *Driver) SetConfig(cfg *base.Config) error {
@@ -181,7 +474,10 @@ func (d *Driver) SetConfig(cfg *base.Config) error {
 		d.nomadConfig = cfg.AgentConfig.Driver
 	}
 
-	return nil
+	if err := d.configureGC(config.GC); err != nil {
+		return err
+	}
+	return d.configureTelemetry(config.Telemetry)
 }
 
 func (d *Driver) Shutdown(ctx context.Context) error {
@@ -223,6 +519,13 @@ func (d *Driver) buildFingerprint() *drivers.Fingerprint {
 	var health drivers.HealthState
 	var desc string
 	attrs := map[string]*pstructs.Attribute{"driver.firecracker-task": pstructs.NewStringAttribute("1")}
+	if templates := hostCPUTemplates(d.config.CPUTemplateDir); len(templates) > 0 {
+		attrs["driver.firecracker-task.cpu_templates"] = pstructs.NewStringAttribute(strings.Join(templates, ","))
+	}
+	if free, total, err := hugePages2MCount(hugePages2MDir); err == nil && total > 0 {
+		attrs["driver.firecracker-task.hugepages.2M.free"] = pstructs.NewIntAttribute(free, "")
+		attrs["driver.firecracker-task.hugepages.2M.total"] = pstructs.NewIntAttribute(total, "")
+	}
 	health = drivers.HealthStateHealthy
 	desc = "ready"
 	d.logger.Info("buildFingerprint()", "driver.FingerPrint", hclog.Fmt("%+v", health))
@@ -251,29 +554,86 @@ func (d *Driver) RecoverTask(handle *drivers.TaskHandle) error {
 	if err := handle.GetDriverState(&taskState); err != nil {
 		return fmt.Errorf("failed to decode task state from handle: %v", err)
 	}
+	if taskState.RunDir == "" {
+		taskState.RunDir = taskRuntimeDir(d.config.RuntimeDir, handle.Config)
+	}
 
-	m, err := d.initializeContainer(context.Background(), handle.Config, driverConfig)
-	if err != nil {
-		d.logger.Info("Error RecoverTask k", "driver_cfg", hclog.Fmt("%+v", err))
-		return fmt.Errorf("task with ID %q failed: %v", handle.Config.ID, err)
+	// the micro-vm normally outlives the plugin, it is reattached to with
+	// everything it holds. Only when it is gone is a new one booted.
+	var m *vminfo
+	var err error
+	if info, ok := liveVMM(taskState.RunDir, handle.Config.ID); ok {
+		if m, err = d.reattach(handle.Config, driverConfig, taskState, info); err != nil {
+			return fmt.Errorf("task with ID %q failed to reattach: %v", handle.Config.ID, err)
+		}
+		d.emitEvent(handle.Config, fmt.Sprintf("Recovered the running micro-vm (pid %s)", info.Pid))
+	} else {
+		d.releaseStateNetwork(handle.Config, taskState)
+		if m, err = d.initializeContainer(context.Background(), handle.Config, driverConfig, true); err != nil {
+			d.logger.Info("Error RecoverTask k", "driver_cfg", hclog.Fmt("%+v", err))
+			return fmt.Errorf("task with ID %q failed: %v", handle.Config.ID, err)
+		}
+		// the state of the released network must not be torn down again
+		newState := newTaskState(handle.Config, m, taskState.StartedAt)
+		if err := handle.SetDriverState(&newState); err != nil {
+			d.logger.Error("failed to recover task, error setting driver state", "error", err)
+			m.Machine.StopVMM()
+			return fmt.Errorf("failed to set driver state: %v", err)
+		}
+		d.emitEvent(handle.Config, fmt.Sprintf("Recovered the task, its micro-vm was gone: booted a new one (pid %s)", m.Info.Pid))
 	}
 
-	h := &taskHandle{
-		taskConfig:      taskState.TaskConfig,
+	h := d.newTaskHandle(handle.Config, m, taskState.StartedAt)
+	d.tasks.Set(taskState.TaskConfig.ID, h)
+	go func() {
+		h.run()
+		d.releaseNetwork(h)
+	}()
+	return nil
+}
+
+// newTaskHandle returns the handle of a started or recovered micro-vm.
+func (d *Driver) newTaskHandle(cfg *drivers.TaskConfig, m *vminfo, startedAt time.Time) *taskHandle {
+	return &taskHandle{
+		taskConfig:      cfg,
 		State:           drivers.TaskStateRunning,
-		startedAt:       taskState.StartedAt,
+		startedAt:       startedAt,
 		exitResult:      &drivers.ExitResult{},
 		MachineInstance: m.Machine,
 		Info:            m.Info,
+		taskDirs:        m.taskDirs,
+		scratchDisks:    m.scratchDisks,
+		persistentDisks: m.persistentDisks,
+		diskLocks:       m.diskLocks,
+		cgroup:          m.cgroup,
+		bridge:          m.bridge,
+		group:           m.group,
+		network:         m.network,
+		egress:          m.egress,
+		runDir:          m.runDir,
+		vmmLog:          m.vmmLog,
+		metrics:         m.metrics,
 		logger:          d.logger,
-		cpuStatsSys:     cpustats.New(cpustats.Compute{NumCores: 1}),
-		cpuStatsUser:    cpustats.New(cpustats.Compute{NumCores: 1}),
-		cpuStatsTotal:   cpustats.New(cpustats.Compute{NumCores: 1}),
+		sampler:         newVMSampler(m.Info.Pid, m.guestStats, hostCompute(d.nomadConfig), cfg, d.logger),
 	}
+}
 
-	d.tasks.Set(taskState.TaskConfig.ID, h)
-	go h.run()
-	return nil
+// newTaskState returns the state persisted in the handle of a micro-vm.
+func newTaskState(cfg *drivers.TaskConfig, m *vminfo, startedAt time.Time) TaskState {
+	return TaskState{
+		ContainerName:   fmt.Sprintf("%s-%s", cfg.Name, cfg.AllocID),
+		TaskConfig:      cfg,
+		StartedAt:       startedAt,
+		Network:         m.network,
+		Egress:          m.egress,
+		RunDir:          m.runDir,
+		TaskDirs:        m.taskDirs,
+		ScratchDisks:    m.scratchDisks,
+		PersistentDisks: m.persistentDisks,
+		Cgroup:          m.cgroup,
+		Bridge:          m.bridge,
+		Group:           m.group,
+	}
 }
 
 func (d *Driver) StartTask(cfg *drivers.TaskConfig) (*drivers.TaskHandle, *drivers.DriverNetwork, error) {
@@ -284,6 +644,7 @@ func (d *Driver) StartTask(cfg *drivers.TaskConfig) (*drivers.TaskHandle, *drive
 
 	var driverConfig TaskConfig
 	if err := cfg.DecodeDriverConfig(&driverConfig); err != nil {
+		startFailed(phaseValidate)
 		return nil, nil, fmt.Errorf("failed to decode driver config: %v", err)
 	}
 
@@ -291,29 +652,14 @@ func (d *Driver) StartTask(cfg *drivers.TaskConfig) (*drivers.TaskHandle, *drive
 	handle := drivers.NewTaskHandle(taskHandleVersion)
 	handle.Config = cfg
 
-	m, err := d.initializeContainer(context.Background(), cfg, driverConfig)
+	m, err := d.initializeContainer(context.Background(), cfg, driverConfig, false)
 	if err != nil {
 		d.logger.Info("Error starting firecracker vm", "driver_cfg", hclog.Fmt("%+v", err))
 		return nil, nil, fmt.Errorf("task with ID %q failed: %v", cfg.ID, err)
 	}
 
-	h := &taskHandle{
-		taskConfig:      cfg,
-		State:           drivers.TaskStateRunning,
-		startedAt:       time.Now().Round(time.Millisecond),
-		MachineInstance: m.Machine,
-		Info:            m.Info,
-		logger:          d.logger,
-		cpuStatsSys:     cpustats.New(cpustats.Compute{NumCores: 1}),
-		cpuStatsUser:    cpustats.New(cpustats.Compute{NumCores: 1}),
-		cpuStatsTotal:   cpustats.New(cpustats.Compute{NumCores: 1}),
-	}
-
-	driverState := TaskState{
-		ContainerName: fmt.Sprintf("%s-%s", cfg.Name, cfg.AllocID),
-		TaskConfig:    cfg,
-		StartedAt:     h.startedAt,
-	}
+	h := d.newTaskHandle(cfg, m, time.Now().Round(time.Millisecond))
+	driverState := newTaskState(cfg, m, h.startedAt)
 
 	if err := handle.SetDriverState(&driverState); err != nil {
 		d.logger.Error("failed to start task, error setting driver state", "error", err)
@@ -322,9 +668,18 @@ func (d *Driver) StartTask(cfg *drivers.TaskConfig) (*drivers.TaskHandle, *drive
 
 	d.tasks.Set(cfg.ID, h)
 
-	go h.run()
+	go func() {
+		h.run()
+		d.releaseNetwork(h)
+	}()
 
-	return handle, nil, nil
+	var network *drivers.DriverNetwork
+	if m.bridge != nil {
+		network = &drivers.DriverNetwork{IP: m.bridge.IP.IP.String(), AutoAdvertise: true}
+	} else if m.network != nil && m.network.primary() != nil {
+		network = &drivers.DriverNetwork{IP: m.network.primary().advertised(), AutoAdvertise: true}
+	}
+	return handle, network, nil
 }
 
 func (d *Driver) WaitTask(ctx context.Context, taskID string) (<-chan *drivers.ExitResult, error) {
@@ -367,9 +722,13 @@ func (d *Driver) StopTask(taskID string, timeout time.Duration, signal string) e
 		return drivers.ErrTaskNotFound
 	}
 
+	d.emitEvent(handle.taskConfig, fmt.Sprintf("Shutdown initiated, stopping the micro-vm in %s", timeout))
+	start := time.Now()
 	if err := handle.shutdown(timeout); err != nil {
 		return fmt.Errorf("executor Shutdown failed: %v", err)
 	}
+	d.emitPhaseEvent(handle.taskConfig, phaseShutdown, "Micro-vm stopped", time.Since(start))
+	metrics.IncrCounter([]string{"firecracker", "vms", "stopped"}, 1)
 
 	return nil
 }
@@ -391,10 +750,89 @@ func (d *Driver) DestroyTask(taskID string, force bool) error {
 		}
 	}
 
+	start := time.Now()
+	if err := removeScratchDisks(handle.scratchDisks); err != nil {
+		handle.logger.Error("failed to remove scratch disks", "err", err)
+	}
+	closeFiles(handle.diskLocks)
+	if err := handle.cgroup.remove(); err != nil {
+		handle.logger.Error("failed to remove the vmm cgroup", "err", err)
+	}
+	d.releaseNetwork(handle)
+	handle.sampler.stop()
+	if handle.metrics != nil {
+		handle.metrics.close()
+	}
+	if handle.vmmLog != nil {
+		handle.vmmLog.Close()
+	}
+	if err := handle.runDir.remove(); err != nil {
+		handle.logger.Error("failed to remove runtime directory", "err", err)
+	}
+	d.emitPhaseEvent(handle.taskConfig, phaseCleanup, "Cleaned up the micro-vm resources", time.Since(start))
+
 	d.tasks.Delete(taskID)
+	d.forgetTaskMetrics(handle.taskConfig)
+	metrics.IncrCounter([]string{"firecracker", "vms", "destroyed"}, 1)
 	return nil
 }
 
+// releaseNetwork tears down the host side of the micro-vm network once,
+// when the micro-vm exits or when the task is destroyed, whichever comes
+// first, so addresses are released without waiting for the destroy.
+func (d *Driver) releaseNetwork(handle *taskHandle) {
+	handle.networkOnce.Do(func() {
+		if handle.egress != nil {
+			if err := handle.egress.remove(); err != nil {
+				handle.logger.Error("failed to remove egress policy", "err", err)
+			} else {
+				d.emitEvent(handle.taskConfig, "Egress policy removed")
+			}
+		}
+		if handle.bridge != nil {
+			if err := d.teardownBridgeNetwork(handle.taskConfig); err != nil {
+				handle.logger.Error("failed to tear down bridge network", "err", err)
+			}
+		}
+		if handle.group != nil {
+			if err := handle.group.teardown(); err != nil {
+				handle.logger.Error("failed to tear down group network", "err", err)
+			}
+		}
+		if handle.network != nil {
+			if err := d.teardownNetworkInterfaces(handle.taskConfig, handle.network); err != nil {
+				handle.logger.Error("failed to tear down network interfaces", "err", err)
+			}
+		}
+	})
+}
+
+// releaseStateNetwork tears down the network a previous run of the task left
+// in its state, once its micro-vm is known to be gone and before a new one is
+// booted on recovery.
+func (d *Driver) releaseStateNetwork(cfg *drivers.TaskConfig, state TaskState) {
+	if state.Egress != nil {
+		if err := state.Egress.remove(); err != nil {
+			d.logger.Error("failed to remove egress policy", "task_id", cfg.ID, "err", err)
+		}
+	}
+	if state.Bridge != nil {
+		if err := d.teardownBridgeNetwork(cfg); err != nil {
+			d.logger.Error("failed to tear down bridge network", "task_id", cfg.ID, "err", err)
+		}
+	}
+	if state.Group != nil {
+		if err := state.Group.teardown(); err != nil {
+			d.logger.Error("failed to tear down group network", "task_id", cfg.ID, "err", err)
+		}
+	}
+	if state.Network != nil {
+		if err := d.teardownNetworkInterfaces(cfg, state.Network); err != nil {
+			d.logger.Error("failed to tear down network interfaces", "task_id", cfg.ID, "err", err)
+		}
+	}
+}
+
 func (d *Driver) InspectTask(taskID string) (*drivers.TaskStatus, error) {
 	handle, ok := d.tasks.Get(taskID)
 
@@ -412,16 +850,27 @@ func (d *Driver) TaskStats(ctx context.Context, taskID string, interval time.Dur
 		return nil, drivers.ErrTaskNotFound
 	}
 
-	statsChannel := make(chan *drivers.TaskResourceUsage)
-	go handle.stats(ctx, statsChannel, interval)
-
-	return statsChannel, nil
+	return handle.sampler.subscribe(ctx, interval), nil
 }
 
 func (d *Driver) TaskEvents(ctx context.Context) (<-chan *drivers.TaskEvent, error) {
 	return d.eventer.TaskEvents(ctx)
 }
 
+// emitEvent sends a task event shown in the allocation status.
+func (d *Driver) emitEvent(cfg *drivers.TaskConfig, msg string) {
+	err := d.eventer.EmitEvent(&drivers.TaskEvent{
+		TaskID:    cfg.ID,
+		AllocID:   cfg.AllocID,
+		TaskName:  cfg.Name,
+		Timestamp: time.Now(),
+		Message:   msg,
+	})
+	if err != nil {
+		d.logger.Warn("failed to emit task event", "task_id", cfg.ID, "error", err)
+	}
+}
+
 func (d *Driver) SignalTask(taskID string, signal string) error {
 	handle, ok := d.tasks.Get(taskID)
 
@@ -0,0 +1,103 @@
+/* Firecracker-task-driver is a task driver for Hashicorp's nomad that allows
+ * to create microvms using AWS Firecracker vmm
+ * Copyright (C) 2019  Carlos Neira cneirabustos@gmail.com
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ */
+
+package firevm
+
+import (
+	"fmt"
+	"net"
+)
+
+// guestAddrs are the addresses of a guest interface, at most one per
+// family. Either can be missing.
+type guestAddrs struct {
+	IP       *net.IPNet
+	Gateway  net.IP
+	IP6      *net.IPNet
+	Gateway6 net.IP
+}
+
+// parseStaticAddrs parses the address and gateway pairs of a static
+// interface. Each address may be of either family, the gateway has to be of
+// the same family as its address.
+func parseStaticAddrs(ip, gateway, ip6, gateway6 string) (guestAddrs, error) {
+	var a guestAddrs
+	for _, p := range [][2]string{{ip, gateway}, {ip6, gateway6}} {
+		if p[0] == "" {
+			if p[1] != "" {
+				return a, fmt.Errorf("gateway %s has no address", p[1])
+			}
+			continue
+		}
+		addr, subnet, err := net.ParseCIDR(p[0])
+		if err != nil {
+			return a, fmt.Errorf("Fail to parse CIDR address: %v", err)
+		}
+		var gw net.IP
+		if p[1] != "" {
+			if gw = net.ParseIP(p[1]); gw == nil || (gw.To4() == nil) != (addr.To4() == nil) {
+				return a, fmt.Errorf("invalid gateway %s for %s", p[1], p[0])
+			}
+		}
+		if err := a.add(net.IPNet{IP: addr, Mask: subnet.Mask}, gw); err != nil {
+			return a, err
+		}
+	}
+	return a, nil
+}
+
+func (n Nic) addrs() (guestAddrs, error) {
+	return parseStaticAddrs(n.Ip, n.Gateway, n.Ip6, n.Gateway6)
+}
+
+// add sets the address of the family of ip.
+func (a *guestAddrs) add(ip net.IPNet, gateway net.IP) error {
+	if v4 := ip.IP.To4(); v4 != nil {
+		if a.IP != nil {
+			return fmt.Errorf("%s and %s are both ipv4 addresses", a.IP, ip.String())
+		}
+		ip.IP = v4
+		a.IP, a.Gateway = &ip, gateway.To4()
+		return nil
+	}
+	if a.IP6 != nil {
+		return fmt.Errorf("%s and %s are both ipv6 addresses", a.IP6, ip.String())
+	}
+	a.IP6, a.Gateway6 = &ip, gateway
+	return nil
+}
+
+func (a guestAddrs) empty() bool {
+	return a.IP == nil && a.IP6 == nil
+}
+
+// strings returns the addresses in CIDR notation, empty when missing.
+func (a guestAddrs) strings() (string, string) {
+	var ip, ip6 string
+	if a.IP != nil {
+		ip = a.IP.String()
+	}
+	if a.IP6 != nil {
+		ip6 = a.IP6.String()
+	}
+	return ip, ip6
+}
+
+// advertised is the address given to nomad, ipv4 when there is one.
+func (a guestAddrs) advertised() string {
+	if a.IP != nil {
+		return a.IP.IP.String()
+	}
+	if a.IP6 != nil {
+		return a.IP6.IP.String()
+	}
+	return ""
+}
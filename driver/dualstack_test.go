@@ -0,0 +1,149 @@
+/* Firecracker-task-driver is a task driver for Hashicorp's nomad that allows
+ * to create microvms using AWS Firecracker vmm
+ * Copyright (C) 2019  Carlos Neira cneirabustos@gmail.com
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ */
+
+package firevm
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseStaticAddrs(t *testing.T) {
+	cases := []struct {
+		name                     string
+		ip, gateway, ip6, gw6    string
+		wantIP, wantIP6, wantGW6 string
+		ok                       bool
+	}{
+		{"ipv4", "10.0.0.2/24", "10.0.0.1", "", "", "10.0.0.2/24", "", "", true},
+		{"dual-stack", "10.0.0.2/24", "10.0.0.1", "fd00::2/64", "fd00::1", "10.0.0.2/24", "fd00::2/64", "fd00::1", true},
+		{"ipv6 only", "fd00::2/64", "fd00::1", "", "", "", "fd00::2/64", "fd00::1", true},
+		{"families swapped", "fd00::2/64", "", "10.0.0.2/24", "", "10.0.0.2/24", "fd00::2/64", "", true},
+		{"no address", "", "", "", "", "", "", "", true},
+		{"two ipv4", "10.0.0.2/24", "", "10.0.1.2/24", "", "", "", "", false},
+		{"two ipv6", "fd00::2/64", "", "fd01::2/64", "", "", "", "", false},
+		{"gateway without address", "", "10.0.0.1", "", "", "", "", "", false},
+		{"gateway of the other family", "10.0.0.2/24", "fd00::1", "", "", "", "", "", false},
+		{"address without prefix", "10.0.0.2", "", "", "", "", "", "", false},
+		{"bad gateway", "", "", "fd00::2/64", "fd00::zz", "", "", "", false},
+	}
+	for _, c := range cases {
+		a, err := parseStaticAddrs(c.ip, c.gateway, c.ip6, c.gw6)
+		if (err == nil) != c.ok {
+			t.Errorf("%s: got error %v, want ok=%v", c.name, err, c.ok)
+			continue
+		}
+		if !c.ok {
+			continue
+		}
+		ip, ip6 := a.strings()
+		if ip != c.wantIP || ip6 != c.wantIP6 {
+			t.Errorf("%s: got %q and %q, want %q and %q", c.name, ip, ip6, c.wantIP, c.wantIP6)
+		}
+		if gw6 := a.Gateway6.String(); c.wantGW6 != "" && gw6 != c.wantGW6 {
+			t.Errorf("%s: got ipv6 gateway %s, want %s", c.name, gw6, c.wantGW6)
+		}
+		if a.IP != nil && len(a.IP.IP) != 4 {
+			t.Errorf("%s: ipv4 address stored in %d bytes", c.name, len(a.IP.IP))
+		}
+	}
+}
+
+func TestAdvertisedAddr(t *testing.T) {
+	cases := []struct {
+		ip, ip6 string
+		want    string
+	}{
+		{"10.0.0.2/24", "fd00::2/64", "10.0.0.2"},
+		{"", "fd00::2/64", "fd00::2"},
+		{"", "", ""},
+	}
+	for _, c := range cases {
+		a, err := parseStaticAddrs(c.ip, "", c.ip6, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := a.advertised(); got != c.want {
+			t.Errorf("%s %s: got %q, want %q", c.ip, c.ip6, got, c.want)
+		}
+	}
+}
+
+func TestIPKernelArgs(t *testing.T) {
+	iface := func(name, ip, gateway, ip6, gateway6 string) netInterface {
+		a, err := parseStaticAddrs(ip, gateway, ip6, gateway6)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return netInterface{Name: name, guestAddrs: a}
+	}
+	cases := []struct {
+		name    string
+		cmdline string
+		ifaces  []netInterface
+		dns     []string
+		ip      string
+		ip6     string
+	}{
+		{
+			name:   "dual-stack",
+			ifaces: []netInterface{iface("eth0", "10.0.0.2/24", "10.0.0.1", "fd00::2/64", "fd00::1")},
+			dns:    []string{"10.0.0.53", "10.0.0.54", "10.0.0.55"},
+			ip:     " ip=10.0.0.2::10.0.0.1:255.255.255.0::eth0:off:10.0.0.53:10.0.0.54",
+			ip6:    " nomad.ip6.eth0=fd00::2/64,fd00::1",
+		},
+		{
+			name:   "ipv6 only",
+			ifaces: []netInterface{iface("eth0", "", "", "fd00::2/64", "")},
+			ip6:    " nomad.ip6.eth0=fd00::2/64",
+		},
+		{
+			name: "first ipv4 interface",
+			ifaces: []netInterface{
+				iface("eth0", "", "", "fd00::2/64", ""),
+				iface("eth1", "192.168.1.2/16", "", "fd01::2/64", "fd01::1"),
+			},
+			ip:  " ip=192.168.1.2:::255.255.0.0::eth1:off::",
+			ip6: " nomad.ip6.eth0=fd00::2/64 nomad.ip6.eth1=fd01::2/64,fd01::1",
+		},
+		{
+			name:    "ip set by the task",
+			cmdline: "console=ttyS0 ip=dhcp",
+			ifaces:  []netInterface{iface("eth0", "10.0.0.2/24", "", "", "")},
+		},
+	}
+	for _, c := range cases {
+		if got := ipKernelArg(c.cmdline, c.ifaces, c.dns); got != c.ip {
+			t.Errorf("%s: got %q, want %q", c.name, got, c.ip)
+		}
+		if got := ip6KernelArgs(c.ifaces); got != c.ip6 {
+			t.Errorf("%s: got %q, want %q", c.name, got, c.ip6)
+		}
+	}
+}
+
+func TestGuestInterfaces(t *testing.T) {
+	a, err := parseStaticAddrs("10.0.0.2/24", "10.0.0.1", "fd00::2/64", "fd00::1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := guestInterfaces([]netInterface{
+		{Name: "eth0", Mac: "02:fc:00:00:00:01", MTU: 1400, guestAddrs: a},
+		{Name: "eth1", Mac: "02:fc:00:00:00:02"},
+	})
+	want := []guestInterface{
+		{Name: "eth0", Mac: "02:fc:00:00:00:01", MTU: 1400, Address: "10.0.0.2/24", Gateway: "10.0.0.1", Address6: "fd00::2/64", Gateway6: "fd00::1"},
+		{Name: "eth1", Mac: "02:fc:00:00:00:02"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,325 @@
+/* Firecracker-task-driver is a task driver for Hashicorp's nomad that allows
+ * to create microvms using AWS Firecracker vmm
+ * Copyright (C) 2019  Carlos Neira cneirabustos@gmail.com
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ */
+
+package firevm
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/hashicorp/nomad/plugins/drivers"
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	egressProtocolAny  = "any"
+	egressProtocolTCP  = "tcp"
+	egressProtocolUDP  = "udp"
+	egressProtocolICMP = "icmp"
+
+	// egressPriority runs the policy after conntrack and before nat, so
+	// the destination is the one the guest asked for.
+	egressPriority = -150
+)
+
+// egressDevice is where the frames of a guest interface enter the host
+// network namespace. Bridge ports are filtered in the bridge family, the
+// frames of the other devices are seen by the ip stack.
+type egressDevice struct {
+	Name   string
+	Bridge bool
+}
+
+// vmEgress is the nftables policy of a micro-vm, in a table of its own per
+// family so it can't touch the rules of other allocations.
+type vmEgress struct {
+	Table   string
+	Devices []egressDevice
+	// NetNS is the namespace of the devices, the host one when empty
+	NetNS string
+}
+
+// newEgress returns the policy of the micro-vm, bound to the devices its
+// traffic comes from. In a group network that is the tap of the task inside
+// the group namespace, the namespace is shared with the other tasks of the
+// group and the table named after the tap holds the group network rules.
+func newEgress(cfg *drivers.TaskConfig, network *vmNetwork, group *groupNetwork, nic Nic) (*vmEgress, error) {
+	if group != nil {
+		return &vmEgress{
+			Table:   group.Tap + "_egress",
+			Devices: []egressDevice{{Name: group.Tap}},
+			NetNS:   group.NetNS,
+		}, nil
+	}
+	devices, err := egressDevices(network, nic)
+	if err != nil {
+		return nil, err
+	}
+	return &vmEgress{Table: tapName(cfg), Devices: devices}, nil
+}
+
+func (d egressDevice) family() string {
+	if d.Bridge {
+		return "bridge"
+	}
+	return "inet"
+}
+
+// families returns the nftables families the devices of the policy use.
+func (e *vmEgress) families() []string {
+	var families []string
+	seen := map[string]bool{}
+	for _, d := range e.Devices {
+		if !seen[d.family()] {
+			seen[d.family()] = true
+			families = append(families, d.family())
+		}
+	}
+	return families
+}
+
+// validate checks the allow rules, it is done before anything is set up.
+func (p EgressPolicy) validate() error {
+	for _, r := range p.Allow {
+		if _, _, err := net.ParseCIDR(r.CIDR); err != nil {
+			return fmt.Errorf("invalid egress cidr %q: %v", r.CIDR, err)
+		}
+		switch r.protocol() {
+		case egressProtocolTCP, egressProtocolUDP:
+		case egressProtocolAny, egressProtocolICMP:
+			if len(r.Ports) > 0 {
+				return fmt.Errorf("egress ports need protocol tcp or udp")
+			}
+		default:
+			return fmt.Errorf("invalid egress protocol %q, must be tcp, udp, icmp or any", r.Protocol)
+		}
+		for _, p := range r.Ports {
+			if err := validPortRange(p); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (r EgressRule) protocol() string {
+	if r.Protocol == "" {
+		return egressProtocolAny
+	}
+	return r.Protocol
+}
+
+// validPortRange accepts a port or a first-last range.
+func validPortRange(s string) error {
+	bounds := strings.SplitN(s, "-", 2)
+	var prev int
+	for _, b := range bounds {
+		port, err := strconv.Atoi(b)
+		if err != nil || port < 1 || port > 65535 || port < prev {
+			return fmt.Errorf("invalid egress port %q", s)
+		}
+		prev = port
+	}
+	return nil
+}
+
+// nftRule returns the statement accepting the traffic of the rule.
+func (r EgressRule) nftRule() string {
+	_, cidr, _ := net.ParseCIDR(r.CIDR)
+	family, icmp := "ip", "icmp"
+	if cidr.IP.To4() == nil {
+		family, icmp = "ip6", "ipv6-icmp"
+	}
+	rule := fmt.Sprintf("%s daddr %s", family, cidr)
+	switch r.protocol() {
+	case egressProtocolICMP:
+		rule += " meta l4proto " + icmp
+	case egressProtocolTCP, egressProtocolUDP:
+		if len(r.Ports) > 0 {
+			rule += fmt.Sprintf(" %s dport { %s }", r.protocol(), strings.Join(r.Ports, ", "))
+		} else {
+			rule += " meta l4proto " + r.protocol()
+		}
+	}
+	return rule + " accept"
+}
+
+// ruleset renders the nftables script installing the policy. The tables are
+// dropped and created again in the same transaction, so a policy left by a
+// previous run of the task is replaced.
+func (e *vmEgress) ruleset(p EgressPolicy) string {
+	var b strings.Builder
+	b.WriteString(e.flush())
+	for _, family := range e.families() {
+		t := family + " " + e.Table
+		fmt.Fprintf(&b, "add table %s\n", t)
+		fmt.Fprintf(&b, "add chain %s egress\n", t)
+		fmt.Fprintf(&b, "add rule %s egress ct state established,related accept\n", t)
+		if family == "bridge" {
+			fmt.Fprintf(&b, "add rule %s egress ether type arp accept\n", t)
+		}
+		fmt.Fprintf(&b, "add rule %s egress icmpv6 type { nd-neighbor-solicit, nd-neighbor-advert, nd-router-solicit } accept\n", t)
+		for _, r := range p.Allow {
+			fmt.Fprintf(&b, "add rule %s egress %s\n", t, r.nftRule())
+		}
+		fmt.Fprintf(&b, "add rule %s egress counter drop\n", t)
+
+		fmt.Fprintf(&b, "add chain %s prerouting { type filter hook prerouting priority %d ; policy accept ; }\n", t, egressPriority)
+		for _, d := range e.Devices {
+			if d.family() == family {
+				fmt.Fprintf(&b, "add rule %s prerouting iifname %q jump egress\n", t, d.Name)
+			}
+		}
+	}
+	return b.String()
+}
+
+// flush deletes the tables of the policy, adding them first so it doesn't
+// fail when they are missing.
+func (e *vmEgress) flush() string {
+	var b strings.Builder
+	for _, family := range e.families() {
+		fmt.Fprintf(&b, "add table %s %s\n", family, e.Table)
+		fmt.Fprintf(&b, "delete table %s %s\n", family, e.Table)
+	}
+	return b.String()
+}
+
+func (e *vmEgress) apply(p EgressPolicy) error {
+	if err := e.nft(e.ruleset(p)); err != nil {
+		return fmt.Errorf("Fail to apply the egress policy: %v", err)
+	}
+	return nil
+}
+
+func (e *vmEgress) remove() error {
+	if e.NetNS != "" {
+		// the tables went away with the namespace
+		if _, err := os.Stat(e.NetNS); os.IsNotExist(err) {
+			return nil
+		}
+	}
+	if err := e.nft(e.flush()); err != nil {
+		return fmt.Errorf("Fail to remove the egress policy: %v", err)
+	}
+	return nil
+}
+
+// nft runs script in the namespace of the policy, nft runs in a child
+// process which starts in the namespace of the locked thread.
+func (e *vmEgress) nft(script string) error {
+	if e.NetNS == "" {
+		return nft(script)
+	}
+	return ns.WithNetNSPath(e.NetNS, func(ns.NetNS) error {
+		return nft(script)
+	})
+}
+
+// nft runs an nftables script as a single transaction.
+func nft(script string) error {
+	cmd := exec.Command("nft", "-f", "-")
+	cmd.Stdin = strings.NewReader(script)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("nft failed: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// egressDevices returns the host devices the guest traffic comes from.
+// Taps in the host namespace are used directly, for micro-vms in a network
+// namespace of their own it is the host side of the veth of the namespace.
+func egressDevices(network *vmNetwork, nic Nic) ([]egressDevice, error) {
+	var devices []egressDevice
+	switch {
+	case network != nil:
+		for _, iface := range network.Interfaces {
+			var d egressDevice
+			var err error
+			if network.NetNS != "" {
+				d, err = hostPeer(network.NetNS, iface.IfName)
+			} else {
+				d, err = hostDevice(iface.Tap)
+			}
+			if err != nil {
+				return nil, err
+			}
+			devices = append(devices, d)
+		}
+	case nic.Interface != "":
+		d, err := hostDevice(nic.Interface)
+		if err != nil {
+			return nil, err
+		}
+		devices = append(devices, d)
+	}
+	if len(devices) == 0 {
+		return nil, errEgressWithoutNetwork
+	}
+	return devices, nil
+}
+
+func hostDevice(name string) (egressDevice, error) {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return egressDevice{}, fmt.Errorf("Fail to look up %s: %v", name, err)
+	}
+	return egressDeviceOf(link)
+}
+
+func egressDeviceOf(link netlink.Link) (egressDevice, error) {
+	d := egressDevice{Name: link.Attrs().Name}
+	if master := link.Attrs().MasterIndex; master != 0 {
+		m, err := netlink.LinkByIndex(master)
+		if err != nil {
+			return d, fmt.Errorf("Fail to look up the master of %s: %v", d.Name, err)
+		}
+		d.Bridge = m.Type() == "bridge"
+	}
+	return d, nil
+}
+
+// hostPeer returns the host side of the veth link of the network namespace.
+func hostPeer(netns, link string) (egressDevice, error) {
+	var peer int
+	err := ns.WithNetNSPath(netns, func(ns.NetNS) error {
+		l, err := netlink.LinkByName(link)
+		if err != nil {
+			return err
+		}
+		if _, ok := l.(*netlink.Veth); !ok {
+			return fmt.Errorf("%s is not a veth, egress policies can't be bound to it", link)
+		}
+		peer = l.Attrs().ParentIndex
+		return nil
+	})
+	if err != nil {
+		return egressDevice{}, err
+	}
+	l, err := netlink.LinkByIndex(peer)
+	if err != nil {
+		return egressDevice{}, fmt.Errorf("Fail to find the host side of %s: %v", link, err)
+	}
+	return egressDeviceOf(l)
+}
+
+func (e *vmEgress) deviceNames() string {
+	names := make([]string, len(e.Devices))
+	for i, d := range e.Devices {
+		names[i] = d.Name
+	}
+	return strings.Join(names, ", ")
+}
@@ -0,0 +1,156 @@
+/* Firecracker-task-driver is a task driver for Hashicorp's nomad that allows
+ * to create microvms using AWS Firecracker vmm
+ * Copyright (C) 2019  Carlos Neira cneirabustos@gmail.com
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ */
+
+package firevm
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+func TestValidPortRange(t *testing.T) {
+	cases := []struct {
+		port string
+		ok   bool
+	}{
+		{"53", true},
+		{"1", true},
+		{"65535", true},
+		{"8000-8080", true},
+		{"8080-8080", true},
+		{"0", false},
+		{"65536", false},
+		{"8080-8000", false},
+		{"-80", false},
+		{"80-", false},
+		{"http", false},
+		{"", false},
+	}
+	for _, c := range cases {
+		if err := validPortRange(c.port); (err == nil) != c.ok {
+			t.Errorf("%q: got %v, want ok=%v", c.port, err, c.ok)
+		}
+	}
+}
+
+func TestEgressPolicyValidate(t *testing.T) {
+	cases := []struct {
+		name string
+		rule EgressRule
+		ok   bool
+	}{
+		{"cidr only", EgressRule{CIDR: "10.0.0.0/8"}, true},
+		{"tcp ports", EgressRule{CIDR: "10.0.0.53/32", Protocol: "tcp", Ports: []string{"53", "8000-8080"}}, true},
+		{"ipv6", EgressRule{CIDR: "fd00::/8", Protocol: "udp"}, true},
+		{"icmp", EgressRule{CIDR: "0.0.0.0/0", Protocol: "icmp"}, true},
+		{"address without prefix", EgressRule{CIDR: "10.0.0.1"}, false},
+		{"bad protocol", EgressRule{CIDR: "10.0.0.0/8", Protocol: "sctp"}, false},
+		{"ports without protocol", EgressRule{CIDR: "10.0.0.0/8", Ports: []string{"53"}}, false},
+		{"icmp ports", EgressRule{CIDR: "10.0.0.0/8", Protocol: "icmp", Ports: []string{"53"}}, false},
+		{"bad port", EgressRule{CIDR: "10.0.0.0/8", Protocol: "tcp", Ports: []string{"70000"}}, false},
+	}
+	for _, c := range cases {
+		err := EgressPolicy{Allow: []EgressRule{c.rule}}.validate()
+		if (err == nil) != c.ok {
+			t.Errorf("%s: got %v, want ok=%v", c.name, err, c.ok)
+		}
+	}
+}
+
+func TestEgressRuleset(t *testing.T) {
+	policy := EgressPolicy{Allow: []EgressRule{
+		{CIDR: "10.0.0.53/32", Protocol: "udp", Ports: []string{"53"}},
+		{CIDR: "fd00::/8", Protocol: "icmp"},
+		{CIDR: "192.168.0.0/16", Protocol: "tcp"},
+	}}
+	cases := []struct {
+		name    string
+		devices []egressDevice
+		want    []string
+		missing []string
+	}{
+		{
+			name:    "tap",
+			devices: []egressDevice{{Name: "fc1234"}},
+			want: []string{
+				"add table inet fc1234\ndelete table inet fc1234\nadd table inet fc1234\n",
+				"add rule inet fc1234 egress ct state established,related accept\n",
+				"add rule inet fc1234 egress ip daddr 10.0.0.53/32 udp dport { 53 } accept\n",
+				"add rule inet fc1234 egress ip6 daddr fd00::/8 meta l4proto ipv6-icmp accept\n",
+				"add rule inet fc1234 egress ip daddr 192.168.0.0/16 meta l4proto tcp accept\n",
+				"add rule inet fc1234 egress counter drop\n",
+				`add rule inet fc1234 prerouting iifname "fc1234" jump egress` + "\n",
+			},
+			missing: []string{"bridge", "arp"},
+		},
+		{
+			name:    "bridge port",
+			devices: []egressDevice{{Name: "fc1234", Bridge: true}},
+			want: []string{
+				"add rule bridge fc1234 egress ether type arp accept\n",
+				`add rule bridge fc1234 prerouting iifname "fc1234" jump egress` + "\n",
+			},
+			missing: []string{"inet"},
+		},
+	}
+	for _, c := range cases {
+		e := &vmEgress{Table: "fc1234", Devices: c.devices}
+		rules := e.ruleset(policy)
+		for _, w := range c.want {
+			if !strings.Contains(rules, w) {
+				t.Errorf("%s: missing %q in\n%s", c.name, w, rules)
+			}
+		}
+		for _, m := range c.missing {
+			if strings.Contains(rules, m) {
+				t.Errorf("%s: unexpected %q in\n%s", c.name, m, rules)
+			}
+		}
+		// the drop comes after every allow rule
+		if strings.Index(rules, "counter drop") < strings.LastIndex(rules, "egress ip daddr 192.168.0.0/16") {
+			t.Errorf("%s: drop before the allow rules", c.name)
+		}
+	}
+}
+
+func TestNewEgressGroup(t *testing.T) {
+	cfg := &drivers.TaskConfig{ID: "task-1"}
+	g := &groupNetwork{NetNS: "/var/run/netns/alloc", Tap: tapName(cfg), Link: "eth0"}
+
+	e, err := newEgress(cfg, nil, g, g.nic())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// bound to the tap of the task, not to the veth shared by the group
+	want := &vmEgress{Table: g.Tap + "_egress", Devices: []egressDevice{{Name: g.Tap}}, NetNS: g.NetNS}
+	if !reflect.DeepEqual(e, want) {
+		t.Errorf("got %+v, want %+v", e, want)
+	}
+	rules := e.ruleset(EgressPolicy{})
+	if strings.Contains(rules, "table inet "+g.Tap+"\n") {
+		t.Errorf("egress policy touches the group network table:\n%s", rules)
+	}
+
+	if _, err := newEgress(cfg, nil, nil, Nic{}); err != errEgressWithoutNetwork {
+		t.Errorf("got error %v, want %v", err, errEgressWithoutNetwork)
+	}
+}
+
+func TestEgressRemoveGoneNamespace(t *testing.T) {
+	e := &vmEgress{Table: "fc1234_egress", Devices: []egressDevice{{Name: "fc1234"}}, NetNS: filepath.Join(t.TempDir(), "gone")}
+	if err := e.remove(); err != nil {
+		t.Errorf("remove without namespace: %v", err)
+	}
+}
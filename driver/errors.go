@@ -27,10 +27,69 @@ var (
 	errUnableToParseVsockDevices = errors.New("unable to parse vsock devices")
 	errUnableToParseVsockCID     = errors.New("unable to parse vsock CID as a number")
 
-	errConflictingLogOpts        = errors.New("vmm-log-fifo and firecracker-log cannot be used together")
-	errConflictingNetworkOpts    = errors.New("network and nic cannot be used together")
-	errUnableToCreateFifoLogFile = errors.New("failed to create fifo log file")
+	errConflictingLogOpts     = errors.New("vmm-log-fifo and firecracker-log cannot be used together")
+	errConflictingNetworkOpts = errors.New("network and nic cannot be used together")
 
 	// error with firecracker config
 	errInvalidMetadata = errors.New("invalid metadata, unable to parse as json")
+
+	// error packing task directories
+	errInvalidTaskDir       = errors.New("invalid task dir, must be one of local, secrets or alloc")
+	errInvalidTaskDirFormat = errors.New("invalid task dir format, must be ext4 or raw")
+	errSymlinkInPath        = errors.New("refusing to write through a symlink")
+	errSecretsNotOnTmpfs    = errors.New("the secrets task dir needs the runtime_dir of the plugin config on a tmpfs")
+
+	// error creating scratch disks
+	errInvalidScratchDiskSize   = errors.New("invalid scratch disk, size_mb must be greater than zero")
+	errInvalidScratchDiskFsType = errors.New("invalid scratch disk, fs_type must be ext4, xfs or raw")
+	errInvalidScratchDiskLabel  = errors.New("invalid scratch disk label, only letters, digits, _ and - are allowed")
+	errScratchDiskLabelTooLong  = errors.New("invalid scratch disk label, too long for the filesystem")
+
+	// error resizing the root filesystem
+	errInvalidRootfsSize    = errors.New("invalid root filesystem size, RootfsSizeMB must not be negative")
+	errRootfsNotResizable   = errors.New("only ext4 root filesystems stored in a regular file can be resized")
+	errUnknownEphemeralDisk = errors.New("scratch disks, RootfsSizeMB and GrowRootfs need the ephemeral_disk size, unable to look it up from the nomad agent")
+
+	// error with the nomad api
+	errIncompleteNomadClientCert = errors.New("nomad_client_cert and nomad_client_key must be set together")
+
+	// error with persistent disks
+	errPersistentDisksDisabled   = errors.New("persistent disks are disabled, set persistent_disk_dir in the plugin config")
+	errInvalidPersistentDiskName = errors.New("invalid persistent disk name, only letters, digits, _ and - are allowed")
+	errInvalidPersistentDiskSize = errors.New("invalid persistent disk, size_mb must be greater than zero")
+
+	// error with volumes
+	errWritableDirVolume = errors.New("writable host volumes backed by a directory are not supported, mount it read_only or use a block device or disk image")
+
+	// error with hugepages
+	errInvalidHugePages = errors.New("invalid HugePages, must be 2M or None")
+
+	// error with cpu pinning
+	errNumaBindWithoutCgroup = errors.New("NumaBind needs cgroups, the guest memory is bound with the cpuset of the task")
+
+	// error with cgroups
+	errCgroupInUse = errors.New("the firecracker cgroup of the task still holds a running vmm")
+
+	// error with the bridge and group networks
+	errBridgeNotConfigured      = errors.New("Network = \"bridge\" needs a bridge block with a subnet in the plugin config")
+	errConflictingGroupNetwork  = errors.New("Network and Nic cannot be used in a group network, the micro-vm uses the group network namespace")
+	errGroupNetworkFull         = errors.New("no free link address left for the micro-vm in the group network")
+	errUnknownPortLabel         = errors.New("unknown port label")
+	errPortsWithoutGroupNetwork = errors.New("ports needs a group network (network { mode = \"bridge\" })")
+
+	// error with network_interface blocks
+	errConflictingNetworkInterfaces = errors.New("network_interface blocks cannot be used with Network, Nic or a group network")
+	errMixedNetworkInterfaces       = errors.New("cni network interfaces cannot be mixed with tap or bridge interfaces")
+	errInvalidCNIInterface          = errors.New("mac, mac_from_alloc, mtu, ip and gateway of a cni network interface come from the cni result")
+
+	// error with the firecracker log
+	errInvalidLogLevel = errors.New("invalid log_level, must be Error, Warning, Info or Debug")
+	errHostLogPath     = errors.New("Log must be a file name in alloc/logs, set allow_host_log_paths in the plugin config to use other paths")
+
+	// error with the runtime directory
+	errRuntimeDirTooLong = errors.New("the firecracker socket path would be too long, set a shorter runtime_dir in the plugin config")
+	errRuntimeDirInUse   = errors.New("the runtime directory of the task belongs to a micro-vm that still runs")
+
+	// error with egress policies
+	errEgressWithoutNetwork = errors.New("an egress policy needs a network, the micro-vm has none")
 )
@@ -0,0 +1,80 @@
+/* Firecracker-task-driver is a task driver for Hashicorp's nomad that allows
+ * to create microvms using AWS Firecracker vmm
+ * Copyright (C) 2019  Carlos Neira cneirabustos@gmail.com
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ */
+
+package firevm
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+
+	firecracker "github.com/firecracker-microvm/firecracker-go-sdk"
+)
+
+// machineConfig is the firecracker machine-config body, it carries the
+// fields newer firecracker releases accept and the sdk models lack.
+type machineConfig struct {
+	VcpuCount   int64  `json:"vcpu_count"`
+	MemSizeMib  int64  `json:"mem_size_mib"`
+	Smt         bool   `json:"smt"`
+	CPUTemplate string `json:"cpu_template,omitempty"`
+	HugePages   string `json:"huge_pages,omitempty"`
+}
+
+// putAPI sends a PUT request with a json body to the firecracker api
+// listening on socketPath.
+func putAPI(ctx context.Context, socketPath, path string, body interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socketPath)
+			},
+		},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, "http://localhost"+path, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("PUT %s failed: %s: %s", path, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// createMachineHandler replaces the sdk machine configuration handler to
+// send the whole machine config to firecracker.
+func createMachineHandler(cfg machineConfig) firecracker.Handler {
+	return firecracker.Handler{
+		Name: firecracker.CreateMachineHandlerName,
+		Fn: func(ctx context.Context, m *firecracker.Machine) error {
+			return putAPI(ctx, m.Cfg.SocketPath, "/machine-config", cfg)
+		},
+	}
+}
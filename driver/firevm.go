@@ -71,58 +71,304 @@ func taskConfig2FirecrackerOpts(taskConfig TaskConfig, cfg *drivers.TaskConfig)
 		opts.FcNetworkName = taskConfig.Network
 	}
 
-	if len(taskConfig.Log) > 0 {
-		opts.FcFifoLogFile = taskConfig.Log
-		opts.Debug = true
-		opts.FcLogLevel = "Debug"
-	}
-
-	if cfg.Resources.NomadResources.Cpu.CpuShares > 100 {
-		opts.FcCPUCount = cfg.Resources.NomadResources.Cpu.CpuShares / 100
-	} else {
-		opts.FcCPUCount = 1
-	}
-	opts.FcCPUTemplate = taskConfig.Cputype
-	opts.FcDisableHt = taskConfig.DisableHt
+	opts.FcDisableHt = !smtEnabled(taskConfig)
 
-	if cfg.Resources.NomadResources.Memory.MemoryMB > 0 {
-		opts.FcMemSz = cfg.Resources.NomadResources.Memory.MemoryMB
-	} else {
-		opts.FcMemSz = 300
-	}
 	opts.FcBinary = taskConfig.Firecracker
 
 	return opts, nil
 }
 
 type vminfo struct {
-	Machine *firecracker.Machine
-	tty     string
-	Info    Instance_info
+	Machine  *firecracker.Machine
+	tty      string
+	Info     Instance_info
+	taskDirs []taskDirDrive
+
+	scratchDisks    []scratchDrive
+	persistentDisks []persistentDrive
+	diskLocks       []*os.File
+	cgroup          *vmCgroup
+	group           *groupNetwork
+	bridge          *bridgeNetwork
+	network         *vmNetwork
+	egress          *vmEgress
+	runDir          runtimeDir
+	vmmLog          *vmmLog
+	metrics         *vmMetrics
+	guestStats      guestStatsFunc
 }
 type Instance_info struct {
 	AllocId string
 	Ip      string
+	Ip6     string `json:",omitempty"`
 	Serial  string
 	Pid     string
 	Vnic    string
 }
 
-func (d *Driver) initializeContainer(ctx context.Context, cfg *drivers.TaskConfig, taskConfig TaskConfig) (*vminfo, error) {
+// initializeContainer sets up and boots the micro-vm of a task. recovered is
+// set when the task is recovered and its micro-vm was gone, the boot is then
+// neither reported phase by phase nor counted in the boot metrics.
+func (d *Driver) initializeContainer(ctx context.Context, cfg *drivers.TaskConfig, taskConfig TaskConfig, recovered bool) (_ *vminfo, rerr error) {
 	opts, _ := taskConfig2FirecrackerOpts(taskConfig, cfg)
+
+	// boot emits the events of the phases, its phase is the reason of a
+	// failure in the start failure metric
+	start := time.Now()
+	success := false
+	boot := d.newBootPhases(cfg, recovered)
+	defer func() {
+		if success {
+			if !recovered {
+				vmBooted(start)
+			}
+		} else {
+			boot.failed(rerr)
+			boot.console.close()
+		}
+	}()
+
+	vcpus, memMB, err := vmShape(taskConfig, cfg, d.config.VMMOverheadMB)
+	if err != nil {
+		return nil, err
+	}
+	opts.FcCPUCount = vcpus
+	opts.FcMemSz = memMB
+
+	if taskConfig.Balloon != nil {
+		if err := taskConfig.Balloon.validate(memMB); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := checkHugePages(hugePages2MDir, taskConfig.HugePages, memMB); err != nil {
+		d.emitEvent(cfg, err.Error())
+		return nil, err
+	}
+
+	cpuTemplate, err := resolveCPUTemplate(d.config.CPUTemplateDir, taskConfig)
+	if err != nil {
+		return nil, err
+	}
+	opts.FcCPUTemplate = cpuTemplate.Static
+
+	opts.FcDNS = taskDNS(cfg)
+	if opts.FcExtraHosts, err = parseExtraHosts(taskConfig.ExtraHosts); err != nil {
+		return nil, err
+	}
+	if taskConfig.Egress != nil {
+		if err := taskConfig.Egress.validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	readyTimeout, err := taskConfig.readyTimeout()
+	if err != nil {
+		return nil, err
+	}
+	if err := checkArtifacts(opts); err != nil {
+		return nil, err
+	}
+
+	boot.next(phaseImage, "Validated the task config and artifacts")
+	runDir, err := createRuntimeDir(d.config.RuntimeDir, cfg)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if !success {
+			runDir.remove()
+		}
+	}()
+	opts.FcRuntimeDir = runDir
+	opts.FcMetricsFifo = runDir.path(runtimeMetricsFifo)
+
+	taskDirs, err := prepareTaskDirs(cfg, taskConfig.TaskDirs, runDir)
+	if err != nil {
+		return nil, err
+	}
+	volumes, packedVolumes, err := prepareVolumes(cfg)
+	if err != nil {
+		return nil, err
+	}
+	taskDirs = append(taskDirs, packedVolumes...)
+	opts.FcTaskDirDrives = taskDirs
+	opts.FcVolumeDrives = volumes
+
+	// the task config nomad passes to drivers has no ephemeral_disk, it is
+	// only looked up when there are disk sizes to validate
+	var diskMB int64
+	if taskConfig.usesEphemeralDisk() {
+		if diskMB, err = d.ephemeralDiskMB(cfg); err != nil {
+			return nil, fmt.Errorf("%v: %v", errUnknownEphemeralDisk, err)
+		}
+	}
+	rootfsMB, err := diskSizes(taskConfig, diskMB)
+	if err != nil {
+		return nil, err
+	}
+	scratchDisks, err := prepareScratchDisks(cfg, taskConfig.ScratchDisks)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if !success {
+			removeScratchDisks(scratchDisks)
+		}
+	}()
+	opts.FcScratchDrives = scratchDisks
+
+	if opts.FcRootDrivePath, err = prepareRootfs(cfg, opts.FcRootDrivePath, rootfsMB); err != nil {
+		return nil, err
+	}
+
+	persistentDisks, err := preparePersistentDisks(d.config.PersistentDiskDir, cfg, taskConfig.PersistentDisks)
+	if err != nil {
+		return nil, err
+	}
+	opts.FcPersistentDrives = persistentDisks
+
+	// the vmm log goes to the task stderr at Info unless the task says
+	// otherwise
+	vlog, err := d.openVMMLog(cfg, taskConfig)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if !success {
+			vlog.Close()
+		}
+	}()
+	opts.FcLogWriter = vlog
+	opts.FcLogLevel = vlog.levelName
+	boot.next(phaseNetwork, "Prepared the images")
+	var bridge *bridgeNetwork
+	if taskConfig.Network == bridgeNetworkName {
+		if len(taskConfig.Nic.Ip) > 0 {
+			return nil, errConflictingNetworkOpts
+		}
+		if bridge, err = d.setupBridgeNetwork(cfg); err != nil {
+			return nil, err
+		}
+		defer func() {
+			if !success {
+				d.teardownBridgeNetwork(cfg)
+			}
+		}()
+		opts.FcNetworkName = ""
+		opts.FcNicConfig = bridge.nic()
+	}
+
+	var network *vmNetwork
+	blocks := taskConfig.NetworkInterfaces
+	if len(blocks) > 0 && (len(taskConfig.Network) > 0 || len(taskConfig.Nic.Ip) > 0 || usesGroupNetwork(cfg)) {
+		return nil, errConflictingNetworkInterfaces
+	}
+	if len(opts.FcNetworkName) > 0 && !usesGroupNetwork(cfg) {
+		if len(taskConfig.Nic.Ip) > 0 {
+			return nil, errConflictingNetworkOpts
+		}
+		// the sdk reads a single address from the cni result, the network
+		// is set up like a network_interface block to get both families
+		blocks = []NetworkInterface{{Type: netIfaceCNI, Network: opts.FcNetworkName, AllowMMDS: true}}
+		opts.FcNetworkName = ""
+	}
+	if len(blocks) > 0 {
+		if network, err = d.setupNetworkInterfaces(ctx, cfg, blocks); err != nil {
+			return nil, err
+		}
+		defer func() {
+			if !success {
+				d.teardownNetworkInterfaces(cfg, network)
+			}
+		}()
+		opts.FcInterfaces = network.Interfaces
+	}
+
+	var group *groupNetwork
+	if usesGroupNetwork(cfg) {
+		if len(taskConfig.Network) > 0 || len(taskConfig.Nic.Ip) > 0 {
+			return nil, errConflictingGroupNetwork
+		}
+		ports, err := groupPorts(cfg, taskConfig.Ports)
+		if err != nil {
+			return nil, err
+		}
+		if group, err = setupGroupNetwork(cfg, ports); err != nil {
+			return nil, err
+		}
+		defer func() {
+			if !success {
+				group.teardown()
+			}
+		}()
+		opts.FcNicConfig = group.nic()
+	} else if len(taskConfig.Ports) > 0 {
+		return nil, errPortsWithoutGroupNetwork
+	}
+
+	var egress *vmEgress
+	if taskConfig.Egress != nil {
+		if egress, err = newEgress(cfg, network, group, opts.FcNicConfig); err != nil {
+			return nil, err
+		}
+		if err := egress.apply(*taskConfig.Egress); err != nil {
+			d.emitEvent(cfg, err.Error())
+			return nil, err
+		}
+		defer func() {
+			if !success {
+				egress.remove()
+			}
+		}()
+		if !recovered {
+			d.emitEvent(cfg, fmt.Sprintf("Egress policy applied on %s: %d allow rules, everything else is dropped",
+				egress.deviceNames(), len(taskConfig.Egress.Allow)))
+		}
+	}
+
+	if taskConfig.DNSDrive {
+		dnsDrive, err := prepareDNSDrive(cfg, opts.guestDNS(), opts.FcExtraHosts)
+		if err != nil {
+			return nil, err
+		}
+		opts.FcTaskDirDrives = append(opts.FcTaskDirDrives, dnsDrive)
+	}
+
+	ip, ip6, vnic := vmAddresses(opts, network)
+	boot.next(phaseVMM, networkReady(ip, ip6))
 	fcCfg, err := opts.getFirecrackerConfig(cfg.AllocID)
 	if err != nil {
 		log.Errorf("Error: %s", err)
 		return nil, err
 	}
+	if group != nil {
+		// firecracker opens the tap, it has to run in the group namespace
+		fcCfg.NetNS = group.NetNS
+	}
+	if network != nil && network.NetNS != "" {
+		fcCfg.NetNS = network.NetNS
+	}
+
+	diskLocks, err := lockDrives(fcCfg.Drives)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if !success {
+			closeFiles(diskLocks)
+		}
+	}()
+	for i := range persistentDisks {
+		if err := persistentDisks[i].grow(taskConfig.PersistentDisks[i].SizeMB); err != nil {
+			return nil, err
+		}
+	}
 
 	d.logger.Info("Starting firecracker", "driver_initialize_container", hclog.Fmt("%v+", opts))
+	// the sdk logger is per task, its level follows log_level
 	logger := log.New()
-
-	if opts.Debug {
-		log.SetLevel(log.DebugLevel)
-		logger.SetLevel(log.DebugLevel)
-	}
+	logger.SetLevel(vlog.logrusLevel())
 
 	vmmCtx, vmmCancel := context.WithCancel(ctx)
 	defer vmmCancel()
@@ -161,6 +407,10 @@ func (d *Driver) initializeContainer(ctx context.Context, cfg *drivers.TaskConfi
 	if err != nil {
 		return nil, fmt.Errorf("Could not create serial console  %v+", err)
 	}
+	// the console is only read for the events, the boot goes on without it
+	if boot.console, err = watchConsole(ftty, taskConfig.ReadyMarker); err != nil {
+		d.logger.Warn("unable to read the serial console", "task_id", cfg.ID, "error", err)
+	}
 
 	cmd := firecracker.VMCommandBuilder{}.
 		WithBin(firecrackerBinary).
@@ -169,6 +419,11 @@ func (d *Driver) initializeContainer(ctx context.Context, cfg *drivers.TaskConfi
 		WithStdout(tty).
 		WithStderr(nil).
 		Build(ctx)
+	// the vmm inherits the disk locks so they are held for as long as the
+	// vm runs, even across plugin restarts.
+	cmd.ExtraFiles = diskLocks
+	// tagged so the garbage collector can tell the micro-vms of the driver
+	cmd.Env = append(os.Environ(), taskIDEnv+"="+cfg.ID)
 
 	machineOpts = append(machineOpts, firecracker.WithProcessRunner(cmd))
 
@@ -177,9 +432,68 @@ func (d *Driver) initializeContainer(ctx context.Context, cfg *drivers.TaskConfi
 		return nil, fmt.Errorf("Failed creating machine: %v", err)
 	}
 
+	// the sdk only knows the C3 and T2 templates and has no hugepages
+	// setting, send the machine config ourselves when they are used.
+	if taskConfig.HugePages == hugePages2M || cpuTemplate.Static != "" {
+		m.Handlers.FcInit = m.Handlers.FcInit.Swap(createMachineHandler(machineConfig{
+			VcpuCount:   vcpus,
+			MemSizeMib:  memMB,
+			Smt:         firecracker.BoolValue(fcCfg.MachineCfg.Smt),
+			CPUTemplate: cpuTemplate.Static,
+			HugePages:   taskConfig.HugePages,
+		}))
+	}
+	if cpuTemplate.Custom != nil {
+		m.Handlers.FcInit = m.Handlers.FcInit.AppendAfter(firecracker.CreateMachineHandlerName,
+			setCPUConfigHandler(cpuTemplate.Custom))
+	}
+
+	var guestStats guestStatsFunc
+	if taskConfig.Balloon != nil {
+		m.Handlers.FcInit = m.Handlers.FcInit.AppendAfter(firecracker.CreateMachineHandlerName,
+			taskConfig.Balloon.balloonHandler())
+		guestStats = m.GetBalloonStats
+	}
+
+	cgroup := taskCgroup(cfg, d.config.CgroupParent)
+	if cgroup != nil && cfg.Resources.LinuxResources == nil {
+		cgroup = nil
+	}
+	numaNode := -1
+	if cores := reservedCores(cfg); taskConfig.NumaBind && len(cores) > 0 {
+		// the guest memory is bound through the cpuset of the vmm
+		if cgroup == nil {
+			return nil, errNumaBindWithoutCgroup
+		}
+		if numaNode, err = numaNodeOf(cores); err != nil {
+			return nil, err
+		}
+	}
+	if cgroup != nil {
+		m.Handlers.FcInit = m.Handlers.FcInit.AppendAfter(firecracker.StartVMMHandlerName,
+			cgroup.joinCgroupHandler(cfg.Resources.LinuxResources, memMB, d.config.VMMOverheadMB, numaNode))
+		defer func() {
+			if !success {
+				// best effort, the vmm may not have exited yet
+				cgroup.remove()
+			}
+		}()
+	}
+
+	m.Handlers.FcInit = m.Handlers.FcInit.AppendAfter(firecracker.StartVMMHandlerName,
+		boot.handler(phaseAPI, func(m *firecracker.Machine) string {
+			pid, _ := m.PID()
+			return fmt.Sprintf("Firecracker started (pid %d)", pid)
+		}))
+	m.Handlers.FcInit = m.Handlers.FcInit.Append(
+		boot.handler(phaseInstanceStart, func(*firecracker.Machine) string {
+			return "Micro-vm configured"
+		}))
+
 	if err := m.Start(vmmCtx); err != nil {
 		return nil, fmt.Errorf("Failed to start machine: %v", err)
 	}
+	boot.next(phaseGuest, "Instance started")
 
 	if opts.validMetadata != nil {
 		m.SetMetadata(vmmCtx, opts.validMetadata)
@@ -189,31 +503,64 @@ func (d *Driver) initializeContainer(ctx context.Context, cfg *drivers.TaskConfi
 	if errpid != nil {
 		return nil, fmt.Errorf("Failed getting pid for machine: %v", errpid)
 	}
-	var ip string
-	var vnic string
-	if len(opts.FcNetworkName) > 0 {
-		ip = fcCfg.NetworkInterfaces[0].StaticConfiguration.IPConfiguration.IPAddr.String()
-		vnic = fcCfg.NetworkInterfaces[0].CNIConfiguration.IfName + "vm"
-	} else {
-		ip = "No network chosen"
-		vnic = ip
+
+	if err := pinVcpus(pid, reservedCores(cfg)); err != nil {
+		m.StopVMM()
+		return nil, err
+	}
+
+	// the metrics are best effort, the task runs without them
+	vmetrics, err := startVMMetrics(opts.FcMetricsFifo, fcCfg.SocketPath, cfg, d.logger)
+	if err != nil {
+		d.logger.Warn("firecracker metrics disabled", "task_id", cfg.ID, "error", err)
 	}
 	info := Instance_info{Serial: ftty, AllocId: cfg.AllocID,
 		Ip:  ip,
+		Ip6: ip6,
 		Pid: strconv.Itoa(pid), Vnic: vnic}
 
 	f, _ := json.MarshalIndent(info, "", " ")
 
-	logfile := fmt.Sprintf("/tmp/%s-%s", cfg.Name, cfg.AllocID)
-
-	d.logger.Info("Writing to", "driver_initialize_container", hclog.Fmt("%v+", logfile))
-	log, err := os.OpenFile(logfile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	infoFile := runDir.path(runtimeInfo)
+	d.logger.Info("Writing to", "driver_initialize_container", hclog.Fmt("%v+", infoFile))
+	if err := os.WriteFile(infoFile, f, 0600); err != nil {
+		m.StopVMM()
+		return nil, fmt.Errorf("Failed creating info file=%s err=%v", infoFile, err)
+	}
+	if err := runDir.linkConsole(ftty); err != nil {
+		m.StopVMM()
+		return nil, fmt.Errorf("Failed linking the serial console: %v", err)
+	}
 
-	if err != nil {
-		return nil, fmt.Errorf("Failed creating info file=%s err=%v", logfile, err)
+	if readyTimeout > 0 && boot.console != nil {
+		if !boot.console.wait(readyTimeout) {
+			m.StopVMM()
+			return nil, fmt.Errorf("Guest not ready after %s", readyTimeout)
+		}
+		boot.done("Guest ready")
+		boot.console.close()
+	} else {
+		go boot.watchGuest()
 	}
-	defer log.Close()
-	fmt.Fprintf(log, "%s", f)
 
-	return &vminfo{Machine: m, tty: ftty, Info: info}, nil
+	success = true
+	return &vminfo{Machine: m, tty: ftty, Info: info, taskDirs: taskDirs, scratchDisks: scratchDisks,
+		persistentDisks: persistentDisks, diskLocks: diskLocks, cgroup: cgroup, bridge: bridge,
+		group: group, network: network, egress: egress, runDir: runDir, vmmLog: vlog, metrics: vmetrics, guestStats: guestStats}, nil
+}
+
+// vmAddresses returns the addresses and the host interface of the micro-vm.
+func vmAddresses(opts *options, network *vmNetwork) (ip, ip6, vnic string) {
+	if len(opts.FcNicConfig.Ip) > 0 {
+		addrs, _ := opts.FcNicConfig.addrs()
+		ip, ip6 = addrs.strings()
+		vnic = opts.FcNicConfig.Interface
+	} else if network != nil && network.primary() != nil {
+		ip, ip6 = network.primary().strings()
+		vnic = network.primary().Tap
+	} else {
+		ip = noNetworkChosen
+		vnic = ip
+	}
+	return ip, ip6, vnic
 }
@@ -0,0 +1,531 @@
+/* Firecracker-task-driver is a task driver for Hashicorp's nomad that allows
+ * to create microvms using AWS Firecracker vmm
+ * Copyright (C) 2019  Carlos Neira cneirabustos@gmail.com
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ */
+
+package firevm
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	metrics "github.com/armon/go-metrics"
+	"github.com/containernetworking/cni/libcni"
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	// taskIDEnv tags the firecracker processes started by the driver with
+	// the id of their task.
+	taskIDEnv = "NOMAD_FIRECRACKER_TASK_ID"
+
+	defaultGCInterval    = 5 * time.Minute
+	defaultGCGracePeriod = 10 * time.Minute
+
+	// kinds of orphans
+	orphanProcess    = "process"
+	orphanNetwork    = "network"
+	orphanLink       = "link"
+	orphanEgress     = "egress"
+	orphanLease      = "lease"
+	orphanRuntimeDir = "runtime_dir"
+	orphanSocket     = "socket"
+	orphanFifoDir    = "fifo_dir"
+)
+
+// taskNetName matches the names derived from tapName: taps, network
+// namespaces, cni caches and egress tables, the taps of extra bridge
+// interfaces have an index suffix.
+var taskNetName = regexp.MustCompile(`^(fc[0-9a-f]{8})(-[0-9]+)?$`)
+
+// GCConfig tunes the collector of what crashed or lost tasks leave behind.
+type GCConfig struct {
+	Disabled    bool   `codec:"disabled"`
+	Interval    string `codec:"interval"`
+	GracePeriod string `codec:"grace_period"`
+	DryRun      bool   `codec:"dry_run"`
+}
+
+// orphan is something the driver created that no task claims.
+type orphan struct {
+	Kind  string
+	Name  string
+	clean func() error
+}
+
+// claims is what the tasks the driver tracks use.
+type claims struct {
+	pids    map[int]bool
+	taskIDs map[string]bool
+	nets    map[string]bool
+	runDirs map[string]bool
+}
+
+// collector periodically removes orphans. Something is only removed once it
+// has been unclaimed for the grace period, so tasks being started or
+// recovered are left alone.
+type collector struct {
+	d        *Driver
+	interval time.Duration
+	grace    time.Duration
+	dryRun   bool
+
+	// seen is when each orphan was first found
+	seen map[string]time.Time
+}
+
+func newCollector(d *Driver, conf GCConfig) (*collector, error) {
+	c := &collector{
+		d:        d,
+		interval: defaultGCInterval,
+		grace:    defaultGCGracePeriod,
+		dryRun:   conf.DryRun,
+		seen:     map[string]time.Time{},
+	}
+	var err error
+	if conf.Interval != "" {
+		if c.interval, err = time.ParseDuration(conf.Interval); err != nil || c.interval <= 0 {
+			return nil, fmt.Errorf("invalid gc interval %q", conf.Interval)
+		}
+	}
+	if conf.GracePeriod != "" {
+		if c.grace, err = time.ParseDuration(conf.GracePeriod); err != nil || c.grace < 0 {
+			return nil, fmt.Errorf("invalid gc grace_period %q", conf.GracePeriod)
+		}
+	}
+	return c, nil
+}
+
+// configureGC starts the collector of the config. A changed config stops
+// the running collector, once its sweep is over, before the new one starts.
+// An invalid config leaves the running collector alone.
+func (d *Driver) configureGC(config GCConfig) error {
+	d.gcLock.Lock()
+	defer d.gcLock.Unlock()
+	if d.gc != nil && *d.gc == config {
+		return nil
+	}
+	var c *collector
+	if !config.Disabled {
+		var err error
+		if c, err = newCollector(d, config); err != nil {
+			return err
+		}
+	}
+	if d.stopGC != nil {
+		d.stopGC()
+		d.stopGC = nil
+	}
+	if c != nil {
+		ctx, cancel := context.WithCancel(d.ctx)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			c.run(ctx)
+		}()
+		d.stopGC = func() {
+			cancel()
+			<-done
+		}
+	}
+	d.gc = &config
+	return nil
+}
+
+// run sweeps when the plugin starts and then every interval.
+func (c *collector) run(ctx context.Context) {
+	c.d.logger.Info("starting garbage collector", "interval", c.interval, "grace_period", c.grace, "dry_run", c.dryRun)
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	for {
+		c.sweep()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (c *collector) sweep() {
+	orphans := c.scan(c.d.claims())
+	metrics.SetGauge([]string{"firecracker", "gc", "orphans"}, float32(len(orphans)))
+	c.reap(orphans, time.Now())
+}
+
+// reap removes the orphans unclaimed for the grace period, or only logs
+// them in a dry run. The orphans no longer found are forgotten.
+func (c *collector) reap(orphans []orphan, now time.Time) {
+	seen := map[string]time.Time{}
+	for _, o := range orphans {
+		key := o.Kind + ":" + o.Name
+		first, ok := c.seen[key]
+		if !ok {
+			first = now
+			c.d.logger.Debug("found orphan", "kind", o.Kind, "name", o.Name)
+		}
+		if now.Sub(first) < c.grace {
+			seen[key] = first
+			continue
+		}
+		labels := []metrics.Label{{Name: "kind", Value: o.Kind}}
+		if c.dryRun {
+			c.d.logger.Info("dry run, would remove orphan", "kind", o.Kind, "name", o.Name)
+			metrics.IncrCounterWithLabels([]string{"firecracker", "gc", "dry_run"}, 1, labels)
+			seen[key] = first
+			continue
+		}
+		if err := o.clean(); err != nil {
+			c.d.logger.Error("failed to remove orphan", "kind", o.Kind, "name", o.Name, "error", err)
+			metrics.IncrCounterWithLabels([]string{"firecracker", "gc", "failed"}, 1, labels)
+			seen[key] = first
+			continue
+		}
+		c.d.logger.Info("removed orphan", "kind", o.Kind, "name", o.Name)
+		metrics.IncrCounterWithLabels([]string{"firecracker", "gc", "removed"}, 1, labels)
+	}
+	c.seen = seen
+}
+
+// claims returns what the tracked tasks use.
+func (d *Driver) claims() claims {
+	cl := claims{
+		pids:    map[int]bool{},
+		taskIDs: map[string]bool{},
+		nets:    map[string]bool{},
+		runDirs: map[string]bool{},
+	}
+	for _, h := range d.tasks.List() {
+		h.stateLock.RLock()
+		if pid, err := strconv.Atoi(h.Info.Pid); err == nil {
+			cl.pids[pid] = true
+		}
+		cl.taskIDs[h.taskConfig.ID] = true
+		cl.nets[tapName(h.taskConfig)] = true
+		cl.runDirs[string(h.runDir)] = true
+		h.stateLock.RUnlock()
+	}
+	return cl
+}
+
+// scan lists the orphans, processes first so nothing is removed from under
+// a running micro-vm.
+func (c *collector) scan(cl claims) []orphan {
+	var orphans []orphan
+	scanners := []func(claims) ([]orphan, error){
+		scanProcesses,
+		scanNetworks,
+		scanLinks,
+		scanEgressTables,
+		c.d.scanLeases,
+		c.d.scanRuntimeDirs,
+		scanLegacyFiles,
+	}
+	for _, scan := range scanners {
+		found, err := scan(cl)
+		if err != nil {
+			c.d.logger.Warn("garbage collector scan failed", "error", err)
+		}
+		orphans = append(orphans, found...)
+	}
+	return orphans
+}
+
+// scanProcesses finds the tagged firecracker processes of no tracked task.
+func scanProcesses(cl claims) ([]orphan, error) {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil, err
+	}
+	var orphans []orphan
+	for _, e := range entries {
+		pid, err := strconv.Atoi(e.Name())
+		if err != nil || cl.pids[pid] {
+			continue
+		}
+		taskID, ok := processTaskID(pid)
+		if !ok {
+			continue
+		}
+		orphans = append(orphans, orphan{
+			Kind: orphanProcess,
+			Name: fmt.Sprintf("%d (task %s)", pid, taskID),
+			clean: func() error {
+				// the tag is checked again, the pid may have been reused
+				if id, ok := processTaskID(pid); !ok || id != taskID {
+					return nil
+				}
+				if err := syscall.Kill(pid, syscall.SIGKILL); err != nil && err != syscall.ESRCH {
+					return err
+				}
+				return nil
+			},
+		})
+	}
+	return orphans, nil
+}
+
+// processTaskID returns the task id a process is tagged with.
+func processTaskID(pid int) (string, bool) {
+	environ, err := os.ReadFile(fmt.Sprintf("/proc/%d/environ", pid))
+	if err != nil {
+		return "", false
+	}
+	for _, kv := range bytes.Split(environ, []byte{0}) {
+		if v := strings.TrimPrefix(string(kv), taskIDEnv+"="); v != string(kv) {
+			return v, true
+		}
+	}
+	return "", false
+}
+
+// scanNetworks finds the network namespaces and cni caches of no tracked
+// task. They are released with CNI DEL from the cached attachments.
+func scanNetworks(cl claims) ([]orphan, error) {
+	names := map[string]bool{}
+	for _, dir := range []string{netNSDir, cniCacheDir} {
+		entries, err := os.ReadDir(dir)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		for _, e := range entries {
+			if m := taskNetName.FindStringSubmatch(e.Name()); m != nil && m[2] == "" && !cl.nets[m[1]] {
+				names[m[1]] = true
+			}
+		}
+	}
+	var orphans []orphan
+	for name := range names {
+		orphans = append(orphans, orphan{
+			Kind:  orphanNetwork,
+			Name:  name,
+			clean: func() error { return releaseCachedNetwork(name) },
+		})
+	}
+	return orphans, nil
+}
+
+// releaseCachedNetwork runs CNI DEL for what libcni cached for the task
+// named name, then removes its namespace and cache.
+func releaseCachedNetwork(name string) error {
+	netns := filepath.Join(netNSDir, name)
+	cacheDir := filepath.Join(cniCacheDir, name)
+	attachments, err := libcni.NewCNIConfigWithCacheDir([]string{cniBinDir}, cacheDir, nil).GetCachedAttachments(name)
+	if err != nil {
+		return err
+	}
+	for _, a := range attachments {
+		list, err := libcni.ConfListFromBytes(a.Config)
+		if err != nil {
+			return fmt.Errorf("Fail to parse the cached config of %s: %v", a.Network, err)
+		}
+		att := newCNIAttachment(list, &libcni.RuntimeConf{ContainerID: a.ContainerID, IfName: a.IfName, Args: a.CniArgs}, cacheDir)
+		if err := att.del(context.Background(), netns); err != nil {
+			return err
+		}
+	}
+	if err := removeNetNS(netns); err != nil {
+		return err
+	}
+	return os.RemoveAll(cacheDir)
+}
+
+// scanLinks finds the taps of no tracked task in the host namespace.
+func scanLinks(cl claims) ([]orphan, error) {
+	links, err := netlink.LinkList()
+	if err != nil {
+		return nil, err
+	}
+	var orphans []orphan
+	for _, l := range links {
+		name := l.Attrs().Name
+		m := taskNetName.FindStringSubmatch(name)
+		if m == nil || cl.nets[m[1]] || l.Type() != "tuntap" {
+			continue
+		}
+		orphans = append(orphans, orphan{
+			Kind: orphanLink,
+			Name: name,
+			clean: func() error {
+				link, err := netlink.LinkByName(name)
+				if err != nil {
+					return nil
+				}
+				return netlink.LinkDel(link)
+			},
+		})
+	}
+	return orphans, nil
+}
+
+// scanEgressTables finds the egress tables of no tracked task, nothing is
+// found when nft isn't installed.
+func scanEgressTables(cl claims) ([]orphan, error) {
+	if _, err := exec.LookPath("nft"); err != nil {
+		return nil, nil
+	}
+	out, err := exec.Command("nft", "list", "tables").Output()
+	if err != nil {
+		return nil, fmt.Errorf("Fail to list nftables tables: %v", err)
+	}
+	var orphans []orphan
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 3 || fields[0] != "table" {
+			continue
+		}
+		family, table := fields[1], fields[2]
+		if m := taskNetName.FindStringSubmatch(table); m == nil || m[2] != "" || cl.nets[table] {
+			continue
+		}
+		orphans = append(orphans, orphan{
+			Kind: orphanEgress,
+			Name: family + " " + table,
+			clean: func() error {
+				return nft(fmt.Sprintf("add table %s %s\ndelete table %s %s\n", family, table, family, table))
+			},
+		})
+	}
+	return orphans, nil
+}
+
+// scanLeases finds the bridge addresses leased to no tracked task, the
+// owner of a lease is the task id, with the interface index for
+// network_interface blocks.
+func (d *Driver) scanLeases(cl claims) ([]orphan, error) {
+	if d.config.Bridge.Subnet == "" {
+		return nil, nil
+	}
+	subnet, gateway, err := d.config.Bridge.subnet()
+	if err != nil {
+		return nil, err
+	}
+	pool := newIPAM(d.config.Bridge.ipamDir(), subnet, gateway)
+	leases, err := pool.leases()
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var orphans []orphan
+	for ip, owner := range leases {
+		if cl.taskIDs[owner] {
+			continue
+		}
+		if i := strings.LastIndex(owner, "/"); i > 0 && cl.taskIDs[owner[:i]] {
+			continue
+		}
+		orphans = append(orphans, orphan{
+			Kind:  orphanLease,
+			Name:  ip + " (" + owner + ")",
+			clean: func() error { return pool.release(owner) },
+		})
+	}
+	return orphans, nil
+}
+
+// scanRuntimeDirs finds the runtime directories of no tracked task.
+func (d *Driver) scanRuntimeDirs(cl claims) ([]orphan, error) {
+	root := runtimeRoot(d.config.RuntimeDir)
+	entries, err := os.ReadDir(root)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var orphans []orphan
+	for _, e := range entries {
+		r := runtimeDir(filepath.Join(root, e.Name()))
+		if !e.IsDir() || cl.runDirs[string(r)] {
+			continue
+		}
+		orphans = append(orphans, orphan{Kind: orphanRuntimeDir, Name: string(r), clean: r.remove})
+	}
+	return orphans, nil
+}
+
+// scanLegacyFiles finds the sockets and fifo directories older versions of
+// the driver left in $HOME and the temp dir, unless a firecracker process
+// still uses them.
+func scanLegacyFiles(cl claims) ([]orphan, error) {
+	var candidates []orphan
+	if home := os.Getenv("HOME"); home != "" {
+		sockets, _ := filepath.Glob(filepath.Join(home, ".firecracker.sock-*"))
+		for _, s := range sockets {
+			candidates = append(candidates, orphan{Kind: orphanSocket, Name: s})
+		}
+	}
+	dirs, _ := filepath.Glob(filepath.Join(os.TempDir(), "fcfifo*"))
+	for _, dir := range dirs {
+		candidates = append(candidates, orphan{Kind: orphanFifoDir, Name: dir})
+	}
+	if len(candidates) == 0 {
+		return nil, nil
+	}
+
+	used := firecrackerPaths()
+	var orphans []orphan
+	for _, o := range candidates {
+		path := o.Name
+		if used[path] || (o.Kind == orphanFifoDir && usedUnder(used, path)) {
+			continue
+		}
+		o.clean = func() error { return os.RemoveAll(path) }
+		orphans = append(orphans, o)
+	}
+	return orphans, nil
+}
+
+// firecrackerPaths returns the arguments and open files of the running
+// firecracker processes, the api socket is an argument and the fifos are
+// open files.
+func firecrackerPaths() map[string]bool {
+	used := map[string]bool{}
+	entries, _ := os.ReadDir("/proc")
+	for _, e := range entries {
+		if _, err := strconv.Atoi(e.Name()); err != nil {
+			continue
+		}
+		proc := filepath.Join("/proc", e.Name())
+		cmdline, err := os.ReadFile(filepath.Join(proc, "cmdline"))
+		if err != nil || !strings.Contains(filepath.Base(string(bytes.SplitN(cmdline, []byte{0}, 2)[0])), "firecracker") {
+			continue
+		}
+		for _, arg := range bytes.Split(cmdline, []byte{0}) {
+			used[string(arg)] = true
+		}
+		fds, _ := os.ReadDir(filepath.Join(proc, "fd"))
+		for _, fd := range fds {
+			if target, err := os.Readlink(filepath.Join(proc, "fd", fd.Name())); err == nil {
+				used[target] = true
+			}
+		}
+	}
+	return used
+}
+
+func usedUnder(used map[string]bool, dir string) bool {
+	for path := range used {
+		if strings.HasPrefix(path, dir+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,260 @@
+/* Firecracker-task-driver is a task driver for Hashicorp's nomad that allows
+ * to create microvms using AWS Firecracker vmm
+ * Copyright (C) 2019  Carlos Neira cneirabustos@gmail.com
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ */
+
+package firevm
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	hclog "github.com/hashicorp/go-hclog"
+)
+
+func TestCollectorReap(t *testing.T) {
+	cleaned := map[string]int{}
+	found := func(name string, err error) orphan {
+		return orphan{Kind: orphanLink, Name: name, clean: func() error {
+			cleaned[name]++
+			return err
+		}}
+	}
+	d := NewFirecrackerDriver(hclog.NewNullLogger()).(*Driver)
+	defer d.signalShutdown()
+
+	cases := []struct {
+		name    string
+		dryRun  bool
+		sweeps  [][]orphan
+		after   time.Duration
+		cleaned map[string]int
+		seen    []string
+	}{
+		{
+			name:    "within the grace period",
+			sweeps:  [][]orphan{{found("a", nil)}, {found("a", nil)}},
+			after:   time.Minute,
+			cleaned: map[string]int{},
+			seen:    []string{"link:a"},
+		},
+		{
+			name:    "unclaimed for the grace period",
+			sweeps:  [][]orphan{{found("a", nil), found("b", nil)}, {found("a", nil), found("b", nil)}},
+			after:   10 * time.Minute,
+			cleaned: map[string]int{"a": 1, "b": 1},
+		},
+		{
+			// a task being started claims it before the next sweep
+			name:    "claimed again",
+			sweeps:  [][]orphan{{found("a", nil)}, {}, {found("a", nil)}},
+			after:   10 * time.Minute,
+			cleaned: map[string]int{},
+			seen:    []string{"link:a"},
+		},
+		{
+			name:    "dry run",
+			dryRun:  true,
+			sweeps:  [][]orphan{{found("a", nil)}, {found("a", nil)}},
+			after:   10 * time.Minute,
+			cleaned: map[string]int{},
+			seen:    []string{"link:a"},
+		},
+		{
+			// retried on the next sweep
+			name:    "failed removal",
+			sweeps:  [][]orphan{{found("a", errors.New("busy"))}, {found("a", errors.New("busy"))}},
+			after:   10 * time.Minute,
+			cleaned: map[string]int{"a": 1},
+			seen:    []string{"link:a"},
+		},
+	}
+	for _, c := range cases {
+		for k := range cleaned {
+			delete(cleaned, k)
+		}
+		col, err := newCollector(d, GCConfig{GracePeriod: "10m", DryRun: c.dryRun})
+		if err != nil {
+			t.Fatal(err)
+		}
+		now := time.Now()
+		for _, orphans := range c.sweeps {
+			col.reap(orphans, now)
+			now = now.Add(c.after)
+		}
+		if fmt.Sprint(cleaned) != fmt.Sprint(c.cleaned) {
+			t.Errorf("%s: cleaned %v, want %v", c.name, cleaned, c.cleaned)
+		}
+		var seen []string
+		for k := range col.seen {
+			seen = append(seen, k)
+		}
+		sort.Strings(seen)
+		if strings.Join(seen, ",") != strings.Join(c.seen, ",") {
+			t.Errorf("%s: seen %v, want %v", c.name, seen, c.seen)
+		}
+	}
+}
+
+func TestNewCollector(t *testing.T) {
+	cases := []struct {
+		conf     GCConfig
+		interval time.Duration
+		grace    time.Duration
+		ok       bool
+	}{
+		{GCConfig{}, defaultGCInterval, defaultGCGracePeriod, true},
+		{GCConfig{Interval: "1m", GracePeriod: "0s"}, time.Minute, 0, true},
+		{GCConfig{Interval: "0s"}, 0, 0, false},
+		{GCConfig{Interval: "soon"}, 0, 0, false},
+		{GCConfig{GracePeriod: "-1m"}, 0, 0, false},
+	}
+	for _, c := range cases {
+		col, err := newCollector(nil, c.conf)
+		if (err == nil) != c.ok {
+			t.Errorf("%+v: got error %v", c.conf, err)
+			continue
+		}
+		if c.ok && (col.interval != c.interval || col.grace != c.grace) {
+			t.Errorf("%+v: got interval %s grace %s", c.conf, col.interval, col.grace)
+		}
+	}
+}
+
+func TestScanProcesses(t *testing.T) {
+	cmd := startTaggedProcess(t, "task-gc")
+	pid := cmd.Process.Pid
+
+	find := func(cl claims) *orphan {
+		orphans, err := scanProcesses(cl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, o := range orphans {
+			if strings.HasPrefix(o.Name, fmt.Sprintf("%d ", pid)) {
+				return &o
+			}
+		}
+		return nil
+	}
+
+	if o := find(claims{pids: map[int]bool{pid: true}}); o != nil {
+		t.Errorf("claimed process reported as orphan: %s", o.Name)
+	}
+	o := find(claims{pids: map[int]bool{}})
+	if o == nil {
+		t.Fatal("unclaimed tagged process not found")
+	}
+	if o.Kind != orphanProcess || o.Name != fmt.Sprintf("%d (task task-gc)", pid) {
+		t.Errorf("got orphan %s %s", o.Kind, o.Name)
+	}
+	if err := o.clean(); err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Wait(); err == nil || cmd.ProcessState.Sys().(syscall.WaitStatus).Signal() != syscall.SIGKILL {
+		t.Errorf("orphan not killed: %v", err)
+	}
+}
+
+func TestScanLeases(t *testing.T) {
+	d := NewFirecrackerDriver(hclog.NewNullLogger()).(*Driver)
+	defer d.signalShutdown()
+	d.config.Bridge = BridgeConfig{Subnet: "10.0.0.0/29", IPAMDir: t.TempDir()}
+	subnet, gateway, err := d.config.Bridge.subnet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := newIPAM(d.config.Bridge.ipamDir(), subnet, gateway)
+	// the leases of network_interface blocks are owned by <task>/<index>
+	for _, owner := range []string{"running", "running/1", "gone", "gone/1"} {
+		if _, err := pool.allocate(owner); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	orphans, err := d.scanLeases(claims{taskIDs: map[string]bool{"running": true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, o := range orphans {
+		names = append(names, o.Name)
+	}
+	sort.Strings(names)
+	if want := "10.0.0.4 (gone),10.0.0.5 (gone/1)"; strings.Join(names, ",") != want {
+		t.Errorf("got orphans %v, want %s", names, want)
+	}
+
+	for _, o := range orphans {
+		if err := o.clean(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	leases, err := pool.leases()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(leases) != 2 || leases["10.0.0.2"] != "running" || leases["10.0.0.3"] != "running/1" {
+		t.Errorf("leases left %v", leases)
+	}
+}
+
+func TestConfigureGC(t *testing.T) {
+	d := NewFirecrackerDriver(hclog.NewNullLogger()).(*Driver)
+	defer d.signalShutdown()
+	// the runtime root of the test, nothing found stays for the grace period
+	d.config.RuntimeDir = t.TempDir()
+	enabled := GCConfig{Interval: "1h", GracePeriod: "1h"}
+
+	if err := d.configureGC(GCConfig{Disabled: true}); err != nil {
+		t.Fatal(err)
+	}
+	if d.stopGC != nil {
+		t.Error("collector started while disabled")
+	}
+
+	if err := d.configureGC(enabled); err != nil {
+		t.Fatal(err)
+	}
+	if d.stopGC == nil {
+		t.Fatal("collector not started once enabled")
+	}
+	running := d.gc
+	if err := d.configureGC(enabled); err != nil || d.gc != running {
+		t.Errorf("unchanged config restarted the collector: %v", err)
+	}
+
+	dryRun := enabled
+	dryRun.DryRun = true
+	if err := d.configureGC(dryRun); err != nil {
+		t.Fatal(err)
+	}
+	if d.gc == running || !d.gc.DryRun || d.stopGC == nil {
+		t.Errorf("dry_run not applied: %+v", d.gc)
+	}
+
+	if err := d.configureGC(GCConfig{Interval: "soon"}); err == nil {
+		t.Error("no error with an invalid interval")
+	}
+	if !d.gc.DryRun || d.stopGC == nil {
+		t.Error("invalid config stopped the running collector")
+	}
+
+	if err := d.configureGC(GCConfig{Disabled: true}); err != nil {
+		t.Fatal(err)
+	}
+	if d.stopGC != nil {
+		t.Error("collector still running once disabled")
+	}
+}
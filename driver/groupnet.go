@@ -0,0 +1,317 @@
+/* Firecracker-task-driver is a task driver for Hashicorp's nomad that allows
+ * to create microvms using AWS Firecracker vmm
+ * Copyright (C) 2019  Carlos Neira cneirabustos@gmail.com
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ */
+
+package firevm
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/hashicorp/nomad/nomad/structs"
+	"github.com/hashicorp/nomad/plugins/drivers"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// groupNetwork is the tap created for the micro-vm in the network namespace
+// nomad set up for the task group. The tap and the guest share a /30 link,
+// the namespace routes the guest traffic and masquerades it behind its own
+// address, only the forwarded ports of the task are sent to the guest.
+type groupNetwork struct {
+	NetNS string
+	Tap   string
+	Link  string
+	Ports []int
+
+	// local are the addresses of the namespace interface
+	local guestAddrs
+	// guestAddrs are the addresses of the guest, the gateways are the
+	// addresses of the tap
+	guestAddrs
+}
+
+var (
+	// groupLinkNet is split in /30 links between the group namespace and
+	// each micro-vm of the group, groupLinkNet6 in /126 ones.
+	groupLinkNet  = net.IPNet{IP: net.IPv4(169, 254, 100, 0).To4(), Mask: net.CIDRMask(24, 32)}
+	groupLinkNet6 = net.IPNet{IP: net.ParseIP("fd00:fc::"), Mask: net.CIDRMask(120, 128)}
+)
+
+// usesGroupNetwork reports whether the task runs in a group network
+// (network { mode = "bridge" } or "cni/*").
+func usesGroupNetwork(cfg *drivers.TaskConfig) bool {
+	return cfg.NetworkIsolation != nil &&
+		cfg.NetworkIsolation.Mode == drivers.NetIsolationModeGroup &&
+		cfg.NetworkIsolation.Path != ""
+}
+
+// groupPorts returns the ports the guest listens on for the given port
+// labels of the group network.
+func groupPorts(cfg *drivers.TaskConfig, labels []string) ([]int, error) {
+	var ports []int
+	for _, label := range labels {
+		var p structs.AllocatedPortMapping
+		var ok bool
+		if cfg.Resources != nil && cfg.Resources.Ports != nil {
+			p, ok = cfg.Resources.Ports.Get(label)
+		}
+		if !ok {
+			return nil, fmt.Errorf("%v: %s", errUnknownPortLabel, label)
+		}
+		if p.To > 0 {
+			ports = append(ports, p.To)
+		} else {
+			ports = append(ports, p.Value)
+		}
+	}
+	return ports, nil
+}
+
+func (g *groupNetwork) nic() Nic {
+	n := Nic{Interface: g.Tap}
+	n.Ip, n.Ip6 = g.strings()
+	if g.Gateway != nil {
+		n.Gateway = g.Gateway.String()
+	}
+	if g.Gateway6 != nil {
+		n.Gateway6 = g.Gateway6.String()
+	}
+	if n.Ip == "" {
+		// ipv6 only namespace
+		n.Ip, n.Gateway, n.Ip6, n.Gateway6 = n.Ip6, n.Gateway6, "", ""
+	}
+	return n
+}
+
+// groupLink returns the addresses of the tap and of the guest on the link
+// of the given slot, for the families the namespace has an address of.
+func groupLink(slot int, local guestAddrs) (tap, guest guestAddrs) {
+	if local.IP != nil {
+		base := groupLinkNet.IP.To4()
+		mask := net.CIDRMask(30, 32)
+		t := net.IPv4(base[0], base[1], base[2], base[3]+byte(4*slot+1)).To4()
+		v := net.IPv4(base[0], base[1], base[2], base[3]+byte(4*slot+2)).To4()
+		tap.add(net.IPNet{IP: t, Mask: mask}, nil)
+		guest.add(net.IPNet{IP: v, Mask: mask}, t)
+	}
+	if local.IP6 != nil {
+		mask := net.CIDRMask(126, 128)
+		t := make(net.IP, net.IPv6len)
+		copy(t, groupLinkNet6.IP)
+		t[15] = byte(4*slot + 1)
+		v := make(net.IP, net.IPv6len)
+		copy(v, t)
+		v[15]++
+		tap.add(net.IPNet{IP: t, Mask: mask}, nil)
+		guest.add(net.IPNet{IP: v, Mask: mask}, t)
+	}
+	return tap, guest
+}
+
+// groupLinkSlot returns the link of the tap when it already has one, the
+// task restarted in the same namespace, or the first one no other tap of
+// the group uses.
+func groupLinkSlot(tap netlink.Link) (int, error) {
+	addrs, err := netlink.AddrList(nil, netlink.FAMILY_V4)
+	if err != nil {
+		return 0, err
+	}
+	used := map[int]bool{}
+	for _, a := range addrs {
+		if !groupLinkNet.Contains(a.IP) {
+			continue
+		}
+		slot := int(a.IP.To4()[3]) / 4
+		if a.LinkIndex == tap.Attrs().Index {
+			return slot, nil
+		}
+		used[slot] = true
+	}
+	ones, bits := groupLinkNet.Mask.Size()
+	for slot := 0; slot < 1<<(bits-ones)/4; slot++ {
+		if !used[slot] {
+			return slot, nil
+		}
+	}
+	return 0, errGroupNetworkFull
+}
+
+// setupGroupNetwork creates the tap of the micro-vm in the group network
+// namespace, routes the guest traffic out of the namespace interface and
+// forwards the given ports to the guest.
+func setupGroupNetwork(cfg *drivers.TaskConfig, ports []int) (*groupNetwork, error) {
+	g := &groupNetwork{
+		NetNS: cfg.NetworkIsolation.Path,
+		Tap:   tapName(cfg),
+		Ports: ports,
+	}
+
+	err := ns.WithNetNSPath(g.NetNS, func(ns.NetNS) error {
+		link, addrs, err := namespaceInterface(g.Tap)
+		if err != nil {
+			return err
+		}
+		g.Link = link.Attrs().Name
+		g.local = addrs
+
+		if err := createTap(g.Tap, nil); err != nil {
+			return err
+		}
+		tap, err := netlink.LinkByName(g.Tap)
+		if err != nil {
+			return err
+		}
+		if err := netlink.LinkSetMTU(tap, link.Attrs().MTU); err != nil {
+			return fmt.Errorf("Fail to set the mtu of %s: %v", g.Tap, err)
+		}
+		slot, err := groupLinkSlot(tap)
+		if err != nil {
+			return err
+		}
+		tapAddrs, guest := groupLink(slot, g.local)
+		g.guestAddrs = guest
+		for _, a := range []*net.IPNet{tapAddrs.IP, tapAddrs.IP6} {
+			if a == nil {
+				continue
+			}
+			if err := netlink.AddrReplace(tap, &netlink.Addr{IPNet: a}); err != nil {
+				return fmt.Errorf("Fail to add %s to %s: %v", a, g.Tap, err)
+			}
+		}
+
+		for _, s := range g.sysctls() {
+			if err := os.WriteFile(s[0], []byte(s[1]), 0644); err != nil {
+				return fmt.Errorf("Fail to set %s: %v", s[0], err)
+			}
+		}
+		// nft runs in a child process, which starts in the namespace of
+		// this locked thread.
+		return nft(g.ruleset())
+	})
+	if err != nil {
+		g.teardown()
+		return nil, fmt.Errorf("Fail to set up the group network: %v", err)
+	}
+	return g, nil
+}
+
+// teardown deletes the tap of the micro-vm, with its addresses, and its nft
+// table from the group network namespace. The sysctls of the namespace are
+// left, ip_forward is shared by the micro-vms of the group and the namespace
+// goes away with the allocation. Nothing is left once nomad removed it.
+func (g *groupNetwork) teardown() error {
+	if _, err := os.Stat(g.NetNS); os.IsNotExist(err) {
+		return nil
+	}
+	err := ns.WithNetNSPath(g.NetNS, func(ns.NetNS) error {
+		// the tap goes even when nft fails, a restart finds the table
+		// and replaces it
+		t := "inet " + g.Tap
+		nftErr := nft(fmt.Sprintf("add table %s\ndelete table %s\n", t, t))
+		if link, err := netlink.LinkByName(g.Tap); err == nil {
+			if err := netlink.LinkDel(link); err != nil {
+				return fmt.Errorf("Fail to delete tap device: %v", err)
+			}
+		}
+		return nftErr
+	})
+	if err != nil {
+		return fmt.Errorf("Fail to tear down the group network: %v", err)
+	}
+	return nil
+}
+
+// sysctls are the settings of the namespace needed to route the guest
+// traffic. route_localnet lets the guest reach the services bound to the
+// loopback of the namespace, like the connect upstreams.
+func (g *groupNetwork) sysctls() [][2]string {
+	var s [][2]string
+	if g.IP != nil {
+		s = append(s,
+			[2]string{"/proc/sys/net/ipv4/ip_forward", "1"},
+			[2]string{"/proc/sys/net/ipv4/conf/" + g.Tap + "/route_localnet", "1"},
+		)
+	}
+	if g.IP6 != nil {
+		s = append(s, [2]string{"/proc/sys/net/ipv6/conf/all/forwarding", "1"})
+	}
+	return s
+}
+
+// ruleset renders the nftables script of the namespace. The guest traffic
+// leaves masqueraded behind the namespace address, the forwarded ports
+// reaching the namespace address or its loopback go to the guest, and the
+// guest reaches the loopback of the namespace through its gateway.
+func (g *groupNetwork) ruleset() string {
+	var b strings.Builder
+	t := "inet " + g.Tap
+	fmt.Fprintf(&b, "add table %s\n", t)
+	fmt.Fprintf(&b, "delete table %s\n", t)
+	fmt.Fprintf(&b, "add table %s\n", t)
+	fmt.Fprintf(&b, "add chain %s prerouting { type nat hook prerouting priority dstnat ; policy accept ; }\n", t)
+	fmt.Fprintf(&b, "add chain %s output { type nat hook output priority -100 ; policy accept ; }\n", t)
+	fmt.Fprintf(&b, "add chain %s postrouting { type nat hook postrouting priority srcnat ; policy accept ; }\n", t)
+
+	if g.IP != nil {
+		guest := g.IP.IP.String()
+		fmt.Fprintf(&b, "add rule %s postrouting oifname %q ip saddr %s masquerade\n", t, g.Link, guest)
+		fmt.Fprintf(&b, "add rule %s postrouting oifname %q ip saddr 127.0.0.0/8 masquerade\n", t, g.Tap)
+		fmt.Fprintf(&b, "add rule %s prerouting iifname %q ip daddr %s meta l4proto { tcp, udp } dnat ip to 127.0.0.1\n", t, g.Tap, g.Gateway)
+		for _, p := range g.Ports {
+			fmt.Fprintf(&b, "add rule %s prerouting iifname %q ip daddr %s meta l4proto { tcp, udp } th dport %d dnat ip to %s\n", t, g.Link, g.local.IP.IP, p, guest)
+			fmt.Fprintf(&b, "add rule %s output ip daddr { 127.0.0.1, %s } meta l4proto { tcp, udp } th dport %d dnat ip to %s\n", t, g.local.IP.IP, p, guest)
+		}
+	}
+	if g.IP6 != nil {
+		guest := g.IP6.IP.String()
+		fmt.Fprintf(&b, "add rule %s postrouting oifname %q ip6 saddr %s masquerade\n", t, g.Link, guest)
+		for _, p := range g.Ports {
+			fmt.Fprintf(&b, "add rule %s prerouting iifname %q ip6 daddr %s meta l4proto { tcp, udp } th dport %d dnat ip6 to %s\n", t, g.Link, g.local.IP6.IP, p, guest)
+			fmt.Fprintf(&b, "add rule %s output ip6 daddr %s meta l4proto { tcp, udp } th dport %d dnat ip6 to %s\n", t, g.local.IP6.IP, p, guest)
+		}
+	}
+	return b.String()
+}
+
+// namespaceInterface returns the interface nomad configured in the group
+// network namespace and its global ipv4 and ipv6 addresses.
+func namespaceInterface(tap string) (netlink.Link, guestAddrs, error) {
+	links, err := netlink.LinkList()
+	if err != nil {
+		return nil, guestAddrs{}, err
+	}
+	for _, link := range links {
+		if link.Attrs().Flags&net.FlagLoopback != 0 || link.Attrs().Name == tap {
+			continue
+		}
+		addrs, err := netlink.AddrList(link, netlink.FAMILY_ALL)
+		if err != nil {
+			return nil, guestAddrs{}, err
+		}
+		var a guestAddrs
+		for _, addr := range addrs {
+			if addr.Scope != unix.RT_SCOPE_UNIVERSE {
+				continue
+			}
+			v4 := addr.IP.To4() != nil
+			if (v4 && a.IP == nil) || (!v4 && a.IP6 == nil) {
+				a.add(*addr.IPNet, nil)
+			}
+		}
+		if !a.empty() {
+			return link, a, nil
+		}
+	}
+	return nil, guestAddrs{}, fmt.Errorf("no interface with an address in the group network")
+}
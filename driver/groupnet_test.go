@@ -0,0 +1,163 @@
+/* Firecracker-task-driver is a task driver for Hashicorp's nomad that allows
+ * to create microvms using AWS Firecracker vmm
+ * Copyright (C) 2019  Carlos Neira cneirabustos@gmail.com
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ */
+
+package firevm
+
+import (
+	"net"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/testutils"
+	"github.com/hashicorp/nomad/nomad/structs"
+	"github.com/hashicorp/nomad/plugins/drivers"
+	"github.com/vishvananda/netlink"
+)
+
+func TestGroupLink(t *testing.T) {
+	v4 := &net.IPNet{IP: net.ParseIP("172.26.64.10").To4(), Mask: net.CIDRMask(20, 32)}
+	v6 := &net.IPNet{IP: net.ParseIP("fd12::10"), Mask: net.CIDRMask(64, 128)}
+	cases := []struct {
+		name     string
+		slot     int
+		local    guestAddrs
+		tap      []string
+		guest    []string
+		gateways []string
+	}{
+		{"ipv4", 0, guestAddrs{IP: v4}, []string{"169.254.100.1/30", ""}, []string{"169.254.100.2/30", ""}, []string{"169.254.100.1", ""}},
+		{"second slot", 1, guestAddrs{IP: v4}, []string{"169.254.100.5/30", ""}, []string{"169.254.100.6/30", ""}, []string{"169.254.100.5", ""}},
+		{"ipv6 only", 2, guestAddrs{IP6: v6}, []string{"", "fd00:fc::9/126"}, []string{"", "fd00:fc::a/126"}, []string{"", "fd00:fc::9"}},
+		{"dual stack", 0, guestAddrs{IP: v4, IP6: v6}, []string{"169.254.100.1/30", "fd00:fc::1/126"}, []string{"169.254.100.2/30", "fd00:fc::2/126"}, []string{"169.254.100.1", "fd00:fc::1"}},
+	}
+	for _, c := range cases {
+		tap, guest := groupLink(c.slot, c.local)
+		ip, ip6 := tap.strings()
+		if ip != c.tap[0] || ip6 != c.tap[1] {
+			t.Errorf("%s: tap %s %s, want %v", c.name, ip, ip6, c.tap)
+		}
+		ip, ip6 = guest.strings()
+		if ip != c.guest[0] || ip6 != c.guest[1] {
+			t.Errorf("%s: guest %s %s, want %v", c.name, ip, ip6, c.guest)
+		}
+		var gw, gw6 string
+		if guest.Gateway != nil {
+			gw = guest.Gateway.String()
+		}
+		if guest.Gateway6 != nil {
+			gw6 = guest.Gateway6.String()
+		}
+		if gw != c.gateways[0] || gw6 != c.gateways[1] {
+			t.Errorf("%s: gateways %s %s, want %v", c.name, gw, gw6, c.gateways)
+		}
+	}
+}
+
+func TestGroupNetworkRuleset(t *testing.T) {
+	local := guestAddrs{IP: &net.IPNet{IP: net.ParseIP("172.26.64.10").To4(), Mask: net.CIDRMask(20, 32)}}
+	_, guest := groupLink(0, local)
+	g := &groupNetwork{Tap: "fc-1234", Link: "eth0", Ports: []int{8080}, local: local, guestAddrs: guest}
+	rules := g.ruleset()
+
+	for _, want := range []string{
+		`add rule inet fc-1234 postrouting oifname "eth0" ip saddr 169.254.100.2 masquerade`,
+		`add rule inet fc-1234 prerouting iifname "fc-1234" ip daddr 169.254.100.1 meta l4proto { tcp, udp } dnat ip to 127.0.0.1`,
+		`add rule inet fc-1234 prerouting iifname "eth0" ip daddr 172.26.64.10 meta l4proto { tcp, udp } th dport 8080 dnat ip to 169.254.100.2`,
+		`add rule inet fc-1234 output ip daddr { 127.0.0.1, 172.26.64.10 } meta l4proto { tcp, udp } th dport 8080 dnat ip to 169.254.100.2`,
+	} {
+		if !strings.Contains(rules, want+"\n") {
+			t.Errorf("missing rule %q in\n%s", want, rules)
+		}
+	}
+	// only the forwarded ports reach the guest, nothing redirects the
+	// whole namespace interface
+	if n := strings.Count(rules, `iifname "eth0"`); n != 1 {
+		t.Errorf("got %d rules on the namespace interface, want 1:\n%s", n, rules)
+	}
+	if strings.Contains(rules, "ip6") {
+		t.Errorf("ipv6 rules in an ipv4 namespace:\n%s", rules)
+	}
+}
+
+func TestGroupPorts(t *testing.T) {
+	cfg := &drivers.TaskConfig{Resources: &drivers.Resources{Ports: &structs.AllocatedPorts{
+		{Label: "http", Value: 25123, To: 8080},
+		{Label: "admin", Value: 25124},
+	}}}
+	ports, err := groupPorts(cfg, []string{"http", "admin"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ports) != 2 || ports[0] != 8080 || ports[1] != 25124 {
+		t.Errorf("got %v, want [8080 25124]", ports)
+	}
+	if _, err := groupPorts(cfg, []string{"grpc"}); err == nil {
+		t.Error("no error for an unknown label")
+	}
+}
+
+func TestGroupNetworkTeardown(t *testing.T) {
+	netns, err := testutils.NewNS()
+	if err != nil {
+		t.Skipf("can't create a network namespace: %v", err)
+	}
+	defer testutils.UnmountNS(netns)
+	defer netns.Close()
+
+	g := &groupNetwork{NetNS: netns.Path(), Tap: "fc00000001"}
+	err = netns.Do(func(ns.NetNS) error {
+		if err := createTap(g.Tap, nil); err != nil {
+			return err
+		}
+		tap, err := netlink.LinkByName(g.Tap)
+		if err != nil {
+			return err
+		}
+		tapAddrs, _ := groupLink(0, guestAddrs{IP: &net.IPNet{IP: net.IPv4(172, 26, 64, 2), Mask: net.CIDRMask(20, 32)}})
+		return netlink.AddrAdd(tap, &netlink.Addr{IPNet: tapAddrs.IP})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = g.teardown()
+	if _, lookErr := exec.LookPath("nft"); lookErr == nil && err != nil {
+		t.Errorf("teardown: %v", err)
+	}
+	err = netns.Do(func(ns.NetNS) error {
+		if _, err := netlink.LinkByName(g.Tap); err == nil {
+			t.Errorf("tap %s left in the namespace", g.Tap)
+		}
+		// the link address of the tap is free for the next micro-vm
+		addrs, err := netlink.AddrList(nil, netlink.FAMILY_V4)
+		if err != nil {
+			return err
+		}
+		for _, a := range addrs {
+			if groupLinkNet.Contains(a.IP) {
+				t.Errorf("link address %s left in the namespace", a.IPNet)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// nomad already removed the namespace
+	gone := &groupNetwork{NetNS: filepath.Join(t.TempDir(), "gone"), Tap: g.Tap}
+	if err := gone.teardown(); err != nil {
+		t.Errorf("teardown without namespace: %v", err)
+	}
+}
@@ -13,7 +13,6 @@
 package firevm
 
 import (
-	"context"
 	"fmt"
 	"os"
 	"strconv"
@@ -24,9 +23,7 @@ import (
 
 	"github.com/firecracker-microvm/firecracker-go-sdk"
 	hclog "github.com/hashicorp/go-hclog"
-	"github.com/hashicorp/nomad/client/lib/cpustats"
 	"github.com/hashicorp/nomad/plugins/drivers"
-	"github.com/shirou/gopsutil/process"
 )
 
 var (
@@ -47,28 +44,51 @@ type taskHandle struct {
 	startedAt       time.Time
 	completedAt     time.Time
 	exitResult      *drivers.ExitResult
-
-	cpuStatsSys   *cpustats.Tracker
-	cpuStatsUser  *cpustats.Tracker
-	cpuStatsTotal *cpustats.Tracker
+	taskDirs        []taskDirDrive
+	scratchDisks    []scratchDrive
+	persistentDisks []persistentDrive
+	diskLocks       []*os.File
+	cgroup          *vmCgroup
+	bridge          *bridgeNetwork
+	group           *groupNetwork
+	network         *vmNetwork
+	egress          *vmEgress
+	networkOnce     sync.Once
+	runDir          runtimeDir
+	vmmLog          *vmmLog
+	metrics         *vmMetrics
+	sampler         *vmSampler
 }
 
 func (h *taskHandle) TaskStatus() *drivers.TaskStatus {
 	h.stateLock.RLock()
 	defer h.stateLock.RUnlock()
 
+	attrs := map[string]string{
+		"Ip":     h.Info.Ip,
+		"Serial": h.Info.Serial,
+		"Pid":    h.Info.Pid,
+	}
+	if h.Info.Ip6 != "" {
+		attrs["Ip6"] = h.Info.Ip6
+	}
+	for _, p := range h.persistentDisks {
+		attrs["PersistentDisk."+p.Name] = fmt.Sprintf("%dMB", p.SizeMB)
+	}
+	if h.metrics != nil {
+		for k, v := range h.metrics.attributes() {
+			attrs[k] = v
+		}
+	}
+
 	return &drivers.TaskStatus{
-		ID:          h.taskConfig.ID,
-		Name:        h.taskConfig.Name,
-		State:       h.State,
-		StartedAt:   h.startedAt,
-		CompletedAt: h.completedAt,
-		ExitResult:  h.exitResult,
-		DriverAttributes: map[string]string{
-			"Ip":     h.Info.Ip,
-			"Serial": h.Info.Serial,
-			"Pid":    h.Info.Pid,
-		},
+		ID:               h.taskConfig.ID,
+		Name:             h.taskConfig.Name,
+		State:            h.State,
+		StartedAt:        h.startedAt,
+		CompletedAt:      h.completedAt,
+		ExitResult:       h.exitResult,
+		DriverAttributes: attrs,
 	}
 }
 
@@ -114,71 +134,27 @@ func (h *taskHandle) run() {
 			break
 		}
 	}
+
+	// copy back what the guest wrote to writable task dirs before reporting
+	// the exit, nomad may remove the alloc dir right after.
+	for _, t := range h.taskDirs {
+		if err := t.sync(); err != nil {
+			h.logger.Error("failed to sync task dir", "dir", t.Name, "error", err)
+		}
+	}
+
 	h.stateLock.Lock()
 	defer h.stateLock.Unlock()
 
 	h.State = drivers.TaskStateExited
 	h.exitResult.ExitCode = 0
 	h.exitResult.Signal = 0
-	h.completedAt = time.Now()
-}
-
-func (h *taskHandle) stats(ctx context.Context, statsChannel chan *drivers.TaskResourceUsage, interval time.Duration) {
-	defer close(statsChannel)
-	timer := time.NewTimer(0)
-	h.logger.Debug("Starting stats collection for ", h.taskConfig.ID)
-	for {
-		select {
-		case <-ctx.Done():
-			h.logger.Debug("Stopping stats collection for ", h.taskConfig.ID)
-			return
-		case <-timer.C:
-			timer.Reset(interval)
-		}
-
-		h.stateLock.Lock()
-		t := time.Now()
-
-		pid, err := strconv.Atoi(h.Info.Pid)
-		if err != nil {
-			h.logger.Error("unable to convert pid ", h.Info.Pid, " to int from ", h.taskConfig.ID)
-			continue
-		}
-
-		p, err := process.NewProcess(int32(pid))
-		if err != nil {
-			h.logger.Error("unable create new process ", h.Info.Pid, " from ", h.taskConfig.ID)
-			continue
-		}
-		ms := &drivers.MemoryStats{}
-		if memInfo, err := p.MemoryInfo(); err == nil {
-			ms.RSS = memInfo.RSS
-			ms.Swap = memInfo.Swap
-			ms.Measured = firecrackerMemStats
-		}
-
-		cs := &drivers.CpuStats{}
-		if cpuStats, err := p.Times(); err == nil {
-			cs.SystemMode = h.cpuStatsSys.Percent(cpuStats.System * float64(time.Second))
-			cs.UserMode = h.cpuStatsUser.Percent(cpuStats.User * float64(time.Second))
-			cs.Measured = firecrackerCPUStats
-
-			// calculate cpu usage percent
-			cs.Percent = h.cpuStatsTotal.Percent(cpuStats.Total() * float64(time.Second))
-		}
-		h.stateLock.Unlock()
-
-		// update uasge
-		usage := drivers.TaskResourceUsage{
-			ResourceUsage: &drivers.ResourceUsage{
-				CpuStats:    cs,
-				MemoryStats: ms,
-			},
-			Timestamp: t.UTC().UnixNano(),
-		}
-		// send stats to nomad
-		statsChannel <- &usage
+	if h.cgroup.oomKilled() {
+		h.exitResult.OOMKilled = true
+		h.exitResult.ExitCode = 128 + int(syscall.SIGKILL)
+		h.exitResult.Signal = int(syscall.SIGKILL)
 	}
+	h.completedAt = time.Now()
 }
 
 func keysToVal(line string) (string, uint64, error) {
@@ -217,9 +193,9 @@ func (h *taskHandle) Signal(sig string) error {
 }
 
 // shutdown shuts down the container, with `timeout` grace period
-// before shutdown vm
+// before shutdown vm. The vmm is signaled by pid, a recovered micro-vm is not
+// a child of the plugin.
 func (h *taskHandle) shutdown(timeout time.Duration) error {
 	time.Sleep(timeout)
-	h.MachineInstance.StopVMM()
-	return nil
+	return h.Signal("SIGTERM")
 }
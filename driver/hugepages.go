@@ -0,0 +1,74 @@
+/* Firecracker-task-driver is a task driver for Hashicorp's nomad that allows
+ * to create microvms using AWS Firecracker vmm
+ * Copyright (C) 2019  Carlos Neira cneirabustos@gmail.com
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ */
+
+package firevm
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	hugePagesNone = "None"
+	hugePages2M   = "2M"
+
+	hugePages2MDir = "/sys/kernel/mm/hugepages/hugepages-2048kB"
+	hugePage2MSize = 2
+)
+
+// hugePages2MCount returns the free and total number of 2M hugepages of the
+// host, dir is hugePages2MDir outside of tests.
+func hugePages2MCount(dir string) (int64, int64, error) {
+	free, err := readSysInt(filepath.Join(dir, "free_hugepages"))
+	if err != nil {
+		return 0, 0, err
+	}
+	total, err := readSysInt(filepath.Join(dir, "nr_hugepages"))
+	if err != nil {
+		return 0, 0, err
+	}
+	return free, total, nil
+}
+
+// checkHugePages validates the HugePages option and, when set, that the
+// host pool found in dir can back memMB of guest memory.
+func checkHugePages(dir, hugePages string, memMB int64) error {
+	switch hugePages {
+	case "", hugePagesNone:
+		return nil
+	case hugePages2M:
+	default:
+		return errInvalidHugePages
+	}
+
+	if memMB%hugePage2MSize != 0 {
+		return fmt.Errorf("guest memory (%d MB) must be a multiple of the 2M hugepage size", memMB)
+	}
+	free, _, err := hugePages2MCount(dir)
+	if err != nil {
+		return fmt.Errorf("Fail to read the free 2M hugepages: %v", err)
+	}
+	if need := memMB / hugePage2MSize; need > free {
+		return fmt.Errorf("hugepages pool exhausted: the guest needs %d 2M hugepages, %d are free", need, free)
+	}
+	return nil
+}
+
+func readSysInt(path string) (int64, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64)
+}
@@ -0,0 +1,57 @@
+/* Firecracker-task-driver is a task driver for Hashicorp's nomad that allows
+ * to create microvms using AWS Firecracker vmm
+ * Copyright (C) 2019  Carlos Neira cneirabustos@gmail.com
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ */
+
+package firevm
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckHugePages(t *testing.T) {
+	pool := t.TempDir()
+	os.WriteFile(filepath.Join(pool, "free_hugepages"), []byte("256\n"), 0644)
+	os.WriteFile(filepath.Join(pool, "nr_hugepages"), []byte("512\n"), 0644)
+	missing := filepath.Join(t.TempDir(), "hugepages-2048kB")
+
+	cases := []struct {
+		name      string
+		dir       string
+		hugePages string
+		memMB     int64
+		err       string
+	}{
+		{"unset", missing, "", 1024, ""},
+		{"none", missing, hugePagesNone, 1024, ""},
+		{"fits", pool, hugePages2M, 256, ""},
+		{"whole pool", pool, hugePages2M, 512, ""},
+		{"bad size", pool, "1G", 512, errInvalidHugePages.Error()},
+		{"odd memory", pool, hugePages2M, 513, "multiple of the 2M hugepage size"},
+		{"exhausted", pool, hugePages2M, 514, "the guest needs 257 2M hugepages, 256 are free"},
+		{"no 2M pool", missing, hugePages2M, 512, "Fail to read the free 2M hugepages"},
+	}
+	for _, c := range cases {
+		err := checkHugePages(c.dir, c.hugePages, c.memMB)
+		if c.err == "" && err != nil {
+			t.Errorf("%s: got error %v", c.name, err)
+		}
+		if c.err != "" && (err == nil || !strings.Contains(err.Error(), c.err)) {
+			t.Errorf("%s: got error %v, want %q", c.name, err, c.err)
+		}
+	}
+
+	free, total, err := hugePages2MCount(pool)
+	if err != nil || free != 256 || total != 512 {
+		t.Errorf("got %d free of %d, %v, want 256 free of 512", free, total, err)
+	}
+}
@@ -0,0 +1,223 @@
+/* Firecracker-task-driver is a task driver for Hashicorp's nomad that allows
+ * to create microvms using AWS Firecracker vmm
+ * Copyright (C) 2019  Carlos Neira cneirabustos@gmail.com
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ */
+
+package firevm
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// mib is the number of bytes in a MiB, disk sizes in the task config
+	// are expressed in MiB.
+	mib = 1024 * 1024
+)
+
+// runCmd runs an external tool and folds its combined output into the
+// returned error so failures are visible in the task events.
+func runCmd(name string, args ...string) error {
+	out, err := exec.Command(name, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s failed: %v: %s", name, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// createSparseFile creates (or truncates) path to sizeMB without allocating
+// any blocks on the host.
+func createSparseFile(path string, sizeMB int64) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Truncate(sizeMB * mib)
+}
+
+// mkfsExt4 formats image as ext4, optionally populating it with the
+// contents of srcDir.
+func mkfsExt4(image, label, srcDir string) error {
+	args := []string{"-q", "-F"}
+	if label != "" {
+		args = append(args, "-L", label)
+	}
+	if srcDir != "" {
+		args = append(args, "-d", srcDir)
+	}
+	return runCmd("mkfs.ext4", append(args, image)...)
+}
+
+// dirSize returns an estimate of the bytes needed to store dir in a
+// filesystem image, rounding every entry up to a 4k block.
+func dirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		size += 4096
+		if info.Mode().IsRegular() {
+			size += (info.Size() + 4095) &^ 4095
+		}
+		return nil
+	})
+	return size, err
+}
+
+// copyTree copies src into dst, hard linking regular files when possible.
+// Top level entries listed in skip are left out.
+func copyTree(src, dst string, skip map[string]bool) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		if skip[strings.SplitN(rel, string(filepath.Separator), 2)[0]] {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		target := filepath.Join(dst, rel)
+
+		switch {
+		case info.IsDir():
+			return os.MkdirAll(target, info.Mode().Perm())
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			os.Remove(target)
+			return os.Symlink(link, target)
+		case info.Mode().IsRegular():
+			os.Remove(target)
+			if err := os.Link(path, target); err == nil {
+				return nil
+			}
+			return copyFile(path, target, info.Mode().Perm())
+		}
+		// sockets, fifos and devices have no meaning inside the vm
+		return nil
+	})
+}
+
+// inRoot returns the path of rel inside root, rel can't go up. None of the
+// existing directories between root and the entry may be a symlink, a path
+// written by the guest never leads outside root.
+func inRoot(root, rel string) (string, error) {
+	rel = strings.TrimPrefix(filepath.Clean("/"+rel), "/")
+	if rel == "" {
+		return root, nil
+	}
+	parts := strings.Split(rel, "/")
+	cur := root
+	for _, part := range parts[:len(parts)-1] {
+		cur = filepath.Join(cur, part)
+		fi, err := os.Lstat(cur)
+		if os.IsNotExist(err) {
+			// the rest of the path is created by the caller
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			return "", fmt.Errorf("%s: %w", rel, errSymlinkInPath)
+		}
+		if !fi.IsDir() {
+			return "", fmt.Errorf("%s: %s is not a directory", rel, part)
+		}
+	}
+	return filepath.Join(root, rel), nil
+}
+
+// mkdirInRoot creates the directory rel inside root, refusing symlinks on
+// its way, including the directory itself.
+func mkdirInRoot(root, rel string, perm os.FileMode) (string, error) {
+	target, err := inRoot(root, rel)
+	if err != nil {
+		return "", err
+	}
+	if fi, err := os.Lstat(target); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+		return "", fmt.Errorf("%s: %w", rel, errSymlinkInPath)
+	}
+	return target, os.MkdirAll(target, perm)
+}
+
+// moveTree moves the contents of src into dst, replacing files that already
+// exist in dst. Both paths must be on the same filesystem. src is written by
+// the guest: its symlinks are dropped and nothing is written through a
+// symlink of dst.
+func moveTree(src, dst string, skip map[string]bool) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		if skip[strings.SplitN(rel, string(filepath.Separator), 2)[0]] {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() {
+			_, err := mkdirInRoot(dst, rel, info.Mode().Perm())
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			// symlinks, sockets, fifos and devices of the guest stay there
+			return nil
+		}
+		target, err := inRoot(dst, rel)
+		if err != nil {
+			return err
+		}
+		if fi, err := os.Lstat(target); err == nil && fi.IsDir() {
+			if err := os.RemoveAll(target); err != nil {
+				return err
+			}
+		}
+		return os.Rename(path, target)
+	})
+}
+
+func copyFile(src, dst string, perm os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,101 @@
+/* Firecracker-task-driver is a task driver for Hashicorp's nomad that allows
+ * to create microvms using AWS Firecracker vmm
+ * Copyright (C) 2019  Carlos Neira cneirabustos@gmail.com
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ */
+
+package firevm
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestInRoot(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+	if err := os.Mkdir(filepath.Join(root, "dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(root, "link")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "file"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		rel  string
+		want string
+		err  bool
+	}{
+		{rel: "a", want: filepath.Join(root, "a")},
+		{rel: "dir/a", want: filepath.Join(root, "dir/a")},
+		{rel: "new/dir/a", want: filepath.Join(root, "new/dir/a")},
+		{rel: "../../etc/passwd", want: filepath.Join(root, "etc/passwd")},
+		{rel: "/etc/passwd", want: filepath.Join(root, "etc/passwd")},
+		{rel: "link", want: filepath.Join(root, "link")},
+		{rel: "link/passwd", err: true},
+		{rel: "dir/../link/passwd", err: true},
+		{rel: "file/a", err: true},
+	}
+	for _, c := range cases {
+		got, err := inRoot(root, c.rel)
+		if c.err {
+			if err == nil {
+				t.Errorf("inRoot(%q) = %q, want an error", c.rel, got)
+			}
+			continue
+		}
+		if err != nil || got != c.want {
+			t.Errorf("inRoot(%q) = %q, %v, want %q", c.rel, got, err, c.want)
+		}
+	}
+}
+
+func TestMoveTreeSymlinks(t *testing.T) {
+	src := t.TempDir()
+	dst := t.TempDir()
+	outside := t.TempDir()
+
+	// the guest plants a symlink and writes through it
+	if err := os.Symlink(outside, filepath.Join(src, "x")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(src, "data"), []byte("ok"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := moveTree(src, dst, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Lstat(filepath.Join(dst, "x")); !os.IsNotExist(err) {
+		t.Errorf("guest symlink copied to the host: %v", err)
+	}
+	if b, err := os.ReadFile(filepath.Join(dst, "data")); err != nil || string(b) != "ok" {
+		t.Errorf("data = %q, %v", b, err)
+	}
+
+	// a symlink already on the host is not followed
+	if err := os.Symlink(outside, filepath.Join(dst, "y")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(src, "y"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(src, "y", "passwd"), []byte("evil"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := moveTree(src, dst, nil); !errors.Is(err, errSymlinkInPath) {
+		t.Errorf("moveTree through a host symlink = %v, want %v", err, errSymlinkInPath)
+	}
+	if _, err := os.Stat(filepath.Join(outside, "passwd")); !os.IsNotExist(err) {
+		t.Errorf("file written outside the host directory")
+	}
+}
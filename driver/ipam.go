@@ -0,0 +1,185 @@
+/* Firecracker-task-driver is a task driver for Hashicorp's nomad that allows
+ * to create microvms using AWS Firecracker vmm
+ * Copyright (C) 2019  Carlos Neira cneirabustos@gmail.com
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ */
+
+package firevm
+
+import (
+	"bytes"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// ipam hands out addresses of a subnet to tasks. Every lease is a file
+// named after the address holding the id of the task using it, so leases
+// survive plugin restarts; a lock file serializes concurrent starts.
+type ipam struct {
+	dir     string
+	subnet  *net.IPNet
+	gateway net.IP
+}
+
+func newIPAM(dir string, subnet *net.IPNet, gateway net.IP) *ipam {
+	// one directory per subnet, so changing the bridge subnet never
+	// reuses stale leases.
+	name := strings.NewReplacer("/", "_", ":", "_").Replace(subnet.String())
+	return &ipam{dir: filepath.Join(dir, name), subnet: subnet, gateway: gateway}
+}
+
+// allocate returns the address leased to id, leasing the lowest free
+// address of the subnet when it has none yet.
+func (i *ipam) allocate(id string) (net.IP, error) {
+	unlock, err := i.lock()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	if ip, err := i.lookup(id); err != nil || ip != nil {
+		return ip, err
+	}
+
+	first, last := addressRange(i.subnet)
+	for ip := first; bytes.Compare(ip, last) <= 0; ip = nextIP(ip) {
+		if ip.Equal(i.gateway) {
+			continue
+		}
+		f, err := os.OpenFile(filepath.Join(i.dir, ip.String()), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if os.IsExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		_, err = f.WriteString(id)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(f.Name())
+			return nil, err
+		}
+		return ip, nil
+	}
+	return nil, fmt.Errorf("no address left in %s", i.subnet)
+}
+
+// release frees the addresses leased to id.
+func (i *ipam) release(id string) error {
+	unlock, err := i.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	leases, err := i.leases()
+	if err != nil {
+		return err
+	}
+	for ip, owner := range leases {
+		if owner == id {
+			if err := os.Remove(filepath.Join(i.dir, ip)); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (i *ipam) lookup(id string) (net.IP, error) {
+	leases, err := i.leases()
+	if err != nil {
+		return nil, err
+	}
+	for ip, owner := range leases {
+		if owner == id {
+			return net.ParseIP(ip), nil
+		}
+	}
+	return nil, nil
+}
+
+// leases maps every leased address to the task holding it.
+func (i *ipam) leases() (map[string]string, error) {
+	entries, err := os.ReadDir(i.dir)
+	if err != nil {
+		return nil, err
+	}
+	leases := map[string]string{}
+	for _, e := range entries {
+		if net.ParseIP(e.Name()) == nil {
+			continue
+		}
+		owner, err := os.ReadFile(filepath.Join(i.dir, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		leases[e.Name()] = strings.TrimSpace(string(owner))
+	}
+	return leases, nil
+}
+
+func (i *ipam) lock() (func(), error) {
+	if err := os.MkdirAll(i.dir, 0700); err != nil {
+		return nil, fmt.Errorf("Fail to create ipam directory: %v", err)
+	}
+	f, err := os.OpenFile(filepath.Join(i.dir, "lock"), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("Fail to lock ipam directory: %v", err)
+	}
+	return func() { f.Close() }, nil
+}
+
+// addressRange returns the first and last host addresses of the subnet,
+// leaving out the network and broadcast addresses of ipv4 subnets.
+func addressRange(subnet *net.IPNet) (net.IP, net.IP) {
+	first := nextIP(subnet.IP.Mask(subnet.Mask))
+	last := make(net.IP, len(first))
+	for i := range last {
+		last[i] = subnet.IP.Mask(subnet.Mask)[i] | ^subnet.Mask[i]
+	}
+	if subnet.IP.To4() != nil {
+		last = prevIP(last)
+	}
+	return first, last
+}
+
+func nextIP(ip net.IP) net.IP {
+	return addIP(ip, 1)
+}
+
+func prevIP(ip net.IP) net.IP {
+	return addIP(ip, -1)
+}
+
+func addIP(ip net.IP, n int64) net.IP {
+	size := len(ip)
+	if v4 := ip.To4(); v4 != nil {
+		ip, size = v4, net.IPv4len
+	}
+	v := new(big.Int).SetBytes(ip)
+	v.Add(v, big.NewInt(n))
+	b := v.Bytes()
+	if len(b) > size {
+		b = b[len(b)-size:]
+	}
+	out := make(net.IP, size)
+	copy(out[size-len(b):], b)
+	return out
+}
@@ -0,0 +1,96 @@
+/* Firecracker-task-driver is a task driver for Hashicorp's nomad that allows
+ * to create microvms using AWS Firecracker vmm
+ * Copyright (C) 2019  Carlos Neira cneirabustos@gmail.com
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ */
+
+package firevm
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestIPAMAllocate(t *testing.T) {
+	_, subnet, _ := net.ParseCIDR("10.0.0.0/29")
+	i := newIPAM(t.TempDir(), subnet, net.ParseIP("10.0.0.1"))
+
+	cases := []struct {
+		id string
+		ip string
+	}{
+		{"a", "10.0.0.2"},
+		{"b", "10.0.0.3"},
+		// a task asking again keeps its lease
+		{"a", "10.0.0.2"},
+		{"c", "10.0.0.4"},
+		{"d", "10.0.0.5"},
+		{"e", "10.0.0.6"},
+	}
+	for _, c := range cases {
+		ip, err := i.allocate(c.id)
+		if err != nil {
+			t.Fatalf("%s: %v", c.id, err)
+		}
+		if ip.String() != c.ip {
+			t.Errorf("%s: got %s, want %s", c.id, ip, c.ip)
+		}
+	}
+	if ip, err := i.allocate("f"); err == nil {
+		t.Errorf("got %s from a full subnet", ip)
+	}
+
+	if err := i.release("b"); err != nil {
+		t.Fatal(err)
+	}
+	if ip, err := i.allocate("f"); err != nil || ip.String() != "10.0.0.3" {
+		t.Errorf("got %s, %v after release, want 10.0.0.3", ip, err)
+	}
+	// releasing an unknown task is a no-op
+	if err := i.release("unknown"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestIPAMLeasesSurviveRestart(t *testing.T) {
+	dir := t.TempDir()
+	_, subnet, _ := net.ParseCIDR("10.0.0.0/24")
+	gateway := net.ParseIP("10.0.0.1")
+	if _, err := newIPAM(dir, subnet, gateway).allocate("a"); err != nil {
+		t.Fatal(err)
+	}
+
+	i := newIPAM(dir, subnet, gateway)
+	if ip, err := i.allocate("b"); err != nil || ip.String() != "10.0.0.3" {
+		t.Errorf("got %s, %v, want 10.0.0.3", ip, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "10.0.0.0_24", "10.0.0.2")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestAddressRange(t *testing.T) {
+	cases := []struct {
+		subnet      string
+		first, last string
+	}{
+		{"10.0.0.0/24", "10.0.0.1", "10.0.0.254"},
+		{"172.26.64.0/20", "172.26.64.1", "172.26.79.254"},
+		{"10.0.0.4/30", "10.0.0.5", "10.0.0.6"},
+		{"fd00::/120", "fd00::1", "fd00::ff"},
+	}
+	for _, c := range cases {
+		_, subnet, _ := net.ParseCIDR(c.subnet)
+		first, last := addressRange(subnet)
+		if first.String() != c.first || last.String() != c.last {
+			t.Errorf("%s: got %s - %s, want %s - %s", c.subnet, first, last, c.first, c.last)
+		}
+	}
+}
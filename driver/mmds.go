@@ -0,0 +1,218 @@
+/* Firecracker-task-driver is a task driver for Hashicorp's nomad that allows
+ * to create microvms using AWS Firecracker vmm
+ * Copyright (C) 2019  Carlos Neira cneirabustos@gmail.com
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ */
+
+package firevm
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	firecracker "github.com/firecracker-microvm/firecracker-go-sdk"
+	models "github.com/firecracker-microvm/firecracker-go-sdk/client/models"
+)
+
+const (
+	// guestMetadataKey is the MMDS key holding the metadata the driver
+	// publishes for the guest.
+	guestMetadataKey = "nomad"
+
+	// mountsKernelArg carries the mount hints on the kernel command line
+	// as device:path:mode entries separated by commas.
+	mountsKernelArg = "nomad.mounts"
+
+	// ip6KernelArg prefixes the ipv6 address of each guest interface
+	ip6KernelArg = "nomad.ip6"
+)
+
+// guestMetadata is published in MMDS under the "nomad" key so guests can
+// configure themselves from what nomad handed to the task.
+type guestMetadata struct {
+	Mounts            []mountHint      `json:"mounts,omitempty"`
+	NetworkInterfaces []guestInterface `json:"network_interfaces,omitempty"`
+	DNS               *guestDNS        `json:"dns,omitempty"`
+	ExtraHosts        []extraHost      `json:"extra_hosts,omitempty"`
+}
+
+// mountHint tells the guest where a drive is expected to be mounted.
+type mountHint struct {
+	DriveID  string `json:"drive_id"`
+	Device   string `json:"device"`
+	Path     string `json:"path"`
+	ReadOnly bool   `json:"read_only"`
+}
+
+// mountHints returns a hint for every drive the task expects at a given path.
+// Firecracker always exposes the root drive as vda, the rest follow in the
+// order they are attached.
+func (opts *options) mountHints(drives []models.Drive) []mountHint {
+	paths := map[string]string{}
+	for _, t := range opts.FcTaskDirDrives {
+		paths[t.ID] = t.MountPath
+	}
+	for _, v := range opts.FcVolumeDrives {
+		paths[v.ID] = v.TaskPath
+	}
+
+	var hints []mountHint
+	n := 1
+	for _, d := range drives {
+		if firecracker.BoolValue(d.IsRootDevice) {
+			continue
+		}
+		id := firecracker.StringValue(d.DriveID)
+		if path, ok := paths[id]; ok {
+			hints = append(hints, mountHint{
+				DriveID:  id,
+				Device:   guestBlockDevice(n),
+				Path:     path,
+				ReadOnly: firecracker.BoolValue(d.IsReadOnly),
+			})
+		}
+		n++
+	}
+	return hints
+}
+
+// guestInterface describes a network_interface block to the guest, in the
+// order the interfaces are attached.
+type guestInterface struct {
+	Name     string `json:"name"`
+	Mac      string `json:"mac"`
+	MTU      int    `json:"mtu,omitempty"`
+	Address  string `json:"address,omitempty"`
+	Gateway  string `json:"gateway,omitempty"`
+	Address6 string `json:"address6,omitempty"`
+	Gateway6 string `json:"gateway6,omitempty"`
+}
+
+// guestNetwork returns the interfaces described to the guest, a Nic is a
+// single interface.
+func (opts *options) guestNetwork(NICs []firecracker.NetworkInterface) []netInterface {
+	if len(opts.FcInterfaces) > 0 {
+		return opts.FcInterfaces
+	}
+	if len(opts.FcNicConfig.Ip) == 0 {
+		return nil
+	}
+	// already validated by getNetwork
+	addrs, _ := opts.FcNicConfig.addrs()
+	return []netInterface{{
+		Name:       "eth0",
+		Tap:        opts.FcNicConfig.Interface,
+		Mac:        NICs[0].StaticConfiguration.MacAddress,
+		guestAddrs: addrs,
+	}}
+}
+
+func guestInterfaces(ifaces []netInterface) []guestInterface {
+	var guest []guestInterface
+	for _, iface := range ifaces {
+		g := guestInterface{
+			Name: iface.Name,
+			Mac:  iface.Mac,
+			MTU:  iface.MTU,
+		}
+		g.Address, g.Address6 = iface.strings()
+		if iface.Gateway != nil {
+			g.Gateway = iface.Gateway.String()
+		}
+		if iface.Gateway6 != nil {
+			g.Gateway6 = iface.Gateway6.String()
+		}
+		guest = append(guest, g)
+	}
+	return guest
+}
+
+// ipKernelArg configures the first interface with an ipv4 address and the
+// nameservers through the kernel ip= argument, unless the task sets its own.
+// The other interfaces are left to the guest, from MMDS.
+func ipKernelArg(cmdline string, ifaces []netInterface, nameservers []string) string {
+	if strings.Contains(" "+cmdline, " ip=") {
+		return ""
+	}
+	for _, iface := range ifaces {
+		if iface.IP == nil {
+			continue
+		}
+		mask := iface.IP.Mask
+		if len(mask) == net.IPv6len {
+			mask = mask[12:]
+		}
+		gateway := ""
+		if iface.Gateway != nil {
+			gateway = iface.Gateway.String()
+		}
+		var dns [2]string
+		copy(dns[:], nameservers)
+		return fmt.Sprintf(" ip=%s::%s:%s::%s:off:%s:%s",
+			iface.IP.IP, gateway, net.IP(mask), iface.Name, dns[0], dns[1])
+	}
+	return ""
+}
+
+// ip6KernelArgs passes the ipv6 addresses the kernel ip= argument can't
+// carry, as nomad.ip6.<interface>=<address>[,<gateway>], so guests without
+// ipv4 don't depend on MMDS to configure them.
+func ip6KernelArgs(ifaces []netInterface) string {
+	var args string
+	for _, iface := range ifaces {
+		if iface.IP6 == nil {
+			continue
+		}
+		args += fmt.Sprintf(" %s.%s=%s", ip6KernelArg, iface.Name, iface.IP6)
+		if iface.Gateway6 != nil {
+			args += "," + iface.Gateway6.String()
+		}
+	}
+	return args
+}
+
+// mountsKernelArgs renders the hints for the kernel command line, paths that
+// can't be expressed there are only published through MMDS.
+func mountsKernelArgs(hints []mountHint) string {
+	var entries []string
+	for _, h := range hints {
+		if strings.ContainsAny(h.Path, " \t,:") {
+			continue
+		}
+		mode := "rw"
+		if h.ReadOnly {
+			mode = "ro"
+		}
+		entries = append(entries, fmt.Sprintf("%s:%s:%s", h.Device, h.Path, mode))
+	}
+	if len(entries) == 0 {
+		return ""
+	}
+	return " " + mountsKernelArg + "=" + strings.Join(entries, ",")
+}
+
+// guestBlockDevice returns the name the guest kernel gives to the n-th
+// virtio block device, counting from zero.
+func guestBlockDevice(n int) string {
+	name := ""
+	for n++; n > 0; n = (n - 1) / 26 {
+		name = string(rune('a'+(n-1)%26)) + name
+	}
+	return "/dev/vd" + name
+}
+
+// setGuestMetadata merges md into the metadata given in the task config.
+func (opts *options) setGuestMetadata(md guestMetadata) {
+	switch m := opts.validMetadata.(type) {
+	case nil:
+		opts.validMetadata = map[string]interface{}{guestMetadataKey: md}
+	case map[string]interface{}:
+		m[guestMetadataKey] = md
+	}
+}
@@ -0,0 +1,470 @@
+/* Firecracker-task-driver is a task driver for Hashicorp's nomad that allows
+ * to create microvms using AWS Firecracker vmm
+ * Copyright (C) 2019  Carlos Neira cneirabustos@gmail.com
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ */
+
+package firevm
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"time"
+
+	metrics "github.com/armon/go-metrics"
+	"github.com/containernetworking/cni/libcni"
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/plugins/pkg/ns"
+	firecracker "github.com/firecracker-microvm/firecracker-go-sdk"
+	models "github.com/firecracker-microvm/firecracker-go-sdk/client/models"
+	"github.com/hashicorp/nomad/plugins/drivers"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// network_interface types
+	netIfaceCNI    = "cni"
+	netIfaceTap    = "tap"
+	netIfaceBridge = "bridge"
+
+	// same locations as the sdk uses for the Network option
+	cniBinDir   = "/opt/cni/bin"
+	cniConfDir  = "/etc/cni/conf.d"
+	cniCacheDir = "/var/lib/cni"
+	netNSDir    = "/var/run/netns"
+)
+
+// vmNetwork holds the interfaces of a micro-vm declared with
+// network_interface blocks. CNI interfaces live in a network namespace
+// created for the micro-vm, firecracker runs in it.
+type vmNetwork struct {
+	NetNS      string
+	Interfaces []netInterface
+}
+
+// netInterface is a guest interface and the host tap backing it.
+type netInterface struct {
+	Config NetworkInterface
+	Index  int
+
+	// Name is the interface inside the guest, eth0 for the first block
+	Name string
+	// IfName is the interface CNI was asked to create in the namespace
+	IfName string
+	Tap    string
+	Mac    string
+	MTU    int
+	DNS    guestDNS
+	// CNI is set for cni interfaces from the moment ADD is tried
+	CNI *cniAttachment
+
+	guestAddrs
+}
+
+// validate checks the block on its own, conflicts between blocks are
+// checked by setupNetworkInterfaces.
+func (n NetworkInterface) validate() error {
+	switch n.Type {
+	case netIfaceCNI:
+		if n.Network == "" {
+			return fmt.Errorf("cni network interface needs a network")
+		}
+		if n.Mac != "" || n.MacFromAlloc || n.MTU != 0 || n.IP != "" || n.Gateway != "" || n.IP6 != "" || n.Gateway6 != "" {
+			return errInvalidCNIInterface
+		}
+	case netIfaceTap:
+		if n.Tap == "" {
+			return fmt.Errorf("tap network interface needs a tap")
+		}
+	case netIfaceBridge:
+		if n.IP != "" || n.Gateway != "" || n.IP6 != "" || n.Gateway6 != "" {
+			return fmt.Errorf("the address of a bridge network interface is leased from the bridge subnet")
+		}
+	default:
+		return fmt.Errorf("invalid network interface type %q, must be cni, tap or bridge", n.Type)
+	}
+	if n.Type != netIfaceCNI && len(n.Args) > 0 {
+		return fmt.Errorf("args are only used by cni network interfaces")
+	}
+	if n.Mac != "" {
+		if n.MacFromAlloc {
+			return fmt.Errorf("mac and mac_from_alloc cannot be used together")
+		}
+		if _, err := net.ParseMAC(n.Mac); err != nil {
+			return fmt.Errorf("Fail to parse mac address: %v", err)
+		}
+	}
+	if n.MTU < 0 || n.RxBandwidth < 0 || n.TxBandwidth < 0 || n.RxOps < 0 || n.TxOps < 0 {
+		return fmt.Errorf("mtu and rate limits of a network interface must not be negative")
+	}
+	return nil
+}
+
+// allocMac derives the mac of the i-th interface from the allocation so it
+// stays the same when the task restarts.
+func allocMac(cfg *drivers.TaskConfig, i int) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s/%s/%d", cfg.AllocID, cfg.Name, i)))
+	// locally administered unicast address
+	sum[0] = sum[0]&^1 | 2
+	return net.HardwareAddr(sum[:6]).String()
+}
+
+// setupNetworkInterfaces creates the host side of every network_interface
+// block, in order. CNI interfaces can't be mixed with the others as they
+// live in their own network namespace.
+func (d *Driver) setupNetworkInterfaces(ctx context.Context, cfg *drivers.TaskConfig, blocks []NetworkInterface) (*vmNetwork, error) {
+	cni := 0
+	for _, b := range blocks {
+		if err := b.validate(); err != nil {
+			return nil, err
+		}
+		if b.Type == netIfaceCNI {
+			cni++
+		}
+	}
+	if cni > 0 && cni < len(blocks) {
+		return nil, errMixedNetworkInterfaces
+	}
+
+	n := &vmNetwork{}
+	if cni > 0 {
+		n.NetNS = filepath.Join(netNSDir, tapName(cfg))
+		if err := createNetNS(n.NetNS); err != nil {
+			return nil, err
+		}
+	}
+
+	for i, b := range blocks {
+		iface := netInterface{
+			Config: b,
+			Index:  i,
+			Name:   fmt.Sprintf("eth%d", i),
+			Mac:    b.Mac,
+			MTU:    b.MTU,
+		}
+		if b.MacFromAlloc {
+			iface.Mac = allocMac(cfg, i)
+		}
+
+		var err error
+		switch b.Type {
+		case netIfaceCNI:
+			err = addCNIInterface(ctx, cfg, n.NetNS, i, &iface)
+		case netIfaceTap:
+			err = setupTapInterface(&iface)
+		case netIfaceBridge:
+			err = d.setupBridgeInterface(cfg, i, &iface)
+		}
+		if err == nil && iface.Mac == "" {
+			iface.Mac, err = genmacaddr()
+		}
+		// kept on failure too so the teardown covers a partial setup
+		n.Interfaces = append(n.Interfaces, iface)
+		if err != nil {
+			d.teardownNetworkInterfaces(cfg, n)
+			return nil, fmt.Errorf("Fail to set up network interface %d: %v", i, err)
+		}
+	}
+	return n, nil
+}
+
+// teardownNetworkInterfaces releases what setupNetworkInterfaces created,
+// it carries on after an error and returns the first one. It only needs the
+// network, which is kept in the task state, so it also works on recovery.
+func (d *Driver) teardownNetworkInterfaces(cfg *drivers.TaskConfig, n *vmNetwork) error {
+	var first error
+	for i := len(n.Interfaces) - 1; i >= 0; i-- {
+		iface := n.Interfaces[i]
+		var err error
+		switch iface.Config.Type {
+		case netIfaceCNI:
+			err = delCNIInterface(context.Background(), n.NetNS, iface)
+		case netIfaceBridge:
+			err = d.detachFromBridge(bridgeOwner(cfg, iface.Index), iface.Tap)
+		}
+		if err != nil && first == nil {
+			first = err
+		}
+	}
+	if n.NetNS != "" {
+		if err := removeNetNS(n.NetNS); err != nil && first == nil {
+			first = err
+		}
+		// the cached results are kept until every DEL went through, a
+		// later teardown still needs them
+		if first == nil {
+			os.RemoveAll(cniTaskCacheDir(cfg))
+		}
+	}
+	return first
+}
+
+// primary returns the first interface with an address, it is the one
+// advertised to nomad.
+func (n *vmNetwork) primary() *netInterface {
+	for i := range n.Interfaces {
+		if !n.Interfaces[i].empty() {
+			return &n.Interfaces[i]
+		}
+	}
+	return nil
+}
+
+func setupTapInterface(iface *netInterface) error {
+	c := iface.Config
+	addrs, err := parseStaticAddrs(c.IP, c.Gateway, c.IP6, c.Gateway6)
+	if err != nil {
+		return err
+	}
+	iface.Tap = c.Tap
+	iface.guestAddrs = addrs
+	return setTapMTU(iface.Tap, iface.MTU)
+}
+
+// bridgeOwner is the lease owner of the i-th interface on the bridge.
+func bridgeOwner(cfg *drivers.TaskConfig, i int) string {
+	return fmt.Sprintf("%s/%d", cfg.ID, i)
+}
+
+func (d *Driver) setupBridgeInterface(cfg *drivers.TaskConfig, i int, iface *netInterface) error {
+	b, err := d.attachToBridge(bridgeOwner(cfg, i), fmt.Sprintf("%s-%d", tapName(cfg), i))
+	if err != nil {
+		return err
+	}
+	iface.Tap = b.Tap
+	iface.IP = &b.IP
+	iface.Gateway = b.Gateway
+	return setTapMTU(iface.Tap, iface.MTU)
+}
+
+func setTapMTU(tap string, mtu int) error {
+	if mtu == 0 {
+		return nil
+	}
+	link, err := netlink.LinkByName(tap)
+	if err != nil {
+		return fmt.Errorf("Fail to look up tap device %s: %v", tap, err)
+	}
+	if err := netlink.LinkSetMTU(link, mtu); err != nil {
+		return fmt.Errorf("Fail to set the mtu of %s: %v", tap, err)
+	}
+	return nil
+}
+
+// cniRuntimeConf is the runtime config of the i-th interface. Every network
+// gets its own interface and tap in the namespace of the micro-vm.
+func cniRuntimeConf(cfg *drivers.TaskConfig, netns string, i int, args map[string]string) *libcni.RuntimeConf {
+	rt := &libcni.RuntimeConf{
+		ContainerID: tapName(cfg),
+		NetNS:       netns,
+		IfName:      fmt.Sprintf("eth%d", i),
+		Args: [][2]string{
+			{"IgnoreUnknown", "1"},
+			{"TC_REDIRECT_TAP_NAME", fmt.Sprintf("tap%d", i)},
+		},
+	}
+	keys := make([]string, 0, len(args))
+	for k := range args {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		rt.Args = append(rt.Args, [2]string{k, args[k]})
+	}
+	return rt
+}
+
+// cniTaskCacheDir is where libcni caches the results of the task, apart
+// from other tasks so it can be removed with the network.
+func cniTaskCacheDir(cfg *drivers.TaskConfig) string {
+	return filepath.Join(cniCacheDir, tapName(cfg))
+}
+
+// addCNIInterface runs the network of the i-th interface and reads the tap,
+// mac and addresses of the guest from its result.
+func addCNIInterface(ctx context.Context, cfg *drivers.TaskConfig, netns string, i int, iface *netInterface) error {
+	list, err := libcni.LoadConfList(cniConfDir, iface.Config.Network)
+	if err != nil {
+		return fmt.Errorf("Fail to load cni network %s: %v", iface.Config.Network, err)
+	}
+	cni := libcni.NewCNIConfigWithCacheDir([]string{cniBinDir}, cniTaskCacheDir(cfg), nil)
+	rt := cniRuntimeConf(cfg, netns, i, iface.Config.Args)
+	iface.IfName = rt.IfName
+
+	// like the sdk, clear what a previous run of the task may have left
+	if err := cni.DelNetworkList(ctx, list, rt); err != nil {
+		return fmt.Errorf("Fail to clean up cni network %s: %v", iface.Config.Network, err)
+	}
+	// set before ADD, a failed ADD may have set up part of the network
+	iface.CNI = newCNIAttachment(list, rt, cniTaskCacheDir(cfg))
+	start := time.Now()
+	result, err := cni.AddNetworkList(ctx, list, rt)
+	metrics.MeasureSinceWithLabels([]string{"firecracker", "cni", "setup_time"}, start,
+		[]metrics.Label{{Name: "network", Value: list.Name}})
+	if err != nil {
+		return fmt.Errorf("Fail to add cni network %s: %v", iface.Config.Network, err)
+	}
+	if iface.CNI.Result, err = json.Marshal(result); err != nil {
+		return fmt.Errorf("Fail to encode the cni result of %s: %v", iface.Config.Network, err)
+	}
+
+	if err := readCNIResult(result, rt.ContainerID, iface); err != nil {
+		return fmt.Errorf("Fail to read the cni result of %s: %v", iface.Config.Network, err)
+	}
+	return ns.WithNetNSPath(netns, func(ns.NetNS) error {
+		tap, err := netlink.LinkByName(iface.Tap)
+		if err != nil {
+			return fmt.Errorf("Fail to look up tap device %s: %v", iface.Tap, err)
+		}
+		iface.MTU = tap.Attrs().MTU
+		return nil
+	})
+}
+
+// readCNIResult fills iface from the interfaces a plugin like tc-redirect-tap
+// reports: one in the sandbox of the micro-vm with the guest mac and
+// addresses, and the tap of the same name in the namespace. Unlike the sdk it
+// keeps an address of each family.
+func readCNIResult(result types.Result, containerID string, iface *netInterface) error {
+	res, err := current.NewResultFromResult(result)
+	if err != nil {
+		return err
+	}
+	vm := -1
+	for i, itf := range res.Interfaces {
+		if itf.Sandbox == containerID {
+			vm = i
+		}
+	}
+	if vm < 0 {
+		return fmt.Errorf("no interface for the micro-vm, the network has to end with a plugin like tc-redirect-tap")
+	}
+	for i, itf := range res.Interfaces {
+		if i != vm && itf.Name == res.Interfaces[vm].Name {
+			iface.Tap = itf.Name
+		}
+	}
+	if iface.Tap == "" {
+		return fmt.Errorf("no tap device for %s", res.Interfaces[vm].Name)
+	}
+	iface.Mac = res.Interfaces[vm].Mac
+
+	for _, ipc := range res.IPs {
+		if ipc.Interface == nil || *ipc.Interface != vm {
+			continue
+		}
+		v4 := ipc.Address.IP.To4() != nil
+		if (v4 && iface.IP == nil) || (!v4 && iface.IP6 == nil) {
+			iface.add(ipc.Address, ipc.Gateway)
+		}
+	}
+	iface.DNS = guestDNS{
+		Servers:  res.DNS.Nameservers,
+		Searches: res.DNS.Search,
+		Options:  res.DNS.Options,
+	}
+	return nil
+}
+
+func delCNIInterface(ctx context.Context, netns string, iface netInterface) error {
+	if iface.CNI == nil {
+		// the config failed to load, ADD never ran
+		return nil
+	}
+	return iface.CNI.del(ctx, netns)
+}
+
+// createNetNS creates a network namespace bound to path, an existing one is
+// reused.
+func createNetNS(path string) error {
+	if netns, err := ns.GetNS(path); err == nil {
+		return netns.Close()
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_RDONLY|os.O_CREATE, 0444)
+	if err != nil {
+		return fmt.Errorf("Fail to create network namespace %s: %v", path, err)
+	}
+	f.Close()
+
+	errc := make(chan error, 1)
+	go func() {
+		// the thread is never unlocked, it exits with the goroutine instead
+		// of going back to the pool in the new namespace
+		runtime.LockOSThread()
+		if err := unix.Unshare(unix.CLONE_NEWNET); err != nil {
+			errc <- err
+			return
+		}
+		self := fmt.Sprintf("/proc/%d/task/%d/ns/net", os.Getpid(), unix.Gettid())
+		errc <- unix.Mount(self, path, "none", unix.MS_BIND, "")
+	}()
+	if err := <-errc; err != nil {
+		os.Remove(path)
+		return fmt.Errorf("Fail to create network namespace %s: %v", path, err)
+	}
+	return nil
+}
+
+func removeNetNS(path string) error {
+	if err := unix.Unmount(path, unix.MNT_DETACH); err != nil && err != unix.EINVAL && err != unix.ENOENT {
+		return fmt.Errorf("Fail to unmount network namespace %s: %v", path, err)
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// firecrackerInterface is the sdk config of the interface, the guest
+// address is handed over by the driver so the sdk doesn't limit the
+// micro-vm to a single interface.
+func (iface netInterface) firecrackerInterface() firecracker.NetworkInterface {
+	c := iface.Config
+	return firecracker.NetworkInterface{
+		StaticConfiguration: &firecracker.StaticNetworkConfiguration{
+			MacAddress:  iface.Mac,
+			HostDevName: iface.Tap,
+		},
+		AllowMMDS:      c.AllowMMDS,
+		InRateLimiter:  rateLimiter(c.RxBandwidth, c.RxOps),
+		OutRateLimiter: rateLimiter(c.TxBandwidth, c.TxOps),
+	}
+}
+
+// rateLimiter limits to bandwidth bytes and ops operations per second, zero
+// leaves them unlimited.
+func rateLimiter(bandwidth, ops int64) *models.RateLimiter {
+	if bandwidth == 0 && ops == 0 {
+		return nil
+	}
+	bucket := func(size int64) *models.TokenBucket {
+		if size == 0 {
+			return nil
+		}
+		return &models.TokenBucket{
+			Size:       firecracker.Int64(size),
+			RefillTime: firecracker.Int64(1000),
+		}
+	}
+	return &models.RateLimiter{
+		Bandwidth: bucket(bandwidth),
+		Ops:       bucket(ops),
+	}
+}
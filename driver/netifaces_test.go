@@ -0,0 +1,193 @@
+/* Firecracker-task-driver is a task driver for Hashicorp's nomad that allows
+ * to create microvms using AWS Firecracker vmm
+ * Copyright (C) 2019  Carlos Neira cneirabustos@gmail.com
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ */
+
+package firevm
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	current "github.com/containernetworking/cni/pkg/types/100"
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+func TestNetworkInterfaceValidate(t *testing.T) {
+	cases := []struct {
+		name  string
+		iface NetworkInterface
+		err   error
+		ok    bool
+	}{
+		{"cni", NetworkInterface{Type: "cni", Network: "default", Args: map[string]string{"IgnoreUnknown": "1"}}, nil, true},
+		{"tap", NetworkInterface{Type: "tap", Tap: "tap0", IP: "10.0.0.2/24", Gateway: "10.0.0.1", MacFromAlloc: true}, nil, true},
+		{"bridge", NetworkInterface{Type: "bridge", Mac: "02:fc:00:00:00:01", MTU: 9000}, nil, true},
+		{"unknown type", NetworkInterface{Type: "macvtap"}, nil, false},
+		{"cni without network", NetworkInterface{Type: "cni"}, nil, false},
+		{"cni with mac", NetworkInterface{Type: "cni", Network: "default", Mac: "02:fc:00:00:00:01"}, errInvalidCNIInterface, false},
+		{"cni with address", NetworkInterface{Type: "cni", Network: "default", IP6: "fd00::2/64"}, errInvalidCNIInterface, false},
+		{"tap without tap", NetworkInterface{Type: "tap"}, nil, false},
+		{"bridge with address", NetworkInterface{Type: "bridge", IP: "10.0.0.2/24"}, nil, false},
+		{"args outside cni", NetworkInterface{Type: "tap", Tap: "tap0", Args: map[string]string{"a": "b"}}, nil, false},
+		{"mac and mac_from_alloc", NetworkInterface{Type: "tap", Tap: "tap0", Mac: "02:fc:00:00:00:01", MacFromAlloc: true}, nil, false},
+		{"bad mac", NetworkInterface{Type: "tap", Tap: "tap0", Mac: "02:fc:00"}, nil, false},
+		{"negative rate limit", NetworkInterface{Type: "tap", Tap: "tap0", RxOps: -1}, nil, false},
+	}
+	for _, c := range cases {
+		err := c.iface.validate()
+		if (err == nil) != c.ok || (c.err != nil && err != c.err) {
+			t.Errorf("%s: got error %v, want ok=%v", c.name, err, c.ok)
+		}
+	}
+}
+
+func TestAllocMac(t *testing.T) {
+	cfg := &drivers.TaskConfig{AllocID: "alloc-1", Name: "web"}
+	mac := allocMac(cfg, 0)
+	if allocMac(cfg, 0) != mac {
+		t.Errorf("mac of the same interface changed")
+	}
+	hw, err := net.ParseMAC(mac)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// locally administered unicast address
+	if hw[0]&1 != 0 || hw[0]&2 == 0 {
+		t.Errorf("%s is not a locally administered unicast address", mac)
+	}
+
+	others := []string{
+		allocMac(cfg, 1),
+		allocMac(&drivers.TaskConfig{AllocID: "alloc-2", Name: "web"}, 0),
+		allocMac(&drivers.TaskConfig{AllocID: "alloc-1", Name: "db"}, 0),
+	}
+	for _, o := range others {
+		if o == mac {
+			t.Errorf("mac %s shared by another interface", mac)
+		}
+	}
+}
+
+func TestSetupTapNetworkInterfaces(t *testing.T) {
+	d := NewFirecrackerDriver(hclog.NewNullLogger()).(*Driver)
+	defer d.signalShutdown()
+	cfg := &drivers.TaskConfig{ID: "task", AllocID: "alloc-1", Name: "web"}
+
+	n, err := d.setupNetworkInterfaces(context.Background(), cfg, []NetworkInterface{
+		{Type: "tap", Tap: "tap0", IP: "10.0.0.2/24", Gateway: "10.0.0.1", MacFromAlloc: true},
+		{Type: "tap", Tap: "tap1", Mac: "02:fc:00:00:00:01"},
+		{Type: "tap", Tap: "tap2"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n.NetNS != "" {
+		t.Errorf("tap interfaces got a network namespace %s", n.NetNS)
+	}
+	if len(n.Interfaces) != 3 {
+		t.Fatalf("got %d interfaces, want 3", len(n.Interfaces))
+	}
+	for i, want := range []struct{ name, tap, mac string }{
+		{"eth0", "tap0", allocMac(cfg, 0)},
+		{"eth1", "tap1", "02:fc:00:00:00:01"},
+		{"eth2", "tap2", ""},
+	} {
+		iface := n.Interfaces[i]
+		if iface.Name != want.name || iface.Tap != want.tap || iface.Index != i {
+			t.Errorf("interface %d: got %s on %s, want %s on %s", i, iface.Name, iface.Tap, want.name, want.tap)
+		}
+		if want.mac != "" && iface.Mac != want.mac {
+			t.Errorf("interface %d: got mac %s, want %s", i, iface.Mac, want.mac)
+		}
+		if _, err := net.ParseMAC(iface.Mac); err != nil {
+			t.Errorf("interface %d: %v", i, err)
+		}
+	}
+	if p := n.primary(); p == nil || p.Name != "eth0" || p.IP.String() != "10.0.0.2/24" {
+		t.Errorf("got primary interface %+v, want eth0 with 10.0.0.2/24", p)
+	}
+
+	_, err = d.setupNetworkInterfaces(context.Background(), cfg, []NetworkInterface{
+		{Type: "cni", Network: "default"},
+		{Type: "tap", Tap: "tap0"},
+	})
+	if err != errMixedNetworkInterfaces {
+		t.Errorf("got error %v, want %v", err, errMixedNetworkInterfaces)
+	}
+}
+
+func TestReadCNIResult(t *testing.T) {
+	vm, tap := 1, 0
+	_, ip, _ := net.ParseCIDR("10.22.0.5/16")
+	_, ip6, _ := net.ParseCIDR("fd00:22::5/64")
+	result := &current.Result{
+		CNIVersion: current.ImplementedSpecVersion,
+		Interfaces: []*current.Interface{
+			{Name: "veth0", Mac: "aa:bb:cc:dd:ee:00"},
+			{Name: "veth0", Mac: "02:fc:00:00:00:01", Sandbox: "alloc-1"},
+		},
+		IPs: []*current.IPConfig{
+			{Interface: &tap, Address: net.IPNet{IP: net.ParseIP("10.22.0.1"), Mask: ip.Mask}},
+			{Interface: &vm, Address: net.IPNet{IP: net.ParseIP("10.22.0.5"), Mask: ip.Mask}, Gateway: net.ParseIP("10.22.0.1")},
+			{Interface: &vm, Address: net.IPNet{IP: net.ParseIP("10.22.0.6"), Mask: ip.Mask}},
+			{Interface: &vm, Address: net.IPNet{IP: net.ParseIP("fd00:22::5"), Mask: ip6.Mask}, Gateway: net.ParseIP("fd00:22::1")},
+		},
+	}
+	result.DNS.Nameservers = []string{"10.22.0.1"}
+
+	var iface netInterface
+	if err := readCNIResult(result, "alloc-1", &iface); err != nil {
+		t.Fatal(err)
+	}
+	if iface.Tap != "veth0" || iface.Mac != "02:fc:00:00:00:01" {
+		t.Errorf("got tap %s and mac %s", iface.Tap, iface.Mac)
+	}
+	// the first address of each family is kept
+	if ip, ip6 := iface.strings(); ip != "10.22.0.5/16" || ip6 != "fd00:22::5/64" {
+		t.Errorf("got addresses %s and %s", ip, ip6)
+	}
+	if !iface.Gateway.Equal(net.ParseIP("10.22.0.1")) || !iface.Gateway6.Equal(net.ParseIP("fd00:22::1")) {
+		t.Errorf("got gateways %s and %s", iface.Gateway, iface.Gateway6)
+	}
+	if len(iface.DNS.Servers) != 1 || iface.DNS.Servers[0] != "10.22.0.1" {
+		t.Errorf("got dns servers %v", iface.DNS.Servers)
+	}
+
+	if err := readCNIResult(result, "alloc-2", &netInterface{}); err == nil {
+		t.Errorf("no error without an interface for the micro-vm")
+	}
+	result.Interfaces[0].Name = "tap0"
+	if err := readCNIResult(result, "alloc-1", &netInterface{}); err == nil {
+		t.Errorf("no error without a tap")
+	}
+}
+
+func TestFirecrackerInterface(t *testing.T) {
+	iface := netInterface{
+		Config: NetworkInterface{Type: "tap", AllowMMDS: true, RxBandwidth: 1 << 20, TxOps: 100},
+		Tap:    "tap0",
+		Mac:    "02:fc:00:00:00:01",
+	}
+	fc := iface.firecrackerInterface()
+	if fc.StaticConfiguration.HostDevName != "tap0" || fc.StaticConfiguration.MacAddress != "02:fc:00:00:00:01" || !fc.AllowMMDS {
+		t.Errorf("got %+v", fc.StaticConfiguration)
+	}
+	if fc.InRateLimiter == nil || *fc.InRateLimiter.Bandwidth.Size != 1<<20 || fc.InRateLimiter.Ops != nil {
+		t.Errorf("got rx rate limiter %+v", fc.InRateLimiter)
+	}
+	if fc.OutRateLimiter == nil || *fc.OutRateLimiter.Ops.Size != 100 || fc.OutRateLimiter.Bandwidth != nil {
+		t.Errorf("got tx rate limiter %+v", fc.OutRateLimiter)
+	}
+	if rateLimiter(0, 0) != nil {
+		t.Errorf("rate limiter without limits")
+	}
+}
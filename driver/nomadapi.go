@@ -0,0 +1,143 @@
+/* Firecracker-task-driver is a task driver for Hashicorp's nomad that allows
+ * to create microvms using AWS Firecracker vmm
+ * Copyright (C) 2019  Carlos Neira cneirabustos@gmail.com
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ */
+
+package firevm
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+const (
+	defaultNomadAddress = "http://127.0.0.1:4646"
+
+	// nomadAPITimeout bounds the lookups done against the local agent
+	// while a task is starting.
+	nomadAPITimeout = 5 * time.Second
+)
+
+// allocation is the subset of the nomad allocation api object used by the
+// driver.
+type allocation struct {
+	AllocatedResources struct {
+		Shared struct {
+			DiskMB int64
+		}
+	}
+}
+
+// nomadAddress returns the address of the local nomad agent http api.
+func (d *Driver) nomadAddress() string {
+	if d.config.NomadAddress != "" {
+		return d.config.NomadAddress
+	}
+	if addr := os.Getenv("NOMAD_ADDR"); addr != "" {
+		return addr
+	}
+	return defaultNomadAddress
+}
+
+// nomadSetting returns the plugin config value, or the nomad cli variable
+// when it is unset.
+func nomadSetting(value, env string) string {
+	if value != "" {
+		return value
+	}
+	return os.Getenv(env)
+}
+
+// nomadClient returns the client of the local agent http api, trusting the
+// CA and presenting the client certificate of the config for https agents.
+// The files are read on each call so rotated certificates are picked up.
+func (d *Driver) nomadClient() (*http.Client, error) {
+	caCert := nomadSetting(d.config.NomadCACert, "NOMAD_CACERT")
+	clientCert := nomadSetting(d.config.NomadClientCert, "NOMAD_CLIENT_CERT")
+	clientKey := nomadSetting(d.config.NomadClientKey, "NOMAD_CLIENT_KEY")
+	serverName := nomadSetting(d.config.NomadTLSServerName, "NOMAD_TLS_SERVER_NAME")
+	if caCert == "" && clientCert == "" && clientKey == "" && serverName == "" {
+		return http.DefaultClient, nil
+	}
+
+	tlsConfig := &tls.Config{ServerName: serverName}
+	if caCert != "" {
+		pem, err := os.ReadFile(caCert)
+		if err != nil {
+			return nil, fmt.Errorf("Fail to read the nomad CA certificate: %v", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in the nomad CA certificate %s", caCert)
+		}
+	}
+	if (clientCert == "") != (clientKey == "") {
+		return nil, errIncompleteNomadClientCert
+	}
+	if clientCert != "" {
+		cert, err := tls.LoadX509KeyPair(clientCert, clientKey)
+		if err != nil {
+			return nil, fmt.Errorf("Fail to load the nomad client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	return &http.Client{Transport: transport}, nil
+}
+
+// ephemeralDiskMB returns the ephemeral_disk reserved for the allocation.
+// Task configs don't carry it, so it is read from the local agent using the
+// task's workload identity token or the token set in the plugin config.
+func (d *Driver) ephemeralDiskMB(cfg *drivers.TaskConfig) (int64, error) {
+	ctx, cancel := context.WithTimeout(d.ctx, nomadAPITimeout)
+	defer cancel()
+
+	url := strings.TrimSuffix(d.nomadAddress(), "/") + "/v1/allocation/" + cfg.AllocID
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return 0, err
+	}
+	token := cfg.Env["NOMAD_TOKEN"]
+	if token == "" {
+		token = d.config.NomadToken
+	}
+	if token != "" {
+		req.Header.Set("X-Nomad-Token", token)
+	}
+
+	client, err := d.nomadClient()
+	if err != nil {
+		return 0, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("unexpected response from %s: %s", url, resp.Status)
+	}
+
+	var alloc allocation
+	if err := json.NewDecoder(resp.Body).Decode(&alloc); err != nil {
+		return 0, err
+	}
+	return alloc.AllocatedResources.Shared.DiskMB, nil
+}
@@ -0,0 +1,118 @@
+/* Firecracker-task-driver is a task driver for Hashicorp's nomad that allows
+ * to create microvms using AWS Firecracker vmm
+ * Copyright (C) 2019  Carlos Neira cneirabustos@gmail.com
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ */
+
+package firevm
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+func TestEphemeralDiskMBTLS(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/allocation/alloc-1" || r.Header.Get("X-Nomad-Token") != "secret" {
+			http.Error(w, "denied", http.StatusForbidden)
+			return
+		}
+		w.Write([]byte(`{"AllocatedResources":{"Shared":{"DiskMB":300}}}`))
+	}))
+	srv.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	srv.StartTLS()
+	defer srv.Close()
+
+	// the test server certificate doubles as CA and client certificate
+	dir := t.TempDir()
+	cert := srv.TLS.Certificates[0]
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key}), 0600)
+
+	cfg := &drivers.TaskConfig{AllocID: "alloc-1", Env: map[string]string{"NOMAD_TOKEN": "secret"}}
+	cases := []struct {
+		name   string
+		config Config
+		env    map[string]string
+		ok     bool
+	}{
+		{"untrusted agent", Config{}, nil, false},
+		{"without client certificate", Config{NomadCACert: certFile}, nil, false},
+		{"plugin config", Config{NomadCACert: certFile, NomadClientCert: certFile, NomadClientKey: keyFile}, nil, true},
+		{"nomad cli variables", Config{}, map[string]string{
+			"NOMAD_CACERT":      certFile,
+			"NOMAD_CLIENT_CERT": certFile,
+			"NOMAD_CLIENT_KEY":  keyFile,
+		}, true},
+		{"wrong server name", Config{NomadCACert: certFile, NomadClientCert: certFile, NomadClientKey: keyFile,
+			NomadTLSServerName: "server.global.nomad"}, nil, false},
+	}
+	for _, c := range cases {
+		for _, v := range []string{"NOMAD_CACERT", "NOMAD_CLIENT_CERT", "NOMAD_CLIENT_KEY", "NOMAD_TLS_SERVER_NAME"} {
+			t.Setenv(v, c.env[v])
+		}
+		d := NewFirecrackerDriver(hclog.NewNullLogger()).(*Driver)
+		c.config.NomadAddress = srv.URL
+		d.config = &c.config
+
+		diskMB, err := d.ephemeralDiskMB(cfg)
+		d.signalShutdown()
+		if c.ok && (err != nil || diskMB != 300) {
+			t.Errorf("%s: got %d MB, %v", c.name, diskMB, err)
+		}
+		if !c.ok && err == nil {
+			t.Errorf("%s: no error", c.name)
+		}
+	}
+}
+
+func TestNomadClientConfig(t *testing.T) {
+	for _, v := range []string{"NOMAD_CACERT", "NOMAD_CLIENT_CERT", "NOMAD_CLIENT_KEY", "NOMAD_TLS_SERVER_NAME"} {
+		t.Setenv(v, "")
+	}
+	notPEM := filepath.Join(t.TempDir(), "ca.pem")
+	os.WriteFile(notPEM, []byte("not a certificate"), 0600)
+
+	cases := []struct {
+		name   string
+		config Config
+		err    error
+	}{
+		{"certificate without key", Config{NomadClientCert: "/etc/nomad/cli.pem"}, errIncompleteNomadClientCert},
+		{"key without certificate", Config{NomadClientKey: "/etc/nomad/cli-key.pem"}, errIncompleteNomadClientCert},
+		{"missing CA", Config{NomadCACert: "/nonexistent/ca.pem"}, nil},
+		{"CA without certificate", Config{NomadCACert: notPEM}, nil},
+	}
+	for _, c := range cases {
+		d := &Driver{config: &c.config}
+		_, err := d.nomadClient()
+		if err == nil || (c.err != nil && !errors.Is(err, c.err)) {
+			t.Errorf("%s: got error %v, want %v", c.name, err, c.err)
+		}
+	}
+
+	d := &Driver{config: &Config{}}
+	if client, err := d.nomadClient(); err != nil || client != http.DefaultClient {
+		t.Errorf("plain http agent: got %v, %v", client, err)
+	}
+}
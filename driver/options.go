@@ -15,11 +15,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"math/rand"
-	"net"
 	"os"
-	"path/filepath"
 	"strconv"
 	"strings"
 
@@ -30,9 +27,7 @@ import (
 )
 
 func newOptions() *options {
-	return &options{
-		createFifoFileLogs: createFifoFileLogs,
-	}
+	return &options{}
 }
 
 func genmacaddr() (string, error) {
@@ -41,7 +36,8 @@ func genmacaddr() (string, error) {
 	if err != nil {
 		return "", fmt.Errorf("Fail to generate mac address: %v", err)
 	}
-	buf[0] |= 2
+	// locally administered unicast address
+	buf[0] = buf[0]&^1 | 2
 	return fmt.Sprintf("%02x:%02x:%02x:%02x:%02x:%02x", buf[0], buf[1], buf[2], buf[3], buf[4], buf[5]), nil
 }
 
@@ -64,8 +60,16 @@ type options struct {
 	FcRootDrivePath    string   `long:"root-drive" description:"Path to root disk image"`
 	FcRootPartUUID     string   `long:"root-partition" description:"Root partition UUID"`
 	FcAdditionalDrives []string `long:"add-drive" description:"Path to additional drive, suffixed with :ro or :rw, can be specified multiple times"`
+	FcTaskDirDrives    []taskDirDrive
+	FcVolumeDrives     []volumeDrive
+	FcScratchDrives    []scratchDrive
+	FcPersistentDrives []persistentDrive
 	FcNetworkName      string   `long:"Network-name" description:"Network name configured by CNI"`
 	FcNicConfig        Nic      `long:"Nic-config" description:"Nic configuration from tap device"`
+	FcNicMac           string   `long:"Nic-mac" description:"Mac address of the Nic, random when empty"`
+	FcInterfaces       []netInterface
+	FcDNS              guestDNS
+	FcExtraHosts       []extraHost
 	FcVsockDevices     []string `long:"vsock-device" description:"Vsock interface, specified as PATH:CID. Multiple OK"`
 	FcLogFifo          string   `long:"vmm-log-fifo" description:"FIFO for firecracker logs"`
 	FcLogLevel         string   `long:"log-level" description:"vmm log level" default:"Debug"`
@@ -75,15 +79,13 @@ type options struct {
 	FcCPUTemplate      string   `long:"cpu-template" description:"Firecracker CPU Template (C3 or T2)"`
 	FcMemSz            int64    `long:"memory" short:"m" description:"VM memory, in MiB" default:"512"`
 	FcMetadata         string   `long:"metadata" description:"Firecracker Metadata for MMDS (json)"`
-	FcFifoLogFile      string   `long:"firecracker-log" short:"l" description:"pipes the fifo contents to the specified file"`
-	FcSocketPath       string   `long:"socket-path" short:"s" description:"path to use for firecracker socket, defaults to a unique file in in the first existing directory from {$HOME, $TMPDIR, or /tmp}"`
-	Debug              bool     `long:"debug" short:"d" description:"Enable debug output"`
+	FcLogWriter        io.WriteCloser
+	FcSocketPath       string   `long:"socket-path" short:"s" description:"path to use for firecracker socket, in the task runtime dir"`
+	FcRuntimeDir       runtimeDir
 	Version            bool     `long:"version" description:"Outputs the version of the application"`
 
 	closers       []func() error
 	validMetadata interface{}
-
-	createFifoFileLogs func(fifoPath string) (*os.File, error)
 }
 
 // Converts options to a usable firecracker config
@@ -106,6 +108,30 @@ func (opts *options) getFirecrackerConfig(AllocId string) (firecracker.Config, e
 		return firecracker.Config{}, err
 	}
 
+	kernelArgs := opts.FcKernelCmdLine
+	md := guestMetadata{Mounts: opts.mountHints(blockDevices)}
+	kernelArgs += mountsKernelArgs(md.Mounts)
+	dns := opts.guestDNS()
+	if len(opts.FcInterfaces) > 0 {
+		kernelArgs += ipKernelArg(kernelArgs, opts.FcInterfaces, dns.kernelNameservers())
+	}
+	guestNICs := opts.guestNetwork(NICs)
+	kernelArgs += ip6KernelArgs(guestNICs)
+	md.NetworkInterfaces = guestInterfaces(guestNICs)
+	if !dns.empty() {
+		md.DNS = &dns
+	}
+	md.ExtraHosts = opts.FcExtraHosts
+	if len(md.Mounts) > 0 || len(md.NetworkInterfaces) > 0 || md.DNS != nil || len(md.ExtraHosts) > 0 {
+		opts.setGuestMetadata(md)
+	}
+	// network_interface blocks choose the interfaces MMDS is reachable from
+	if opts.validMetadata != nil && len(opts.FcInterfaces) == 0 {
+		for i := range NICs {
+			NICs[i].AllowMMDS = true
+		}
+	}
+
 	// vsocks
 	vsocks, err := parseVsocks(opts.FcVsockDevices)
 	if err != nil {
@@ -118,15 +144,12 @@ func (opts *options) getFirecrackerConfig(AllocId string) (firecracker.Config, e
 		return firecracker.Config{}, err
 	}
 
-	var socketPath string
-	if opts.FcSocketPath != "" {
-		socketPath = opts.FcSocketPath
-	} else {
-		socketPath = getSocketPath()
+	socketPath := opts.FcSocketPath
+	if socketPath == "" {
+		socketPath = opts.FcRuntimeDir.path(runtimeSocket)
 	}
 
-	//htEnabled := !opts.FcDisableHt
-	smt := false
+	smt := !opts.FcDisableHt
 
 	return firecracker.Config{
 		SocketPath:        socketPath,
@@ -135,7 +158,7 @@ func (opts *options) getFirecrackerConfig(AllocId string) (firecracker.Config, e
 		MetricsFifo:       opts.FcMetricsFifo,
 		FifoLogWriter:     fifo,
 		KernelImagePath:   opts.FcKernelImage,
-		KernelArgs:        opts.FcKernelCmdLine,
+		KernelArgs:        kernelArgs,
 		Drives:            blockDevices,
 		NetworkInterfaces: NICs,
 		VsockDevices:      vsocks,
@@ -155,6 +178,16 @@ func (opts *options) getNetwork(AllocId string) ([]firecracker.NetworkInterface,
 		return nil, errConflictingNetworkOpts
 	}
 
+	if len(opts.FcInterfaces) > 0 {
+		if len(opts.FcNetworkName) > 0 || len(opts.FcNicConfig.Ip) > 0 {
+			return nil, errConflictingNetworkInterfaces
+		}
+		for _, iface := range opts.FcInterfaces {
+			NICs = append(NICs, iface.firecrackerInterface())
+		}
+		return NICs, nil
+	}
+
 	if len(opts.FcNetworkName) > 0 {
 		veth, err := RandomVethName()
 		if err != nil {
@@ -171,28 +204,32 @@ func (opts *options) getNetwork(AllocId string) ([]firecracker.NetworkInterface,
 	}
 
 	if len(opts.FcNicConfig.Ip) > 0 {
-		_, Net, err := net.ParseCIDR(opts.FcNicConfig.Ip)
-		if err != nil {
-			return nil, fmt.Errorf("Fail to parse CIDR address: %v", err)
-		}
-		mockMacAddrString, err := genmacaddr()
+		addrs, err := opts.FcNicConfig.addrs()
 		if err != nil {
 			return nil, err
 		}
+		mockMacAddrString := opts.FcNicMac
+		if mockMacAddrString == "" {
+			mockMacAddrString, err = genmacaddr()
+			if err != nil {
+				return nil, err
+			}
+		}
 		nic := firecracker.NetworkInterface{
 			StaticConfiguration: &firecracker.StaticNetworkConfiguration{
 				MacAddress:  mockMacAddrString,
 				HostDevName: opts.FcNicConfig.Interface,
-				IPConfiguration: &firecracker.IPConfiguration{
-					IPAddr: net.IPNet{
-						IP:   Net.IP,
-						Mask: Net.Mask,
-					},
-					Gateway:     net.ParseIP(opts.FcNicConfig.Gateway),
-					Nameservers: opts.FcNicConfig.Nameservers,
-				},
 			},
 		}
+		// the sdk only configures ipv4, the ipv6 address is passed with
+		// the guest network metadata
+		if addrs.IP != nil {
+			nic.StaticConfiguration.IPConfiguration = &firecracker.IPConfiguration{
+				IPAddr:      *addrs.IP,
+				Gateway:     addrs.Gateway,
+				Nameservers: opts.guestDNS().kernelNameservers(),
+			}
+		}
 		NICs = append(NICs, nic)
 	}
 	return NICs, nil
@@ -204,6 +241,18 @@ func (opts *options) getBlockDevices() ([]models.Drive, error) {
 	if err != nil {
 		return nil, err
 	}
+	for _, t := range opts.FcTaskDirDrives {
+		blockDevices = append(blockDevices, t.drive())
+	}
+	for _, v := range opts.FcVolumeDrives {
+		blockDevices = append(blockDevices, v.drive())
+	}
+	for _, s := range opts.FcScratchDrives {
+		blockDevices = append(blockDevices, s.drive())
+	}
+	for _, p := range opts.FcPersistentDrives {
+		blockDevices = append(blockDevices, p.drive())
+	}
 	rootDrive := models.Drive{
 		DriveID:      firecracker.String("1"),
 		PathOnHost:   &opts.FcRootDrivePath,
@@ -224,10 +273,9 @@ func (opts *options) handleFifos() (io.Writer, error) {
 	// directory does not need to be created.
 	generateFifoFilename := false
 	generateMetricFifoFilename := false
-	var err error
 	var fifo io.WriteCloser
 
-	if len(opts.FcFifoLogFile) > 0 {
+	if opts.FcLogWriter != nil {
 		if len(opts.FcLogFifo) > 0 {
 			return nil, errConflictingLogOpts
 		}
@@ -237,12 +285,7 @@ func (opts *options) handleFifos() (io.Writer, error) {
 		if len(opts.FcMetricsFifo) == 0 {
 			generateMetricFifoFilename = true
 		}
-		if fifo, err = opts.createFifoFileLogs(opts.FcFifoLogFile); err != nil {
-			return nil, errors.Wrap(err, errUnableToCreateFifoLogFile.Error())
-		}
-		opts.addCloser(func() error {
-			return fifo.Close()
-		})
+		fifo = opts.FcLogWriter
 
 	} else if len(opts.FcLogFifo) > 0 || len(opts.FcMetricsFifo) > 0 {
 		// this checks to see if either one of the fifos was set. If at least one
@@ -258,19 +301,13 @@ func (opts *options) handleFifos() (io.Writer, error) {
 	}
 
 	if generateFifoFilename || generateMetricFifoFilename {
-		dir, err := ioutil.TempDir(os.TempDir(), "fcfifo")
-		if err != nil {
-			return fifo, fmt.Errorf("Fail to create temporary directory: %v", err)
-		}
-		opts.addCloser(func() error {
-			return os.RemoveAll(dir)
-		})
+		// the fifos live in the runtime dir, removed with it
 		if generateFifoFilename {
-			opts.FcLogFifo = filepath.Join(dir, "fc_fifo")
+			opts.FcLogFifo = opts.FcRuntimeDir.path(runtimeLogFifo)
 		}
 
 		if generateMetricFifoFilename {
-			opts.FcMetricsFifo = filepath.Join(dir, "fc_metrics_fifo")
+			opts.FcMetricsFifo = opts.FcRuntimeDir.path(runtimeMetricsFifo)
 		}
 	}
 
@@ -357,44 +394,3 @@ func parseVsocks(devices []string) ([]firecracker.VsockDevice, error) {
 	}
 	return result, nil
 }
-
-func createFifoFileLogs(fifoPath string) (*os.File, error) {
-	return os.OpenFile(fifoPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
-}
-
-// getSocketPath provides a randomized socket path by building a unique fielname
-// and searching for the existance of directories {$HOME, os.TempDir()} and returning
-// the path with the first directory joined with the unique filename. If we can't
-// find a good path panics.
-func getSocketPath() string {
-	filename := strings.Join([]string{
-		".firecracker.sock",
-		strconv.Itoa(os.Getpid()),
-		strconv.Itoa(rand.Intn(1000))},
-		"-",
-	)
-	var dir string
-	if d := os.Getenv("HOME"); checkExistsAndDir(d) {
-		dir = d
-	} else if checkExistsAndDir(os.TempDir()) {
-		dir = os.TempDir()
-	} else {
-		panic("Unable to find a location for firecracker socket. 'It's not going to do any good to land on mars if we're stupid.' --Ray Bradbury")
-	}
-
-	return filepath.Join(dir, filename)
-}
-
-// checkExistsAndDir returns true if path exists and is a Dir
-func checkExistsAndDir(path string) bool {
-	// empty
-	if path == "" {
-		return false
-	}
-	// does it exist?
-	if info, err := os.Stat(path); err == nil {
-		// is it a directory?
-		return info.IsDir()
-	}
-	return false
-}
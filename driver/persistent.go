@@ -0,0 +1,172 @@
+/* Firecracker-task-driver is a task driver for Hashicorp's nomad that allows
+ * to create microvms using AWS Firecracker vmm
+ * Copyright (C) 2019  Carlos Neira cneirabustos@gmail.com
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ */
+
+package firevm
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"syscall"
+
+	firecracker "github.com/firecracker-microvm/firecracker-go-sdk"
+	models "github.com/firecracker-microvm/firecracker-go-sdk/client/models"
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+var validDiskName = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+// persistentDrive is a named disk kept outside the allocation so later
+// allocations of the same job get it back.
+type persistentDrive struct {
+	Name     string
+	Image    string
+	SizeMB   int64
+	ReadOnly bool
+}
+
+func (p persistentDrive) drive() models.Drive {
+	return models.Drive{
+		DriveID:      firecracker.String("persist_" + p.Name),
+		PathOnHost:   firecracker.String(p.Image),
+		IsReadOnly:   firecracker.Bool(p.ReadOnly),
+		IsRootDevice: firecracker.Bool(false),
+	}
+}
+
+// preparePersistentDisks creates the persistent disks of the task on first
+// use, under <dir>/<namespace>/<job>/<name>.img, and grows ext4 disks whose
+// size_mb was raised.
+func preparePersistentDisks(dir string, cfg *drivers.TaskConfig, disks []PersistentDisk) ([]persistentDrive, error) {
+	if len(disks) == 0 {
+		return nil, nil
+	}
+	if dir == "" {
+		return nil, errPersistentDisksDisabled
+	}
+
+	jobDir := filepath.Join(dir, pathComponent(cfg.Namespace), pathComponent(cfg.JobID))
+	if err := os.MkdirAll(jobDir, 0700); err != nil {
+		return nil, fmt.Errorf("Fail to create persistent disk directory: %v", err)
+	}
+
+	var drives []persistentDrive
+	for _, disk := range disks {
+		if !validDiskName.MatchString(disk.Name) {
+			return nil, errInvalidPersistentDiskName
+		}
+		if disk.SizeMB <= 0 {
+			return nil, errInvalidPersistentDiskSize
+		}
+
+		p := persistentDrive{
+			Name:     disk.Name,
+			Image:    filepath.Join(jobDir, disk.Name+".img"),
+			SizeMB:   disk.SizeMB,
+			ReadOnly: disk.ReadOnly,
+		}
+
+		fi, err := os.Stat(p.Image)
+		switch {
+		case os.IsNotExist(err):
+			if err := createScratchDisk(p.Image, ScratchDisk{SizeMB: disk.SizeMB, FsType: disk.FsType, Label: disk.Name}); err != nil {
+				os.Remove(p.Image)
+				return nil, fmt.Errorf("Fail to create persistent disk %s: %v", disk.Name, err)
+			}
+		case err != nil:
+			return nil, err
+		default:
+			p.SizeMB = fi.Size() / mib
+		}
+		drives = append(drives, p)
+	}
+	return drives, nil
+}
+
+// grow extends an ext4 persistent disk to the size requested in the task
+// config. It must only be called while holding the exclusive lock.
+func (p *persistentDrive) grow(sizeMB int64) error {
+	if p.ReadOnly || sizeMB <= p.SizeMB {
+		return nil
+	}
+	if ok, err := isExt4(p.Image); err != nil || !ok {
+		return err
+	}
+	if err := growExt4(p.Image, sizeMB); err != nil {
+		return fmt.Errorf("Fail to grow persistent disk %s: %v", p.Name, err)
+	}
+	p.SizeMB = sizeMB
+	return nil
+}
+
+// lockDisk takes a flock on a disk used by the vm, exclusive when the vm
+// writes to it and shared otherwise, so two running vms never mount the same
+// disk read-write. The returned file is handed to the firecracker process,
+// which keeps the lock for as long as it runs.
+func lockDisk(path string, readOnly bool) (*os.File, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	how := syscall.LOCK_EX
+	if readOnly {
+		how = syscall.LOCK_SH
+	}
+	if err := syscall.Flock(int(f.Fd()), how|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			// a shared lock is only refused by a writer, an exclusive
+			// one by any user
+			if readOnly {
+				return nil, fmt.Errorf("disk %s is in use read-write by another micro-vm", path)
+			}
+			return nil, fmt.Errorf("disk %s is in use by another micro-vm", path)
+		}
+		return nil, fmt.Errorf("Fail to lock disk %s: %v", path, err)
+	}
+	return f, nil
+}
+
+// lockDrives locks every additional drive attached to the vm. On error the
+// locks already taken are released.
+func lockDrives(drives []models.Drive) ([]*os.File, error) {
+	var locks []*os.File
+	for _, d := range drives {
+		if firecracker.BoolValue(d.IsRootDevice) {
+			continue
+		}
+		f, err := lockDisk(firecracker.StringValue(d.PathOnHost), firecracker.BoolValue(d.IsReadOnly))
+		if err != nil {
+			closeFiles(locks)
+			return nil, err
+		}
+		locks = append(locks, f)
+	}
+	return locks, nil
+}
+
+func closeFiles(files []*os.File) {
+	for _, f := range files {
+		f.Close()
+	}
+}
+
+// pathComponent makes a namespace or job id safe to use as a single path
+// element, dispatched and periodic job ids contain slashes.
+func pathComponent(s string) string {
+	s = strings.ReplaceAll(s, string(filepath.Separator), "_")
+	if s == "" || s == "." || s == ".." {
+		s = "_" + s
+	}
+	return s
+}
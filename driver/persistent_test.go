@@ -0,0 +1,93 @@
+/* Firecracker-task-driver is a task driver for Hashicorp's nomad that allows
+ * to create microvms using AWS Firecracker vmm
+ * Copyright (C) 2019  Carlos Neira cneirabustos@gmail.com
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ */
+
+package firevm
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+func TestLockDisk(t *testing.T) {
+	cases := []struct {
+		name     string
+		held     bool // read-only of the lock already held
+		readOnly bool
+		err      string
+	}{
+		{"shared with shared", true, true, ""},
+		{"exclusive with shared", true, false, "is in use by another micro-vm"},
+		{"shared with exclusive", false, true, "is in use read-write by another micro-vm"},
+		{"exclusive with exclusive", false, false, "is in use by another micro-vm"},
+	}
+	for _, c := range cases {
+		path := filepath.Join(t.TempDir(), "disk.img")
+		if err := os.WriteFile(path, nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+		held, err := lockDisk(path, c.held)
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		f, err := lockDisk(path, c.readOnly)
+		switch {
+		case c.err == "" && err != nil:
+			t.Errorf("%s: %v", c.name, err)
+		case c.err != "" && (err == nil || !strings.Contains(err.Error(), c.err)):
+			t.Errorf("%s: got %v, want %q", c.name, err, c.err)
+		}
+		if f != nil {
+			f.Close()
+		}
+		held.Close()
+	}
+}
+
+func TestPreparePersistentDisks(t *testing.T) {
+	cfg := &drivers.TaskConfig{Namespace: "default", JobID: "batch/periodic-1"}
+	cases := []struct {
+		name  string
+		dir   string
+		disks []PersistentDisk
+		err   error
+	}{
+		{"disabled", "", []PersistentDisk{{Name: "data", SizeMB: 1}}, errPersistentDisksDisabled},
+		{"name", "dir", []PersistentDisk{{Name: "../data", SizeMB: 1}}, errInvalidPersistentDiskName},
+		{"size", "dir", []PersistentDisk{{Name: "data"}}, errInvalidPersistentDiskSize},
+	}
+	for _, c := range cases {
+		dir := c.dir
+		if dir != "" {
+			dir = t.TempDir()
+		}
+		if _, err := preparePersistentDisks(dir, cfg, c.disks); err != c.err {
+			t.Errorf("%s: got %v, want %v", c.name, err, c.err)
+		}
+	}
+}
+
+func TestPathComponent(t *testing.T) {
+	cases := []struct{ in, out string }{
+		{"web", "web"},
+		{"batch/periodic-1", "batch_periodic-1"},
+		{"..", "_.."},
+		{"", "_"},
+	}
+	for _, c := range cases {
+		if got := pathComponent(c.in); got != c.out {
+			t.Errorf("%q: got %q, want %q", c.in, got, c.out)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+/* Firecracker-task-driver is a task driver for Hashicorp's nomad that allows
+ * to create microvms using AWS Firecracker vmm
+ * Copyright (C) 2019  Carlos Neira cneirabustos@gmail.com
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ */
+
+package firevm
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+
+	firecracker "github.com/firecracker-microvm/firecracker-go-sdk"
+	"github.com/hashicorp/nomad/plugins/drivers"
+	log "github.com/sirupsen/logrus"
+)
+
+// readInstanceInfo reads the info file the driver wrote in the runtime
+// directory once the micro-vm started.
+func readInstanceInfo(runDir runtimeDir) (Instance_info, error) {
+	var info Instance_info
+	b, err := os.ReadFile(runDir.path(runtimeInfo))
+	if err != nil {
+		return info, err
+	}
+	if err := json.Unmarshal(b, &info); err != nil {
+		return info, fmt.Errorf("Fail to parse %s: %v", runDir.path(runtimeInfo), err)
+	}
+	return info, nil
+}
+
+// liveVMM returns the info of the micro-vm owning the runtime directory when
+// its firecracker process still runs. The process must carry the tag of the
+// task, the pid of a micro-vm long gone may have been reused.
+func liveVMM(runDir runtimeDir, taskID string) (Instance_info, bool) {
+	info, err := readInstanceInfo(runDir)
+	if err != nil {
+		return info, false
+	}
+	pid, err := strconv.Atoi(info.Pid)
+	if err != nil {
+		return info, false
+	}
+	id, ok := processTaskID(pid)
+	return info, ok && id == taskID
+}
+
+// reattach rebuilds the micro-vm of a task that kept running while the
+// plugin was down. Nothing is set up again: the vmm still holds its disk
+// locks, cgroup, network and runtime directory. Only what lived in the
+// plugin is opened again, the api client, the log and the metrics readers.
+func (d *Driver) reattach(cfg *drivers.TaskConfig, taskConfig TaskConfig, state TaskState, info Instance_info) (*vminfo, error) {
+	runDir := state.RunDir
+	socket := runDir.path(runtimeSocket)
+	m, err := firecracker.NewMachine(context.Background(), firecracker.Config{SocketPath: socket},
+		firecracker.WithLogger(log.NewEntry(log.New())))
+	if err != nil {
+		return nil, fmt.Errorf("Failed creating machine: %v", err)
+	}
+
+	vlog, err := d.openVMMLog(cfg, taskConfig)
+	if err != nil {
+		return nil, err
+	}
+	// a micro-vm booted without a log has no fifo, the task still runs
+	if err := vlog.follow(runDir.path(runtimeLogFifo)); err != nil {
+		d.logger.Warn("failed to follow the firecracker log", "task_id", cfg.ID, "error", err)
+	}
+
+	vmetrics, err := startVMMetrics(runDir.path(runtimeMetricsFifo), socket, cfg, d.logger)
+	if err != nil {
+		d.logger.Warn("firecracker metrics disabled", "task_id", cfg.ID, "error", err)
+	}
+
+	var guestStats guestStatsFunc
+	if taskConfig.Balloon != nil {
+		guestStats = m.GetBalloonStats
+	}
+
+	return &vminfo{Machine: m, tty: info.Serial, Info: info, taskDirs: state.TaskDirs, scratchDisks: state.ScratchDisks,
+		persistentDisks: state.PersistentDisks, cgroup: state.Cgroup, bridge: state.Bridge, group: state.Group,
+		network: state.Network, egress: state.Egress, runDir: runDir, vmmLog: vlog, metrics: vmetrics, guestStats: guestStats}, nil
+}
@@ -0,0 +1,77 @@
+/* Firecracker-task-driver is a task driver for Hashicorp's nomad that allows
+ * to create microvms using AWS Firecracker vmm
+ * Copyright (C) 2019  Carlos Neira cneirabustos@gmail.com
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ */
+
+package firevm
+
+import (
+	"encoding/json"
+	"os"
+	"os/exec"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestLiveVMM(t *testing.T) {
+	cmd := startTaggedProcess(t, "task-1")
+
+	cases := []struct {
+		name   string
+		pid    string
+		taskID string
+		live   bool
+	}{
+		{"running", strconv.Itoa(cmd.Process.Pid), "task-1", true},
+		{"other task", strconv.Itoa(cmd.Process.Pid), "task-2", false},
+		{"untagged process", strconv.Itoa(os.Getpid()), "task-1", false},
+		{"no pid", "", "task-1", false},
+	}
+	for _, c := range cases {
+		runDir := runtimeDir(t.TempDir())
+		b, _ := json.Marshal(Instance_info{Pid: c.pid, Ip: "10.0.0.2"})
+		if err := os.WriteFile(runDir.path(runtimeInfo), b, 0600); err != nil {
+			t.Fatal(err)
+		}
+		info, live := liveVMM(runDir, c.taskID)
+		if live != c.live {
+			t.Errorf("%s: got live=%v, want %v", c.name, live, c.live)
+		}
+		if live && info.Ip != "10.0.0.2" {
+			t.Errorf("%s: got info %+v", c.name, info)
+		}
+	}
+
+	if _, live := liveVMM(runtimeDir(t.TempDir()), "task-1"); live {
+		t.Error("live without an info file")
+	}
+}
+
+// startTaggedProcess starts a process tagged like the vmm of taskID, killed
+// at the end of the test.
+func startTaggedProcess(t *testing.T, taskID string) *exec.Cmd {
+	cmd := exec.Command("sleep", "30")
+	cmd.Env = []string{taskIDEnv + "=" + taskID}
+	if err := cmd.Start(); err != nil {
+		t.Skipf("can't start a process: %v", err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+	// the environment is the one of the test until sleep is executed
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if id, _ := processTaskID(cmd.Process.Pid); id == taskID {
+			return cmd
+		}
+	}
+	t.Fatalf("process %d never got tagged", cmd.Process.Pid)
+	return nil
+}
@@ -0,0 +1,104 @@
+/* Firecracker-task-driver is a task driver for Hashicorp's nomad that allows
+ * to create microvms using AWS Firecracker vmm
+ * Copyright (C) 2019  Carlos Neira cneirabustos@gmail.com
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ */
+
+package firevm
+
+import (
+	"fmt"
+
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+const (
+	// cpuSharesPerVcpu is the nomad cpu reservation, in MHz, backing one
+	// vcpu when the task doesn't reserve cores.
+	cpuSharesPerVcpu = 100
+
+	// maxVcpus is the largest vcpu_count firecracker accepts.
+	maxVcpus = 32
+
+	// defaultMemSizeMB is used when nomad doesn't reserve any memory.
+	defaultMemSizeMB = 300
+)
+
+// vmShape returns the vcpu count and guest memory of the vm. Vcpus and Mem
+// are used when set and must fit in the task's reservation, with overheadMB
+// of memory left to the vmm; otherwise the shape is derived from it.
+func vmShape(taskConfig TaskConfig, cfg *drivers.TaskConfig, overheadMB int64) (int64, int64, error) {
+	var cpuShares, memoryMB int64
+	var reservedCores int
+	if res := cfg.Resources; res != nil && res.NomadResources != nil {
+		cpuShares = res.NomadResources.Cpu.CpuShares
+		reservedCores = len(res.NomadResources.Cpu.ReservedCores)
+		memoryMB = res.NomadResources.Memory.MemoryMB
+		if res.NomadResources.Memory.MemoryMaxMB > memoryMB {
+			memoryMB = res.NomadResources.Memory.MemoryMaxMB
+		}
+	}
+
+	// reserved cores map one to one to vcpus, otherwise every 100MHz of
+	// the cpu reservation backs one vcpu.
+	cpuLimit := int64(reservedCores)
+	if cpuLimit == 0 {
+		cpuLimit = cpuShares / cpuSharesPerVcpu
+	}
+	if cpuLimit < 1 {
+		cpuLimit = 1
+	}
+
+	vcpus := cpuLimit
+	if taskConfig.Vcpus > 0 {
+		vcpus = int64(taskConfig.Vcpus)
+		if vcpus > cpuLimit {
+			if reservedCores > 0 {
+				return 0, 0, fmt.Errorf("Vcpus = %d exceeds the %d cores reserved for the task", vcpus, reservedCores)
+			}
+			return 0, 0, fmt.Errorf("Vcpus = %d needs a cpu reservation of at least %d MHz, the task reserves %d MHz",
+				vcpus, vcpus*cpuSharesPerVcpu, cpuShares)
+		}
+	}
+	if vcpus > maxVcpus {
+		if taskConfig.Vcpus > 0 {
+			return 0, 0, fmt.Errorf("Vcpus = %d exceeds the firecracker limit of %d vcpus", vcpus, maxVcpus)
+		}
+		vcpus = maxVcpus
+	}
+
+	// with smt firecracker only accepts one or an even number of vcpus
+	if smtEnabled(taskConfig) && vcpus > 1 && vcpus%2 != 0 {
+		if taskConfig.Vcpus > 0 {
+			return 0, 0, fmt.Errorf("Vcpus = %d must be 1 or even with hyperthreading enabled", vcpus)
+		}
+		return 0, 0, fmt.Errorf("the task reservation gives %d vcpus, hyperthreading needs 1 or an even number: set Vcpus", vcpus)
+	}
+
+	if memoryMB == 0 {
+		if taskConfig.Mem > 0 {
+			return vcpus, int64(taskConfig.Mem), nil
+		}
+		return vcpus, defaultMemSizeMB, nil
+	}
+
+	available := memoryMB - overheadMB
+	if available <= 0 {
+		return 0, 0, fmt.Errorf("the task reserves %d MB of memory, not enough for the %d MB of vmm overhead",
+			memoryMB, overheadMB)
+	}
+	mem := available
+	if taskConfig.Mem > 0 {
+		mem = int64(taskConfig.Mem)
+		if mem > available {
+			return 0, 0, fmt.Errorf("Mem = %d MB plus %d MB of vmm overhead exceeds the %d MB of memory reserved for the task",
+				mem, overheadMB, memoryMB)
+		}
+	}
+	return vcpus, mem, nil
+}
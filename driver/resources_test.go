@@ -0,0 +1,72 @@
+/* Firecracker-task-driver is a task driver for Hashicorp's nomad that allows
+ * to create microvms using AWS Firecracker vmm
+ * Copyright (C) 2019  Carlos Neira cneirabustos@gmail.com
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ */
+
+package firevm
+
+import (
+	"runtime"
+	"testing"
+
+	"github.com/hashicorp/nomad/nomad/structs"
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+func taskResources(cpuShares int64, cores int, memoryMB int64) *drivers.TaskConfig {
+	res := &structs.AllocatedTaskResources{}
+	res.Cpu.CpuShares = cpuShares
+	for i := 0; i < cores; i++ {
+		res.Cpu.ReservedCores = append(res.Cpu.ReservedCores, uint16(i))
+	}
+	res.Memory.MemoryMB = memoryMB
+	return &drivers.TaskConfig{Resources: &drivers.Resources{NomadResources: res}}
+}
+
+func TestVMShape(t *testing.T) {
+	smtOn := false
+	cases := []struct {
+		name    string
+		task    TaskConfig
+		cfg     *drivers.TaskConfig
+		vcpus   int64
+		mem     int64
+		err     bool
+		smtOnly bool
+	}{
+		{name: "derived", cfg: taskResources(300, 0, 1024), vcpus: 3, mem: 992},
+		{name: "reserved cores", cfg: taskResources(0, 4, 1024), vcpus: 4, mem: 992},
+		{name: "small reservation", cfg: taskResources(50, 0, 256), vcpus: 1, mem: 224},
+		{name: "no memory", cfg: taskResources(100, 0, 0), vcpus: 1, mem: defaultMemSizeMB},
+		{name: "explicit", task: TaskConfig{Vcpus: 3, Mem: 512}, cfg: taskResources(300, 0, 1024), vcpus: 3, mem: 512},
+		{name: "too many vcpus", task: TaskConfig{Vcpus: 4}, cfg: taskResources(300, 0, 1024), err: true},
+		{name: "more than the cores", task: TaskConfig{Vcpus: 5}, cfg: taskResources(0, 4, 1024), err: true},
+		{name: "too much memory", task: TaskConfig{Mem: 1000}, cfg: taskResources(100, 0, 1024), err: true},
+		{name: "overhead", cfg: taskResources(100, 0, 32), err: true},
+		{name: "firecracker limit", task: TaskConfig{Vcpus: 33}, cfg: taskResources(4000, 0, 1024), err: true},
+		{name: "capped", cfg: taskResources(4000, 0, 1024), vcpus: maxVcpus, mem: 992},
+		{name: "odd vcpus with smt", task: TaskConfig{Vcpus: 3, DisableHt: &smtOn}, cfg: taskResources(300, 0, 1024), err: true, smtOnly: true},
+		{name: "derived odd vcpus with smt", task: TaskConfig{DisableHt: &smtOn}, cfg: taskResources(300, 0, 1024), err: true, smtOnly: true},
+	}
+	for _, c := range cases {
+		if c.smtOnly && runtime.GOARCH != "amd64" {
+			continue
+		}
+		vcpus, mem, err := vmShape(c.task, c.cfg, 32)
+		if c.err {
+			if err == nil {
+				t.Errorf("%s: got %d vcpus and %d MB, want an error", c.name, vcpus, mem)
+			}
+			continue
+		}
+		if err != nil || vcpus != c.vcpus || mem != c.mem {
+			t.Errorf("%s: got %d vcpus, %d MB, %v, want %d vcpus, %d MB", c.name, vcpus, mem, err, c.vcpus, c.mem)
+		}
+	}
+}
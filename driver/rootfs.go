@@ -0,0 +1,150 @@
+/* Firecracker-task-driver is a task driver for Hashicorp's nomad that allows
+ * to create microvms using AWS Firecracker vmm
+ * Copyright (C) 2019  Carlos Neira cneirabustos@gmail.com
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ */
+
+package firevm
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+const (
+	// ext4 superblock magic, found 1024 bytes into the image at offset 56
+	// of the superblock.
+	ext4MagicOffset = 1024 + 56
+	ext4Magic       = 0xEF53
+)
+
+// usesEphemeralDisk tells whether the task has disks sized against the
+// ephemeral_disk of the allocation.
+func (tc TaskConfig) usesEphemeralDisk() bool {
+	return tc.GrowRootfs || tc.RootfsSizeMB != 0 || len(tc.ScratchDisks) > 0
+}
+
+// diskSizes works out the root image size requested by the task and checks
+// it, together with the scratch disks, against the ephemeral_disk reserved
+// for the allocation. diskMB is zero when the task has no such disks.
+func diskSizes(taskConfig TaskConfig, diskMB int64) (int64, error) {
+	var scratchMB int64
+	for _, disk := range taskConfig.ScratchDisks {
+		scratchMB += disk.SizeMB
+	}
+
+	rootfsMB := taskConfig.RootfsSizeMB
+	if taskConfig.GrowRootfs {
+		if diskMB == 0 {
+			return 0, errUnknownEphemeralDisk
+		}
+		rootfsMB = diskMB - scratchMB
+	}
+	if rootfsMB < 0 {
+		return 0, errInvalidRootfsSize
+	}
+
+	if diskMB > 0 && rootfsMB+scratchMB > diskMB {
+		return 0, fmt.Errorf("root filesystem (%d MB) and scratch disks (%d MB) don't fit in the %d MB reserved by ephemeral_disk",
+			rootfsMB, scratchMB, diskMB)
+	}
+	return rootfsMB, nil
+}
+
+// prepareRootfs grows the root image to sizeMB before boot and returns the
+// path the vm should use. Images outside the allocation dir are shared
+// between allocations, so they are copied into the task dir first.
+func prepareRootfs(cfg *drivers.TaskConfig, path string, sizeMB int64) (string, error) {
+	if sizeMB == 0 {
+		return path, nil
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	if !fi.Mode().IsRegular() {
+		return "", errRootfsNotResizable
+	}
+
+	rel, err := filepath.Rel(cfg.AllocDir, path)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		imageDir, err := taskImageDir(cfg)
+		if err != nil {
+			return "", err
+		}
+		copied := filepath.Join(imageDir, "rootfs.ext4")
+		// keep the copy across plugin restarts, the vm may be using it
+		if _, err := os.Stat(copied); os.IsNotExist(err) {
+			if err := runCmd("cp", "--sparse=always", path, copied+".tmp"); err != nil {
+				return "", err
+			}
+			if err := os.Rename(copied+".tmp", copied); err != nil {
+				return "", err
+			}
+		}
+		path = copied
+		if fi, err = os.Stat(path); err != nil {
+			return "", err
+		}
+	}
+
+	if fi.Size() >= sizeMB*mib {
+		return path, nil
+	}
+	if err := growExt4(path, sizeMB); err != nil {
+		return "", fmt.Errorf("Fail to grow root filesystem: %v", err)
+	}
+	return path, nil
+}
+
+// growExt4 extends the image file and resizes the ext4 filesystem it holds
+// to fill it, without mounting it.
+func growExt4(path string, sizeMB int64) error {
+	ok, err := isExt4(path)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errRootfsNotResizable
+	}
+
+	if err := os.Truncate(path, sizeMB*mib); err != nil {
+		return err
+	}
+
+	// resize2fs insists on a freshly checked filesystem. e2fsck exits with
+	// 1 when it fixed something, which is fine here.
+	out, err := exec.Command("e2fsck", "-f", "-y", path).CombinedOutput()
+	if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() > 1 {
+		return fmt.Errorf("e2fsck failed: %v: %s", err, strings.TrimSpace(string(out)))
+	} else if err != nil && !ok {
+		return err
+	}
+	return runCmd("resize2fs", path)
+}
+
+func isExt4(path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	magic := make([]byte, 2)
+	if _, err := f.ReadAt(magic, ext4MagicOffset); err != nil {
+		return false, err
+	}
+	return binary.LittleEndian.Uint16(magic) == ext4Magic, nil
+}
@@ -0,0 +1,109 @@
+/* Firecracker-task-driver is a task driver for Hashicorp's nomad that allows
+ * to create microvms using AWS Firecracker vmm
+ * Copyright (C) 2019  Carlos Neira cneirabustos@gmail.com
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ */
+
+package firevm
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestDiskSizes(t *testing.T) {
+	scratch := []ScratchDisk{{SizeMB: 100}, {SizeMB: 50}}
+	cases := []struct {
+		name   string
+		config TaskConfig
+		diskMB int64
+		want   int64
+		err    error
+		ok     bool
+	}{
+		{"no disks", TaskConfig{}, 0, 0, nil, true},
+		{"fixed size", TaskConfig{RootfsSizeMB: 2048}, 0, 2048, nil, true},
+		{"fixed size within ephemeral_disk", TaskConfig{RootfsSizeMB: 2048, ScratchDisks: scratch}, 4096, 2048, nil, true},
+		{"grow", TaskConfig{GrowRootfs: true}, 4096, 4096, nil, true},
+		{"grow leaves room for scratch disks", TaskConfig{GrowRootfs: true, ScratchDisks: scratch}, 4096, 3946, nil, true},
+		{"grow without ephemeral_disk", TaskConfig{GrowRootfs: true}, 0, 0, errUnknownEphemeralDisk, false},
+		{"negative size", TaskConfig{RootfsSizeMB: -1}, 0, 0, errInvalidRootfsSize, false},
+		{"scratch disks fill ephemeral_disk", TaskConfig{GrowRootfs: true, ScratchDisks: scratch}, 100, 0, errInvalidRootfsSize, false},
+		{"too large", TaskConfig{RootfsSizeMB: 4000, ScratchDisks: scratch}, 4096, 0, nil, false},
+	}
+	for _, c := range cases {
+		got, err := diskSizes(c.config, c.diskMB)
+		if (err == nil) != c.ok || (c.err != nil && err != c.err) {
+			t.Errorf("%s: got error %v, want %v", c.name, err, c.err)
+			continue
+		}
+		if got != c.want {
+			t.Errorf("%s: got %d MB, want %d MB", c.name, got, c.want)
+		}
+	}
+}
+
+func TestGrowExt4(t *testing.T) {
+	for _, cmd := range []string{"mkfs.ext4", "e2fsck", "resize2fs"} {
+		if _, err := exec.LookPath(cmd); err != nil {
+			t.Skipf("%s is not installed", cmd)
+		}
+	}
+	dir := t.TempDir()
+	image := filepath.Join(dir, "rootfs.ext4")
+	if err := createSparseFile(image, 16); err != nil {
+		t.Fatal(err)
+	}
+	if err := runCmd("mkfs.ext4", "-q", "-F", image); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := growExt4(image, 64); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != 64*mib {
+		t.Errorf("got image size %d, want %d", fi.Size(), 64*mib)
+	}
+	if ok, err := isExt4(image); !ok || err != nil {
+		t.Errorf("grown image is not ext4: %v", err)
+	}
+	// the filesystem fills the image, not only the file
+	out, err := exec.Command("dumpe2fs", "-h", image).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var blocks, blockSize int64
+	for _, line := range strings.Split(string(out), "\n") {
+		k, v, _ := strings.Cut(line, ":")
+		switch k {
+		case "Block count":
+			blocks, _ = strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+		case "Block size":
+			blockSize, _ = strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+		}
+	}
+	if blocks*blockSize != 64*mib {
+		t.Errorf("got a filesystem of %d blocks of %d bytes, want %d bytes", blocks, blockSize, 64*mib)
+	}
+
+	raw := filepath.Join(dir, "raw.img")
+	if err := createSparseFile(raw, 16); err != nil {
+		t.Fatal(err)
+	}
+	if err := growExt4(raw, 64); err != errRootfsNotResizable {
+		t.Errorf("got error %v, want %v", err, errRootfsNotResizable)
+	}
+}
@@ -0,0 +1,105 @@
+/* Firecracker-task-driver is a task driver for Hashicorp's nomad that allows
+ * to create microvms using AWS Firecracker vmm
+ * Copyright (C) 2019  Carlos Neira cneirabustos@gmail.com
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ */
+
+package firevm
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+const (
+	// files of the runtime directory
+	runtimeSocket      = "firecracker.sock"
+	runtimeLogFifo     = "log.fifo"
+	runtimeMetricsFifo = "metrics.fifo"
+	runtimeInfo        = "info.json"
+	runtimeConsole     = "console"
+
+	// maxSocketPathLen is the longest path of a unix socket, sun_path
+	// holds 108 bytes with the terminating nul.
+	maxSocketPathLen = 107
+
+	// defaultRuntimeDir is the root of the runtime directories when the
+	// plugin config sets no runtime_dir.
+	defaultRuntimeDir = "/run/nomad-firecracker"
+)
+
+// runtimeDir holds the files of a running micro-vm: the api socket, the
+// fifos, the instance info and a link to the serial console. There is one
+// per task under the runtime root.
+type runtimeDir string
+
+// runtimeRoot returns the root of the runtime directories.
+func runtimeRoot(root string) string {
+	if root == "" {
+		return defaultRuntimeDir
+	}
+	return root
+}
+
+// taskRuntimeDir returns the runtime directory of the task. Its name is the
+// start of the allocation id and a hash of the allocation id and task name,
+// short whatever the task name so the socket path fits in sun_path.
+func taskRuntimeDir(root string, cfg *drivers.TaskConfig) runtimeDir {
+	sum := sha256.Sum256([]byte(cfg.AllocID + "/" + cfg.Name))
+	id := cfg.AllocID
+	if len(id) > 8 {
+		id = id[:8]
+	}
+	return runtimeDir(filepath.Join(runtimeRoot(root), id+"-"+hex.EncodeToString(sum[:4])))
+}
+
+// createRuntimeDir creates the runtime directory of the task, only
+// accessible by the plugin. What a previous run left is removed first, unless
+// its micro-vm still runs: its socket and fifos are the only way to it.
+func createRuntimeDir(root string, cfg *drivers.TaskConfig) (runtimeDir, error) {
+	r := taskRuntimeDir(root, cfg)
+	if len(r.path(runtimeSocket)) > maxSocketPathLen {
+		return r, errRuntimeDirTooLong
+	}
+	if info, live := liveVMM(r, cfg.ID); live {
+		return r, fmt.Errorf("%w (pid %s)", errRuntimeDirInUse, info.Pid)
+	}
+	if err := r.remove(); err != nil {
+		return r, err
+	}
+	if err := os.MkdirAll(string(r), 0700); err != nil {
+		return r, fmt.Errorf("Fail to create runtime directory: %v", err)
+	}
+	// MkdirAll leaves an existing parent alone, the umask may loosen the mode
+	if err := os.Chmod(string(r), 0700); err != nil {
+		return r, fmt.Errorf("Fail to create runtime directory: %v", err)
+	}
+	return r, nil
+}
+
+func (r runtimeDir) path(name string) string {
+	return filepath.Join(string(r), name)
+}
+
+// linkConsole links the pty of the serial console, its number changes with
+// every start.
+func (r runtimeDir) linkConsole(pty string) error {
+	return os.Symlink(pty, r.path(runtimeConsole))
+}
+
+func (r runtimeDir) remove() error {
+	if err := os.RemoveAll(string(r)); err != nil {
+		return fmt.Errorf("Fail to remove runtime directory: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+/* Firecracker-task-driver is a task driver for Hashicorp's nomad that allows
+ * to create microvms using AWS Firecracker vmm
+ * Copyright (C) 2019  Carlos Neira cneirabustos@gmail.com
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ */
+
+package firevm
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+func TestTaskRuntimeDir(t *testing.T) {
+	alloc := "590983f4-499a-380f-420e-e5be4d5f46d9"
+	long := &drivers.TaskConfig{AllocID: alloc, Name: strings.Repeat("a-very-long-task-name", 10)}
+	other := &drivers.TaskConfig{AllocID: alloc, Name: "other"}
+
+	r := taskRuntimeDir("", long)
+	if !strings.HasPrefix(string(r), defaultRuntimeDir+"/590983f4-") {
+		t.Errorf("runtime dir %s not under %s", r, defaultRuntimeDir)
+	}
+	if n := len(r.path(runtimeSocket)); n > maxSocketPathLen {
+		t.Errorf("socket path is %d bytes, longer than %d", n, maxSocketPathLen)
+	}
+	if r == taskRuntimeDir("", other) {
+		t.Errorf("tasks of an allocation share the runtime dir %s", r)
+	}
+	if got := taskRuntimeDir("/srv/fc", other); !strings.HasPrefix(string(got), "/srv/fc/") {
+		t.Errorf("runtime_dir ignored: %s", got)
+	}
+}
+
+func TestCreateRuntimeDir(t *testing.T) {
+	cmd := startTaggedProcess(t, "task-1")
+
+	cases := []struct {
+		name  string
+		pid   string
+		inUse bool
+	}{
+		{"micro-vm running", strconv.Itoa(cmd.Process.Pid), true},
+		{"micro-vm gone", strconv.Itoa(os.Getpid()), false},
+		{"no info", "", false},
+	}
+	for _, c := range cases {
+		root := t.TempDir()
+		cfg := &drivers.TaskConfig{ID: "task-1", AllocID: "590983f4-499a-380f-420e-e5be4d5f46d9", Name: "web"}
+		r := taskRuntimeDir(root, cfg)
+		if err := os.MkdirAll(string(r), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if c.pid != "" {
+			b, _ := json.Marshal(Instance_info{Pid: c.pid})
+			if err := os.WriteFile(r.path(runtimeInfo), b, 0600); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := os.WriteFile(r.path(runtimeSocket), nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := createRuntimeDir(root, cfg)
+		if got != r {
+			t.Errorf("%s: got dir %s, want %s", c.name, got, r)
+		}
+		_, statErr := os.Stat(r.path(runtimeSocket))
+		if c.inUse {
+			if !errors.Is(err, errRuntimeDirInUse) {
+				t.Errorf("%s: got error %v, want %v", c.name, err, errRuntimeDirInUse)
+			}
+			if statErr != nil {
+				t.Errorf("%s: socket of the running micro-vm removed", c.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+		}
+		if statErr == nil {
+			t.Errorf("%s: what the previous run left was kept", c.name)
+		}
+		if fi, err := os.Stat(string(r)); err != nil || fi.Mode().Perm() != 0700 {
+			t.Errorf("%s: runtime dir %v, %v", c.name, fi, err)
+		}
+	}
+}
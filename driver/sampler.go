@@ -0,0 +1,363 @@
+/* Firecracker-task-driver is a task driver for Hashicorp's nomad that allows
+ * to create microvms using AWS Firecracker vmm
+ * Copyright (C) 2019  Carlos Neira cneirabustos@gmail.com
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ */
+
+package firevm
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	metrics "github.com/armon/go-metrics"
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad/client/lib/cpustats"
+	"github.com/hashicorp/nomad/plugins/base"
+	"github.com/hashicorp/nomad/plugins/drivers"
+	"github.com/shirou/gopsutil/process"
+)
+
+const (
+	// vmmThreads is the key of the usage of the threads other than the
+	// vcpus: the api, the device emulation and the main thread.
+	vmmThreads = "vmm"
+
+	// guestStatsTimeout bounds the request of the balloon statistics.
+	guestStatsTimeout = 2 * time.Second
+)
+
+// cpuTrackers computes the cpu percentages of a thread or a group of
+// threads.
+type cpuTrackers struct {
+	sys, user, total, steal *cpustats.Tracker
+}
+
+func newCPUTrackers(compute cpustats.Compute) *cpuTrackers {
+	return &cpuTrackers{
+		sys:   cpustats.New(compute),
+		user:  cpustats.New(compute),
+		total: cpustats.New(compute),
+		steal: cpustats.New(compute),
+	}
+}
+
+// stats returns the cpu stats of times given in seconds.
+func (t *cpuTrackers) stats(system, user float64) *drivers.CpuStats {
+	percent := t.total.Percent((system + user) * float64(time.Second))
+	return &drivers.CpuStats{
+		SystemMode: t.sys.Percent(system * float64(time.Second)),
+		UserMode:   t.user.Percent(user * float64(time.Second)),
+		Percent:    percent,
+		TotalTicks: t.total.TicksConsumed(percent),
+		Measured:   firecrackerCPUStats,
+	}
+}
+
+// statsSubscriber is a TaskStats caller, it gets a sample every interval.
+type statsSubscriber struct {
+	ch       chan *drivers.TaskResourceUsage
+	interval time.Duration
+	next     time.Time
+}
+
+// send hands the sample over without waiting for the subscriber, a sample
+// it hasn't read yet is replaced.
+func (s *statsSubscriber) send(usage *drivers.TaskResourceUsage) {
+	for {
+		select {
+		case s.ch <- usage:
+			return
+		default:
+		}
+		select {
+		case <-s.ch:
+		default:
+		}
+	}
+}
+
+// vmSampler samples the resource usage of a firecracker process for all the
+// TaskStats callers of the task. It runs while there are subscribers, at the
+// shortest of their intervals, and never takes the lock of the task handle.
+type vmSampler struct {
+	logger  hclog.Logger
+	pid     int
+	guest   guestStatsFunc
+	compute cpustats.Compute
+	labels  []metrics.Label
+
+	// used by the sampling goroutine only
+	proc    *process.Process
+	total   *cpuTrackers
+	threads map[string]*cpuTrackers
+
+	lock    sync.Mutex
+	subs    map[*statsSubscriber]bool
+	running bool
+	stopped bool
+	kick    chan struct{}
+	stopCh  chan struct{}
+}
+
+// hostCompute is the cpu of the host the percentages are relative to, from
+// the topology nomad fingerprinted when it passed it.
+func hostCompute(config *base.ClientDriverConfig) cpustats.Compute {
+	if config != nil && config.Topology != nil {
+		return config.Topology.Compute()
+	}
+	return cpustats.Compute{NumCores: runtime.NumCPU()}
+}
+
+// newVMSampler returns the sampler of the firecracker process pid, guest
+// returns the memory statistics of the guest when it has a balloon.
+func newVMSampler(pid string, guest guestStatsFunc, compute cpustats.Compute, cfg *drivers.TaskConfig, logger hclog.Logger) *vmSampler {
+	p, err := strconv.Atoi(pid)
+	if err != nil {
+		logger.Error("unable to convert pid to int, stats are disabled", "pid", pid, "task_id", cfg.ID)
+	}
+	return &vmSampler{
+		logger:  logger.With("task_id", cfg.ID),
+		pid:     p,
+		guest:   guest,
+		compute: compute,
+		labels:  taskMetricLabels(cfg),
+		total:   newCPUTrackers(compute),
+		threads: map[string]*cpuTrackers{},
+		subs:    map[*statsSubscriber]bool{},
+		kick:    make(chan struct{}, 1),
+		stopCh:  make(chan struct{}),
+	}
+}
+
+// subscribe returns a channel getting a sample every interval until ctx is
+// done or the sampler is stopped.
+func (s *vmSampler) subscribe(ctx context.Context, interval time.Duration) <-chan *drivers.TaskResourceUsage {
+	sub := &statsSubscriber{ch: make(chan *drivers.TaskResourceUsage, 1), interval: interval}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.stopped {
+		close(sub.ch)
+		return sub.ch
+	}
+	s.subs[sub] = true
+	if !s.running {
+		s.running = true
+		go s.run()
+	} else {
+		select {
+		case s.kick <- struct{}{}:
+		default:
+		}
+	}
+
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-s.stopCh:
+			return
+		}
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		if s.subs[sub] {
+			delete(s.subs, sub)
+			close(sub.ch)
+		}
+	}()
+	return sub.ch
+}
+
+// stop closes the channels of the subscribers, the micro-vm is gone.
+func (s *vmSampler) stop() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.stopped {
+		return
+	}
+	s.stopped = true
+	close(s.stopCh)
+	for sub := range s.subs {
+		delete(s.subs, sub)
+		close(sub.ch)
+	}
+}
+
+func (s *vmSampler) run() {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-s.stopCh:
+			return
+		case <-s.kick:
+		case <-timer.C:
+		}
+
+		s.lock.Lock()
+		if len(s.subs) == 0 {
+			s.running = false
+			s.lock.Unlock()
+			return
+		}
+		now := time.Now()
+		due := false
+		for sub := range s.subs {
+			if !now.Before(sub.next) {
+				due = true
+			}
+		}
+		s.lock.Unlock()
+
+		var usage *drivers.TaskResourceUsage
+		if due {
+			usage = s.sample()
+		}
+
+		s.lock.Lock()
+		wait := time.Duration(-1)
+		for sub := range s.subs {
+			if usage != nil && !now.Before(sub.next) {
+				sub.next = now.Add(sub.interval)
+				sub.send(usage)
+			}
+			if left := sub.next.Sub(time.Now()); wait < 0 || left < wait {
+				wait = left
+			}
+		}
+		s.lock.Unlock()
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		if wait < 0 {
+			wait = 0
+		}
+		timer.Reset(wait)
+	}
+}
+
+// sample returns the usage of the firecracker process, with the vcpu
+// threads and the other threads of the vmm broken down by pid key.
+func (s *vmSampler) sample() *drivers.TaskResourceUsage {
+	t := time.Now()
+	usage := &drivers.TaskResourceUsage{
+		ResourceUsage: &drivers.ResourceUsage{
+			CpuStats:    &drivers.CpuStats{},
+			MemoryStats: &drivers.MemoryStats{},
+		},
+		Timestamp: t.UTC().UnixNano(),
+	}
+	if s.pid == 0 {
+		return usage
+	}
+	if s.proc == nil {
+		p, err := process.NewProcess(int32(s.pid))
+		if err != nil {
+			s.logger.Error("unable to find the firecracker process", "pid", s.pid, "error", err)
+			return usage
+		}
+		s.proc = p
+	}
+
+	if memInfo, err := s.proc.MemoryInfo(); err == nil {
+		usage.ResourceUsage.MemoryStats.RSS = memInfo.RSS
+		usage.ResourceUsage.MemoryStats.Swap = memInfo.Swap
+		usage.ResourceUsage.MemoryStats.Measured = firecrackerMemStats
+	}
+	if s.guest != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), guestStatsTimeout)
+		stats, err := s.guest(ctx)
+		cancel()
+		if err == nil && mergeGuestMemory(usage.ResourceUsage.MemoryStats, stats) {
+			metrics.SetGaugeWithLabels([]string{"firecracker", "guest", "memory", "free"}, float32(stats.FreeMemory), s.labels)
+			metrics.SetGaugeWithLabels([]string{"firecracker", "guest", "memory", "available"}, float32(stats.AvailableMemory), s.labels)
+		} else if err != nil {
+			s.logger.Debug("unable to read the guest memory statistics", "error", err)
+		}
+	}
+	if times, err := s.proc.Times(); err == nil {
+		usage.ResourceUsage.CpuStats = s.total.stats(times.System, times.User)
+	}
+	if pids, err := s.threadStats(); err == nil {
+		usage.Pids = pids
+	} else {
+		s.logger.Debug("unable to read the firecracker threads", "error", err)
+	}
+	return usage
+}
+
+// threadStats returns the cpu usage of each vcpu thread, keyed vcpu<n>,
+// and of the other threads together. The time a vcpu waited for a host cpu,
+// the steal time seen by the guest, is only exported as a gauge: the
+// throttled time of the cpu stats is the cfs throttling of the cgroup.
+func (s *vmSampler) threadStats() (map[string]*drivers.ResourceUsage, error) {
+	threads, err := s.proc.Threads()
+	if err != nil {
+		return nil, err
+	}
+	type cpuTimes struct {
+		system, user float64
+		waited       uint64
+	}
+	groups := map[string]*cpuTimes{}
+	for tid, times := range threads {
+		key := vmmThreads
+		if name := threadName(s.pid, int(tid)); strings.HasPrefix(name, vcpuThreadPrefix) {
+			key = "vcpu" + strings.TrimPrefix(name, vcpuThreadPrefix)
+		}
+		if groups[key] == nil {
+			groups[key] = &cpuTimes{}
+		}
+		groups[key].system += times.System
+		groups[key].user += times.User
+		groups[key].waited += threadWaitTime(s.pid, int(tid))
+	}
+
+	pids := map[string]*drivers.ResourceUsage{}
+	for key, times := range groups {
+		tr, ok := s.threads[key]
+		if !ok {
+			tr = newCPUTrackers(s.compute)
+			s.threads[key] = tr
+		}
+		cs := tr.stats(times.system, times.user)
+		pids[key] = &drivers.ResourceUsage{CpuStats: cs, MemoryStats: &drivers.MemoryStats{}}
+		if strings.HasPrefix(key, "vcpu") {
+			steal := tr.steal.Percent(float64(times.waited))
+			labels := append(append([]metrics.Label{}, s.labels...), metrics.Label{Name: "vcpu", Value: strings.TrimPrefix(key, "vcpu")})
+			metrics.SetGaugeWithLabels([]string{"firecracker", "vcpu", "cpu_percent"}, float32(cs.Percent), labels)
+			metrics.SetGaugeWithLabels([]string{"firecracker", "vcpu", "steal_percent"}, float32(steal), labels)
+		}
+	}
+	return pids, nil
+}
+
+// threadWaitTime returns the nanoseconds a thread spent runnable waiting
+// for a cpu, from its schedstat.
+func threadWaitTime(pid, tid int) uint64 {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/task/%d/schedstat", pid, tid))
+	if err != nil {
+		return 0
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) < 2 {
+		return 0
+	}
+	waited, _ := strconv.ParseUint(fields[1], 10, 64)
+	return waited
+}
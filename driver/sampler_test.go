@@ -0,0 +1,136 @@
+/* Firecracker-task-driver is a task driver for Hashicorp's nomad that allows
+ * to create microvms using AWS Firecracker vmm
+ * Copyright (C) 2019  Carlos Neira cneirabustos@gmail.com
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ */
+
+package firevm
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad/client/lib/cpustats"
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+// newTestSampler returns a sampler without process, its samples are empty
+// and cheap.
+func newTestSampler() *vmSampler {
+	cfg := &drivers.TaskConfig{ID: "task", AllocID: "alloc", Name: "web"}
+	return newVMSampler("0", nil, cpustats.Compute{NumCores: 1}, cfg, hclog.NewNullLogger())
+}
+
+// count reads ch for d and returns how many samples came and whether the
+// channel got closed.
+func count(ch <-chan *drivers.TaskResourceUsage, d time.Duration) (n int, closed bool) {
+	timeout := time.After(d)
+	for {
+		select {
+		case _, ok := <-ch:
+			if !ok {
+				return n, true
+			}
+			n++
+		case <-timeout:
+			return n, false
+		}
+	}
+}
+
+func TestSamplerFanOut(t *testing.T) {
+	s := newTestSampler()
+	defer s.stop()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	fast := s.subscribe(ctx, 20*time.Millisecond)
+	slow := s.subscribe(ctx, 250*time.Millisecond)
+
+	fastN := make(chan int, 1)
+	go func() {
+		n, _ := count(fast, 600*time.Millisecond)
+		fastN <- n
+	}()
+	nSlow, _ := count(slow, 600*time.Millisecond)
+	nFast := <-fastN
+
+	// each subscriber gets a sample right away, then one per interval
+	if nSlow < 2 || nSlow > 4 {
+		t.Errorf("slow subscriber got %d samples in 600ms at 250ms", nSlow)
+	}
+	if nFast < 10 {
+		t.Errorf("fast subscriber got %d samples in 600ms at 20ms", nFast)
+	}
+}
+
+func TestSamplerUnsubscribe(t *testing.T) {
+	s := newTestSampler()
+	defer s.stop()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := s.subscribe(ctx, 10*time.Millisecond)
+	if n, _ := count(ch, 50*time.Millisecond); n == 0 {
+		t.Fatal("no sample")
+	}
+	cancel()
+	if _, closed := count(ch, time.Second); !closed {
+		t.Fatal("channel not closed once the caller is done")
+	}
+
+	// the sampling goroutine exits without subscribers
+	deadline := time.Now().Add(time.Second)
+	for {
+		s.lock.Lock()
+		running := s.running
+		s.lock.Unlock()
+		if !running {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("sampler still running without subscribers")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// a new caller starts it again
+	ch = s.subscribe(context.Background(), time.Hour)
+	if n, _ := count(ch, 200*time.Millisecond); n != 1 {
+		t.Errorf("got %d samples, want the first one right away", n)
+	}
+}
+
+func TestSamplerStop(t *testing.T) {
+	s := newTestSampler()
+	a := s.subscribe(context.Background(), time.Hour)
+	b := s.subscribe(context.Background(), time.Hour)
+	s.stop()
+	s.stop()
+	for _, ch := range []<-chan *drivers.TaskResourceUsage{a, b} {
+		if _, closed := count(ch, time.Second); !closed {
+			t.Error("channel not closed by stop")
+		}
+	}
+	if _, closed := count(s.subscribe(context.Background(), time.Second), time.Second); !closed {
+		t.Error("subscription after stop not closed")
+	}
+}
+
+func TestSubscriberSend(t *testing.T) {
+	sub := &statsSubscriber{ch: make(chan *drivers.TaskResourceUsage, 1)}
+	first := &drivers.TaskResourceUsage{Timestamp: 1}
+	second := &drivers.TaskResourceUsage{Timestamp: 2}
+	sub.send(first)
+	// a slow caller gets the latest sample, the sampler never waits
+	sub.send(second)
+	if got := <-sub.ch; got != second {
+		t.Errorf("got sample %d, want %d", got.Timestamp, second.Timestamp)
+	}
+}
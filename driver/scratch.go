@@ -0,0 +1,155 @@
+/* Firecracker-task-driver is a task driver for Hashicorp's nomad that allows
+ * to create microvms using AWS Firecracker vmm
+ * Copyright (C) 2019  Carlos Neira cneirabustos@gmail.com
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ */
+
+package firevm
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	firecracker "github.com/firecracker-microvm/firecracker-go-sdk"
+	models "github.com/firecracker-microvm/firecracker-go-sdk/client/models"
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+const (
+	fsTypeExt4 = "ext4"
+	fsTypeXfs  = "xfs"
+	fsTypeRaw  = "raw"
+)
+
+// maxLabelLen is the longest label mkfs takes for each filesystem.
+var maxLabelLen = map[string]int{
+	"":         16,
+	fsTypeExt4: 16,
+	fsTypeXfs:  12,
+}
+
+// scratchDrive is a throwaway disk created in the alloc dir for the life of
+// the task.
+type scratchDrive struct {
+	ID    string
+	Image string
+}
+
+func (s scratchDrive) drive() models.Drive {
+	return models.Drive{
+		DriveID:      firecracker.String(s.ID),
+		PathOnHost:   firecracker.String(s.Image),
+		IsReadOnly:   firecracker.Bool(false),
+		IsRootDevice: firecracker.Bool(false),
+	}
+}
+
+// prepareScratchDisks creates and formats the scratch disks of the task,
+// their sizes are checked against ephemeral_disk by diskSizes.
+func prepareScratchDisks(cfg *drivers.TaskConfig, disks []ScratchDisk) ([]scratchDrive, error) {
+	if len(disks) == 0 {
+		return nil, nil
+	}
+
+	names := map[string]bool{}
+	for i, disk := range disks {
+		if disk.SizeMB <= 0 {
+			return nil, errInvalidScratchDiskSize
+		}
+		switch disk.FsType {
+		case "", fsTypeExt4, fsTypeXfs, fsTypeRaw:
+		default:
+			return nil, errInvalidScratchDiskFsType
+		}
+		if disk.Label != "" && !validDiskName.MatchString(disk.Label) {
+			return nil, errInvalidScratchDiskLabel
+		}
+		if n, ok := maxLabelLen[disk.FsType]; ok && len(disk.Label) > n {
+			return nil, fmt.Errorf("%w: %s takes at most %d characters", errScratchDiskLabelTooLong, fsTypeName(disk.FsType), n)
+		}
+		name := scratchDiskName(i, disk)
+		if names[name] {
+			return nil, fmt.Errorf("Duplicate scratch disk %s", name)
+		}
+		names[name] = true
+	}
+
+	imageDir, err := taskImageDir(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	var drives []scratchDrive
+	for i, disk := range disks {
+		name := scratchDiskName(i, disk)
+		s := scratchDrive{
+			ID:    "scratch_" + name,
+			Image: filepath.Join(imageDir, "scratch-"+name+".img"),
+		}
+
+		// the disk survives a plugin restart, never reformat it under a
+		// running vm.
+		if _, err := os.Stat(s.Image); err == nil {
+			drives = append(drives, s)
+			continue
+		}
+		if err := createScratchDisk(s.Image, disk); err != nil {
+			os.Remove(s.Image)
+			return nil, fmt.Errorf("Fail to create scratch disk %s: %v", name, err)
+		}
+		drives = append(drives, s)
+	}
+	return drives, nil
+}
+
+// fsTypeName is the filesystem of a disk, ext4 when fs_type is unset.
+func fsTypeName(fsType string) string {
+	if fsType == "" {
+		return fsTypeExt4
+	}
+	return fsType
+}
+
+// scratchDiskName names the drive and the image of a scratch disk, its label
+// or its index in the task config.
+func scratchDiskName(i int, disk ScratchDisk) string {
+	if disk.Label != "" {
+		return disk.Label
+	}
+	return strconv.Itoa(i)
+}
+
+func createScratchDisk(image string, disk ScratchDisk) error {
+	if err := createSparseFile(image, disk.SizeMB); err != nil {
+		return err
+	}
+	switch disk.FsType {
+	case fsTypeRaw:
+		return nil
+	case fsTypeXfs:
+		args := []string{"-q", "-f"}
+		if disk.Label != "" {
+			args = append(args, "-L", disk.Label)
+		}
+		return runCmd("mkfs.xfs", append(args, image)...)
+	default:
+		return mkfsExt4(image, disk.Label, "")
+	}
+}
+
+// removeScratchDisks deletes the scratch disks of a destroyed task.
+func removeScratchDisks(drives []scratchDrive) error {
+	for _, s := range drives {
+		if err := os.Remove(s.Image); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
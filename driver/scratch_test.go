@@ -0,0 +1,89 @@
+/* Firecracker-task-driver is a task driver for Hashicorp's nomad that allows
+ * to create microvms using AWS Firecracker vmm
+ * Copyright (C) 2019  Carlos Neira cneirabustos@gmail.com
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ */
+
+package firevm
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+func TestPrepareScratchDisksInvalid(t *testing.T) {
+	cases := []struct {
+		name  string
+		disks []ScratchDisk
+		err   error
+	}{
+		{"size", []ScratchDisk{{SizeMB: 0}}, errInvalidScratchDiskSize},
+		{"fs type", []ScratchDisk{{SizeMB: 1, FsType: "btrfs"}}, errInvalidScratchDiskFsType},
+		{"path", []ScratchDisk{{SizeMB: 1, Label: "../../x"}}, errInvalidScratchDiskLabel},
+		{"drive id", []ScratchDisk{{SizeMB: 1, Label: "a.b"}}, errInvalidScratchDiskLabel},
+		{"duplicate label", []ScratchDisk{{SizeMB: 1, Label: "data"}, {SizeMB: 1, Label: "data"}}, nil},
+		{"label and index", []ScratchDisk{{SizeMB: 1}, {SizeMB: 1, Label: "0"}}, nil},
+		{"xfs label", []ScratchDisk{{SizeMB: 1, FsType: "xfs", Label: "thirteen-char"}}, errScratchDiskLabelTooLong},
+		{"ext4 label", []ScratchDisk{{SizeMB: 1, FsType: "ext4", Label: "seventeen-chars-x"}}, errScratchDiskLabelTooLong},
+		{"default fs label", []ScratchDisk{{SizeMB: 1, Label: "seventeen-chars-x"}}, errScratchDiskLabelTooLong},
+	}
+	for _, c := range cases {
+		_, err := prepareScratchDisks(nil, c.disks)
+		if err == nil {
+			t.Errorf("%s: no error", c.name)
+			continue
+		}
+		if c.err != nil && !errors.Is(err, c.err) {
+			t.Errorf("%s: got %v, want %v", c.name, err, c.err)
+		}
+	}
+}
+
+func TestPrepareScratchDisks(t *testing.T) {
+	cfg := &drivers.TaskConfig{AllocDir: t.TempDir(), Name: "web"}
+	disks := []ScratchDisk{
+		{SizeMB: 2, FsType: "raw"},
+		// raw disks have no filesystem, their label only names the drive
+		{SizeMB: 1, FsType: "raw", Label: "a-label-longer-than-16"},
+	}
+	drives, err := prepareScratchDisks(cfg, disks)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	imageDir := filepath.Join(cfg.TaskDir().Dir, "images")
+	want := []scratchDrive{
+		{ID: "scratch_0", Image: filepath.Join(imageDir, "scratch-0.img")},
+		{ID: "scratch_a-label-longer-than-16", Image: filepath.Join(imageDir, "scratch-a-label-longer-than-16.img")},
+	}
+	for i, d := range drives {
+		if d != want[i] {
+			t.Errorf("drive %d: got %+v, want %+v", i, d, want[i])
+		}
+		fi, err := os.Stat(d.Image)
+		if err != nil || fi.Size() != disks[i].SizeMB*mib {
+			t.Errorf("image %s: %v, %v", d.Image, fi, err)
+		}
+	}
+
+	if err := removeScratchDisks(drives); err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range drives {
+		if _, err := os.Stat(d.Image); !os.IsNotExist(err) {
+			t.Errorf("image %s left behind", d.Image)
+		}
+	}
+	if err := removeScratchDisks(drives); err != nil {
+		t.Errorf("removing disks already gone: %v", err)
+	}
+}
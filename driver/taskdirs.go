@@ -0,0 +1,337 @@
+/* Firecracker-task-driver is a task driver for Hashicorp's nomad that allows
+ * to create microvms using AWS Firecracker vmm
+ * Copyright (C) 2019  Carlos Neira cneirabustos@gmail.com
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ */
+
+package firevm
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	firecracker "github.com/firecracker-microvm/firecracker-go-sdk"
+	models "github.com/firecracker-microvm/firecracker-go-sdk/client/models"
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+const (
+	taskDirFormatExt4 = "ext4"
+	taskDirFormatRaw  = "raw"
+
+	// taskDirMinImageMB is the smallest image created for a task directory,
+	// mkfs needs some room for its own metadata even for an empty dir.
+	taskDirMinImageMB = 8
+
+	// taskDirWritableSlackMB is the free space given to the guest on the
+	// writable alloc drive.
+	taskDirWritableSlackMB = 64
+
+	// tmpfsMagic is the statfs type of a tmpfs.
+	tmpfsMagic = 0x01021994
+)
+
+// allocDirSkip lists the entries of alloc/ that are never exposed to the vm,
+// logs holds the fifos nomad uses to collect task output.
+var allocDirSkip = map[string]bool{"logs": true}
+
+// taskDirDrive is a task directory packed into an image and attached to the
+// micro-vm as a drive.
+type taskDirDrive struct {
+	ID        string
+	Name      string
+	HostDir   string
+	MountPath string
+	Image     string
+	Format    string
+	ReadOnly  bool
+}
+
+// drive returns the firecracker drive for the image.
+func (t taskDirDrive) drive() models.Drive {
+	return models.Drive{
+		DriveID:      firecracker.String(t.ID),
+		PathOnHost:   firecracker.String(t.Image),
+		IsReadOnly:   firecracker.Bool(t.ReadOnly),
+		IsRootDevice: firecracker.Bool(false),
+	}
+}
+
+// prepareTaskDirs packs the task directories selected in the task config
+// into images stored in the task directory. Drive ids are well known so
+// guests can tell them apart: task_local, task_secrets, task_alloc. The
+// secrets never reach a disk, their image is in the runtime directory which
+// must be on a tmpfs, like the secrets directory nomad creates.
+func prepareTaskDirs(cfg *drivers.TaskConfig, td TaskDirs, runDir runtimeDir) ([]taskDirDrive, error) {
+	if len(td.Dirs) == 0 {
+		return nil, nil
+	}
+
+	format := td.Format
+	if format == "" {
+		format = taskDirFormatExt4
+	}
+	if format != taskDirFormatExt4 && format != taskDirFormatRaw {
+		return nil, errInvalidTaskDirFormat
+	}
+
+	dirs := cfg.TaskDir()
+	hostDirs := map[string]string{
+		"local":   dirs.LocalDir,
+		"secrets": dirs.SecretsDir,
+		"alloc":   dirs.SharedAllocDir,
+	}
+
+	imageDir, err := taskImageDir(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	var drives []taskDirDrive
+	seen := map[string]bool{}
+	for _, name := range td.Dirs {
+		hostDir, ok := hostDirs[name]
+		if !ok {
+			return nil, errInvalidTaskDir
+		}
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+
+		dir := imageDir
+		if name == "secrets" {
+			if err := checkTmpfs(string(runDir)); err != nil {
+				return nil, err
+			}
+			dir = string(runDir)
+		}
+		t := taskDirDrive{
+			ID:        "task_" + name,
+			Name:      name,
+			HostDir:   hostDir,
+			MountPath: "/" + name,
+			Image:     filepath.Join(dir, name+"."+format),
+			Format:    format,
+			ReadOnly:  !(name == "alloc" && td.SyncAlloc),
+		}
+		if err := t.build(); err != nil {
+			return nil, fmt.Errorf("Fail to pack task dir %s: %v", name, err)
+		}
+		drives = append(drives, t)
+	}
+	return drives, nil
+}
+
+// taskImageDir returns the directory holding the images the driver builds
+// for a task, creating it if needed.
+func taskImageDir(cfg *drivers.TaskConfig) (string, error) {
+	dir := filepath.Join(cfg.TaskDir().Dir, "images")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", fmt.Errorf("Fail to create image directory: %v", err)
+	}
+	return dir, nil
+}
+
+// checkTmpfs fails unless dir is on a tmpfs.
+func checkTmpfs(dir string) error {
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(dir, &fs); err != nil {
+		return fmt.Errorf("Fail to stat filesystem of %s: %v", dir, err)
+	}
+	if fs.Type != tmpfsMagic {
+		return errSecretsNotOnTmpfs
+	}
+	return nil
+}
+
+// skip returns the top level entries of the host directory that are not
+// packed into the image.
+func (t taskDirDrive) skip() map[string]bool {
+	if t.ID == "task_alloc" {
+		return allocDirSkip
+	}
+	return nil
+}
+
+// build writes the contents of the host directory into the image.
+func (t taskDirDrive) build() error {
+	skip := t.skip()
+
+	size, err := dirSize(t.HostDir)
+	if err != nil {
+		return err
+	}
+	sizeMB := size*5/4/mib + 1
+	if !t.ReadOnly {
+		sizeMB += taskDirWritableSlackMB
+	}
+	if sizeMB < taskDirMinImageMB {
+		sizeMB = taskDirMinImageMB
+	}
+
+	if err := createSparseFile(t.Image, sizeMB); err != nil {
+		return err
+	}
+
+	if t.Format == taskDirFormatRaw {
+		return writeTarImage(t.HostDir, t.Image, skip)
+	}
+
+	src := t.HostDir
+	if skip != nil {
+		staging, err := os.MkdirTemp(filepath.Dir(t.Image), t.Name)
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(staging)
+		if err := copyTree(t.HostDir, staging, skip); err != nil {
+			return err
+		}
+		src = staging
+	}
+	return mkfsExt4(t.Image, t.Name, src)
+}
+
+// sync copies the contents of a writable image back into the host directory.
+// Files removed by the guest are left in place on the host.
+func (t taskDirDrive) sync() error {
+	if t.ReadOnly {
+		return nil
+	}
+
+	staging, err := os.MkdirTemp(filepath.Dir(t.Image), t.Name+"-sync")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(staging)
+
+	if t.Format == taskDirFormatRaw {
+		err = readTarImage(t.Image, staging)
+	} else {
+		err = runCmd("debugfs", "-R", fmt.Sprintf("rdump / %s", staging), t.Image)
+	}
+	if err != nil {
+		return err
+	}
+
+	skip := map[string]bool{"lost+found": true}
+	for k := range t.skip() {
+		skip[k] = true
+	}
+	return moveTree(staging, t.HostDir, skip)
+}
+
+// writeTarImage writes dir as a tar archive at the start of image, guests
+// read it back with tar -xf /dev/vdX.
+func writeTarImage(dir, image string, skip map[string]bool) error {
+	f, err := os.OpenFile(image, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	tw := tar.NewWriter(f)
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil || rel == "." {
+			return err
+		}
+		if skip[strings.SplitN(rel, string(filepath.Separator), 2)[0]] {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.Mode()&os.ModeSocket != 0 || info.Mode()&os.ModeNamedPipe != 0 {
+			return nil
+		}
+
+		var link string
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		}
+		hdr, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(rel)
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		src, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+		_, err = io.Copy(tw, src)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// readTarImage extracts the directories and the regular files of the tar
+// archive stored in image into dir. The archive is written by the guest, its
+// symlinks and other special files are left out.
+func readTarImage(image, dir string) error {
+	f, err := os.Open(image)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if _, err := mkdirInRoot(dir, hdr.Name, os.FileMode(hdr.Mode).Perm()); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if _, err := mkdirInRoot(dir, filepath.Dir(filepath.Clean("/"+hdr.Name)), 0755); err != nil {
+				return err
+			}
+			target, err := inRoot(dir, hdr.Name)
+			if err != nil {
+				return err
+			}
+			out, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC|syscall.O_NOFOLLOW, os.FileMode(hdr.Mode).Perm())
+			if err != nil {
+				return err
+			}
+			if _, err := io.Copy(out, tr); err != nil {
+				out.Close()
+				return err
+			}
+			out.Close()
+		}
+	}
+}
@@ -0,0 +1,68 @@
+/* Firecracker-task-driver is a task driver for Hashicorp's nomad that allows
+ * to create microvms using AWS Firecracker vmm
+ * Copyright (C) 2019  Carlos Neira cneirabustos@gmail.com
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ */
+
+package firevm
+
+import (
+	"archive/tar"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadTarImageSymlinks(t *testing.T) {
+	outside := t.TempDir()
+	image := filepath.Join(t.TempDir(), "alloc.raw")
+	f, err := os.Create(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tw := tar.NewWriter(f)
+	entries := []struct {
+		hdr  tar.Header
+		body string
+	}{
+		{hdr: tar.Header{Name: "x", Typeflag: tar.TypeSymlink, Linkname: outside}},
+		{hdr: tar.Header{Name: "x/passwd", Typeflag: tar.TypeReg, Mode: 0644}, body: "evil"},
+		{hdr: tar.Header{Name: "../../escape", Typeflag: tar.TypeReg, Mode: 0644}, body: "evil"},
+		{hdr: tar.Header{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0755}},
+		{hdr: tar.Header{Name: "dir/file", Typeflag: tar.TypeReg, Mode: 0644}, body: "ok"},
+	}
+	for _, e := range entries {
+		e.hdr.Size = int64(len(e.body))
+		if err := tw.WriteHeader(&e.hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	dir := t.TempDir()
+	if err := readTarImage(image, dir); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(outside, "passwd")); !os.IsNotExist(err) {
+		t.Errorf("file written through the guest symlink")
+	}
+	if fi, err := os.Lstat(filepath.Join(dir, "x")); err != nil || !fi.IsDir() {
+		t.Errorf("x should be a plain directory: %v", err)
+	}
+	for _, name := range []string{"escape", "dir/file", "x/passwd"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("%s not extracted in the directory: %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,388 @@
+/* Firecracker-task-driver is a task driver for Hashicorp's nomad that allows
+ * to create microvms using AWS Firecracker vmm
+ * Copyright (C) 2019  Carlos Neira cneirabustos@gmail.com
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ */
+
+package firevm
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	metrics "github.com/armon/go-metrics"
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+const (
+	// telemetryInterval is how often the gauges computed from the task
+	// store are emitted.
+	telemetryInterval = 10 * time.Second
+
+	promContentType = "text/plain; version=0.0.4; charset=utf-8"
+)
+
+var promEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// promBuckets are the upper bounds of the histograms, timings are in
+// milliseconds.
+var promBuckets = []float64{10, 50, 100, 250, 500, 1000, 2500, 5000, 10000, 30000, 60000}
+
+// TelemetryConfig sets where the metrics of the plugin go. They are kept
+// in memory and dropped when nothing is set.
+type TelemetryConfig struct {
+	PrometheusAddress string `codec:"prometheus_address"`
+	StatsdAddress     string `codec:"statsd_address"`
+	StatsiteAddress   string `codec:"statsite_address"`
+}
+
+// configureTelemetry sets up the metric sinks when the config differs from
+// the one in place, the sinks of the previous config are stopped first. The
+// config is only recorded once the setup succeeded, so a failed one is tried
+// again on the next SetConfig.
+func (d *Driver) configureTelemetry(config TelemetryConfig) error {
+	d.telemetryLock.Lock()
+	defer d.telemetryLock.Unlock()
+	if d.telemetry != nil && *d.telemetry == config {
+		return nil
+	}
+	if d.stopTelemetry != nil {
+		d.stopTelemetry()
+		d.stopTelemetry, d.telemetry, d.prom = nil, nil, nil
+	}
+	stop, err := d.setupTelemetry(config)
+	if err != nil {
+		return err
+	}
+	d.stopTelemetry, d.telemetry = stop, &config
+	return nil
+}
+
+// setupTelemetry installs the go-metrics sinks of the config as the global
+// sink and starts the prometheus listener and the gauges of the tasks. They
+// run until the returned func is called or the plugin shuts down. Without
+// sinks the metrics are dropped.
+func (d *Driver) setupTelemetry(config TelemetryConfig) (func(), error) {
+	var sinks metrics.FanoutSink
+	var prom *promSink
+	if config.PrometheusAddress != "" {
+		prom = newPromSink()
+		sinks = append(sinks, prom)
+	}
+	if config.StatsdAddress != "" {
+		s, err := metrics.NewStatsdSink(config.StatsdAddress)
+		if err != nil {
+			return nil, fmt.Errorf("Fail to create the statsd sink: %v", err)
+		}
+		sinks = append(sinks, s)
+	}
+	if config.StatsiteAddress != "" {
+		s, err := metrics.NewStatsiteSink(config.StatsiteAddress)
+		if err != nil {
+			return nil, fmt.Errorf("Fail to create the statsite sink: %v", err)
+		}
+		sinks = append(sinks, s)
+	}
+
+	conf := metrics.DefaultConfig("")
+	conf.EnableHostname = false
+	conf.EnableRuntimeMetrics = false
+	if len(sinks) == 0 {
+		if _, err := metrics.NewGlobal(conf, &metrics.BlackholeSink{}); err != nil {
+			return nil, fmt.Errorf("Fail to set up telemetry: %v", err)
+		}
+		return func() {}, nil
+	}
+
+	var l net.Listener
+	if prom != nil {
+		var err error
+		if l, err = net.Listen("tcp", config.PrometheusAddress); err != nil {
+			return nil, fmt.Errorf("Fail to listen on %s for prometheus: %v", config.PrometheusAddress, err)
+		}
+	}
+	if _, err := metrics.NewGlobal(conf, sinks); err != nil {
+		if l != nil {
+			l.Close()
+		}
+		return nil, fmt.Errorf("Fail to set up telemetry: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(d.ctx)
+	stop := cancel
+	if prom != nil {
+		d.prom = prom
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", prom)
+		srv := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+		go func() {
+			<-ctx.Done()
+			srv.Close()
+		}()
+		// the listener is closed before stop returns so a new config can
+		// take the same address
+		stop = func() {
+			cancel()
+			srv.Close()
+			l.Close()
+		}
+		go func() {
+			if err := srv.Serve(l); err != http.ErrServerClosed {
+				d.logger.Error("prometheus listener failed", "error", err)
+			}
+		}()
+		d.logger.Info("serving prometheus metrics", "address", l.Addr().String())
+	}
+
+	go d.emitTaskGauges(ctx)
+	return stop, nil
+}
+
+// emitTaskGauges emits the gauges of the task store.
+func (d *Driver) emitTaskGauges(ctx context.Context) {
+	ticker := time.NewTicker(telemetryInterval)
+	defer ticker.Stop()
+	for {
+		var running int
+		for _, h := range d.tasks.List() {
+			if h.IsRunning() {
+				running++
+			}
+		}
+		metrics.SetGauge([]string{"firecracker", "vms", "running"}, float32(running))
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// vmBooted records a micro-vm started since start.
+func vmBooted(start time.Time) {
+	metrics.IncrCounter([]string{"firecracker", "vms", "booted"}, 1)
+	metrics.MeasureSince([]string{"firecracker", "vms", "boot_time"}, start)
+}
+
+// startFailed records a start failing in phase.
+func startFailed(phase string) {
+	metrics.IncrCounterWithLabels([]string{"firecracker", "vms", "start_failed"}, 1,
+		[]metrics.Label{{Name: "reason", Value: phase}})
+}
+
+// forgetTaskMetrics drops the series of a destroyed task from the
+// prometheus endpoint, the other sinks don't keep state.
+func (d *Driver) forgetTaskMetrics(cfg *drivers.TaskConfig) {
+	d.telemetryLock.Lock()
+	defer d.telemetryLock.Unlock()
+	if d.prom != nil {
+		d.prom.forget(metrics.Label{Name: "alloc_id", Value: cfg.AllocID}, metrics.Label{Name: "task", Value: cfg.Name})
+	}
+}
+
+// promSeries is a metric with a set of label values.
+type promSeries struct {
+	labels []metrics.Label
+	value  float64
+
+	// histograms
+	buckets []uint64
+	count   uint64
+}
+
+// promFamily is the series of a metric name.
+type promFamily struct {
+	kind   string
+	series map[string]*promSeries
+}
+
+// promSink is a go-metrics sink keeping counters, gauges and histograms to
+// serve them in the prometheus text format. Counters accumulate since the
+// plugin started.
+type promSink struct {
+	lock     sync.Mutex
+	families map[string]*promFamily
+}
+
+func newPromSink() *promSink {
+	return &promSink{families: map[string]*promFamily{}}
+}
+
+func promName(key []string) string {
+	name := strings.Join(key, "_")
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r == ':' {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+// series returns the series of key and labels, creating it.
+func (s *promSink) series(kind string, key []string, labels []metrics.Label) *promSeries {
+	name := promName(key)
+	f, ok := s.families[name]
+	if !ok {
+		f = &promFamily{kind: kind, series: map[string]*promSeries{}}
+		s.families[name] = f
+	}
+	id := promLabels(labels)
+	ps, ok := f.series[id]
+	if !ok {
+		ps = &promSeries{labels: append([]metrics.Label{}, labels...)}
+		if kind == "histogram" {
+			ps.buckets = make([]uint64, len(promBuckets))
+		}
+		f.series[id] = ps
+	}
+	return ps
+}
+
+func (s *promSink) SetGauge(key []string, val float32) {
+	s.SetGaugeWithLabels(key, val, nil)
+}
+
+func (s *promSink) SetGaugeWithLabels(key []string, val float32, labels []metrics.Label) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.series("gauge", key, labels).value = float64(val)
+}
+
+func (s *promSink) EmitKey(key []string, val float32) {
+	s.SetGauge(key, val)
+}
+
+func (s *promSink) IncrCounter(key []string, val float32) {
+	s.IncrCounterWithLabels(key, val, nil)
+}
+
+func (s *promSink) IncrCounterWithLabels(key []string, val float32, labels []metrics.Label) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.series("counter", key, labels).value += float64(val)
+}
+
+func (s *promSink) AddSample(key []string, val float32) {
+	s.AddSampleWithLabels(key, val, nil)
+}
+
+func (s *promSink) AddSampleWithLabels(key []string, val float32, labels []metrics.Label) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	ps := s.series("histogram", key, labels)
+	for i, le := range promBuckets {
+		if float64(val) <= le {
+			ps.buckets[i]++
+		}
+	}
+	ps.count++
+	ps.value += float64(val)
+}
+
+// forget drops the series having all the labels.
+func (s *promSink) forget(labels ...metrics.Label) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, f := range s.families {
+		for id, ps := range f.series {
+			if hasLabels(ps.labels, labels) {
+				delete(f.series, id)
+			}
+		}
+	}
+}
+
+func hasLabels(have, want []metrics.Label) bool {
+	for _, w := range want {
+		found := false
+		for _, h := range have {
+			if h == w {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *promSink) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", promContentType)
+	s.write(w)
+}
+
+// write renders the metrics in the prometheus text format.
+func (s *promSink) write(w io.Writer) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	names := make([]string, 0, len(s.families))
+	for name := range s.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		f := s.families[name]
+		if len(f.series) == 0 {
+			continue
+		}
+		fmt.Fprintf(w, "# TYPE %s %s\n", name, f.kind)
+		ids := make([]string, 0, len(f.series))
+		for id := range f.series {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		for _, id := range ids {
+			ps := f.series[id]
+			if f.kind != "histogram" {
+				fmt.Fprintf(w, "%s%s %s\n", name, id, promValue(ps.value))
+				continue
+			}
+			for i, le := range promBuckets {
+				fmt.Fprintf(w, "%s_bucket%s %d\n", name, promLabels(ps.labels, metrics.Label{Name: "le", Value: promValue(le)}), ps.buckets[i])
+			}
+			fmt.Fprintf(w, "%s_bucket%s %d\n", name, promLabels(ps.labels, metrics.Label{Name: "le", Value: "+Inf"}), ps.count)
+			fmt.Fprintf(w, "%s_sum%s %s\n", name, id, promValue(ps.value))
+			fmt.Fprintf(w, "%s_count%s %d\n", name, id, ps.count)
+		}
+	}
+}
+
+// promLabels renders labels as {name="value",...}, it is also the id of a
+// series.
+func promLabels(labels []metrics.Label, extra ...metrics.Label) string {
+	all := append(append([]metrics.Label{}, labels...), extra...)
+	if len(all) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, l := range all {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, "%s=\"%s\"", promName([]string{l.Name}), promEscaper.Replace(l.Value))
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+func promValue(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
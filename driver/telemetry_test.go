@@ -0,0 +1,122 @@
+/* Firecracker-task-driver is a task driver for Hashicorp's nomad that allows
+ * to create microvms using AWS Firecracker vmm
+ * Copyright (C) 2019  Carlos Neira cneirabustos@gmail.com
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ */
+
+package firevm
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+
+	metrics "github.com/armon/go-metrics"
+	hclog "github.com/hashicorp/go-hclog"
+)
+
+func TestPromSinkWrite(t *testing.T) {
+	task := []metrics.Label{{Name: "alloc_id", Value: "a1"}, {Name: "task", Value: "web"}}
+	other := []metrics.Label{{Name: "alloc_id", Value: "a2"}, {Name: "task", Value: `we"b`}}
+
+	s := newPromSink()
+	s.SetGauge([]string{"firecracker", "vms", "running"}, 2)
+	s.IncrCounterWithLabels([]string{"firecracker", "block", "read_bytes"}, 100, task)
+	s.IncrCounterWithLabels([]string{"firecracker", "block", "read_bytes"}, 50, task)
+	s.IncrCounterWithLabels([]string{"firecracker", "block", "read_bytes"}, 1, other)
+	s.AddSample([]string{"firecracker", "vms", "boot_time"}, 120)
+	s.AddSample([]string{"firecracker", "vms", "boot_time"}, 7)
+
+	var out bytes.Buffer
+	s.write(&out)
+	for _, want := range []string{
+		"# TYPE firecracker_block_read_bytes counter\n" +
+			"firecracker_block_read_bytes{alloc_id=\"a1\",task=\"web\"} 150\n" +
+			"firecracker_block_read_bytes{alloc_id=\"a2\",task=\"we\\\"b\"} 1\n",
+		"# TYPE firecracker_vms_running gauge\nfirecracker_vms_running 2\n",
+		"# TYPE firecracker_vms_boot_time histogram\n",
+		"firecracker_vms_boot_time_bucket{le=\"10\"} 1\n",
+		"firecracker_vms_boot_time_bucket{le=\"100\"} 1\n",
+		"firecracker_vms_boot_time_bucket{le=\"250\"} 2\n",
+		"firecracker_vms_boot_time_bucket{le=\"+Inf\"} 2\n",
+		"firecracker_vms_boot_time_sum 127\n",
+		"firecracker_vms_boot_time_count 2\n",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("missing %q in\n%s", want, out.String())
+		}
+	}
+
+	// a destroyed task disappears, the family goes once it has no series
+	s.forget(other...)
+	s.forget(task...)
+	out.Reset()
+	s.write(&out)
+	if strings.Contains(out.String(), "read_bytes") {
+		t.Errorf("forgotten series in\n%s", out.String())
+	}
+}
+
+func TestPromName(t *testing.T) {
+	cases := []struct {
+		key  []string
+		want string
+	}{
+		{[]string{"firecracker", "vms", "running"}, "firecracker_vms_running"},
+		{[]string{"firecracker", "net", "rx-bytes"}, "firecracker_net_rx_bytes"},
+		{[]string{"a.b", "c:d"}, "a_b_c:d"},
+	}
+	for _, c := range cases {
+		if got := promName(c.key); got != c.want {
+			t.Errorf("%v: got %s, want %s", c.key, got, c.want)
+		}
+	}
+}
+
+func TestConfigureTelemetryRetry(t *testing.T) {
+	d := NewFirecrackerDriver(hclog.NewNullLogger()).(*Driver)
+	defer d.signalShutdown()
+
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := TelemetryConfig{PrometheusAddress: busy.Addr().String()}
+	if err := d.configureTelemetry(config); err == nil {
+		t.Fatal("no error with the prometheus address in use")
+	}
+	if d.telemetry != nil || d.prom != nil {
+		t.Fatal("failed setup recorded")
+	}
+
+	// the same config is tried again once the address is free
+	busy.Close()
+	if err := d.configureTelemetry(config); err != nil {
+		t.Fatal(err)
+	}
+	prom := d.prom
+	if prom == nil {
+		t.Fatal("no prometheus sink")
+	}
+	if err := d.configureTelemetry(config); err != nil || d.prom != prom {
+		t.Errorf("unchanged config set up again: %v", err)
+	}
+
+	// a changed config replaces the sinks and frees the old listener
+	if err := d.configureTelemetry(TelemetryConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	if d.prom != nil {
+		t.Error("prometheus sink kept after it was disabled")
+	}
+	if err := d.configureTelemetry(config); err != nil {
+		t.Errorf("address not released: %v", err)
+	}
+	d.stopTelemetry()
+}
@@ -0,0 +1,251 @@
+/* Firecracker-task-driver is a task driver for Hashicorp's nomad that allows
+ * to create microvms using AWS Firecracker vmm
+ * Copyright (C) 2019  Carlos Neira cneirabustos@gmail.com
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ */
+
+package firevm
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	metrics "github.com/armon/go-metrics"
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+const (
+	// metricsFlushInterval is how often firecracker is asked to write its
+	// metrics, on its own it only does every 60 seconds.
+	metricsFlushInterval = 10 * time.Second
+
+	// maxMetricsLine bounds a line of the metrics fifo, a flush is a single
+	// json object of a few KB.
+	maxMetricsLine = 1024 * 1024
+)
+
+// fcMetricGroup selects counters of the firecracker metrics. Per-device
+// groups are the keys starting with prefix followed by the device id, the
+// other groups the key equal to prefix.
+type fcMetricGroup struct {
+	Name   string
+	Prefix string
+	Device string // label of the device id, empty for vm wide groups
+	Attr   string // prefix of the task driver attributes of the totals
+	Fields map[string]string
+}
+
+var fcMetricGroups = []fcMetricGroup{
+	{Name: "block", Prefix: "block_", Device: "drive", Attr: "Block", Fields: map[string]string{
+		"read_bytes":  "read_bytes",
+		"write_bytes": "write_bytes",
+		"read_count":  "read_ops",
+		"write_count": "write_ops",
+	}},
+	{Name: "net", Prefix: "net_", Device: "iface", Attr: "Net", Fields: map[string]string{
+		"rx_bytes_count":   "rx_bytes",
+		"tx_bytes_count":   "tx_bytes",
+		"rx_packets_count": "rx_packets",
+		"tx_packets_count": "tx_packets",
+	}},
+	{Name: "vcpu", Prefix: "vcpu", Fields: map[string]string{
+		"exit_io_in":      "exit_io_in",
+		"exit_io_out":     "exit_io_out",
+		"exit_mmio_read":  "exit_mmio_read",
+		"exit_mmio_write": "exit_mmio_write",
+	}},
+	{Name: "mmds", Prefix: "mmds", Fields: map[string]string{
+		"rx_accepted":     "hits",
+		"rx_accepted_err": "errors",
+		"tx_bytes":        "tx_bytes",
+	}},
+}
+
+// match returns the device id of key, ok is false when key is not in the
+// group.
+func (g fcMetricGroup) match(key string) (device string, ok bool) {
+	if g.Device == "" {
+		return "", key == g.Prefix
+	}
+	if !strings.HasPrefix(key, g.Prefix) || len(key) == len(g.Prefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(key, g.Prefix), true
+}
+
+// vmCounter identifies a counter of a micro-vm.
+type vmCounter struct {
+	Group  string
+	Device string
+	Name   string
+}
+
+// vmMetrics reads the metrics fifo of a micro-vm. Firecracker writes the
+// counters as the increase since its previous flush, they are exported as is
+// and summed up for the totals.
+type vmMetrics struct {
+	logger hclog.Logger
+	labels []metrics.Label
+	fifo   io.ReadCloser
+	socket string
+	done   chan struct{}
+
+	lock   sync.Mutex
+	totals map[vmCounter]uint64
+}
+
+// taskMetricLabels are the labels of the metrics of a task, the ones nomad
+// uses for its own task metrics.
+func taskMetricLabels(cfg *drivers.TaskConfig) []metrics.Label {
+	return []metrics.Label{
+		{Name: "namespace", Value: cfg.Namespace},
+		{Name: "job", Value: cfg.JobName},
+		{Name: "task_group", Value: cfg.TaskGroupName},
+		{Name: "alloc_id", Value: cfg.AllocID},
+		{Name: "task", Value: cfg.Name},
+	}
+}
+
+// startVMMetrics starts reading the metrics fifo firecracker has opened and
+// asking it to flush every metricsFlushInterval. Reading stops when
+// firecracker exits or close is called.
+func startVMMetrics(path, socket string, cfg *drivers.TaskConfig, logger hclog.Logger) (*vmMetrics, error) {
+	// firecracker keeps the fifo open, the read end doesn't wait for it
+	f, err := os.OpenFile(path, os.O_RDONLY|syscall.O_NONBLOCK, os.ModeNamedPipe)
+	if err != nil {
+		return nil, fmt.Errorf("Fail to open the metrics fifo: %v", err)
+	}
+	v := &vmMetrics{
+		logger: logger.With("task_id", cfg.ID),
+		labels: taskMetricLabels(cfg),
+		fifo:   f,
+		socket: socket,
+		done:   make(chan struct{}),
+		totals: map[vmCounter]uint64{},
+	}
+	go v.read()
+	go v.flush()
+	return v, nil
+}
+
+func (v *vmMetrics) read() {
+	defer close(v.done)
+	scanner := bufio.NewScanner(v.fifo)
+	scanner.Buffer(nil, maxMetricsLine)
+	for scanner.Scan() {
+		if err := v.update(scanner.Bytes()); err != nil {
+			v.logger.Warn("failed to parse firecracker metrics", "error", err)
+		}
+	}
+}
+
+func (v *vmMetrics) flush() {
+	ticker := time.NewTicker(metricsFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-v.done:
+			return
+		case <-ticker.C:
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), metricsFlushInterval)
+		err := putAPI(ctx, v.socket, "/actions", map[string]string{"action_type": "FlushMetrics"})
+		cancel()
+		if err != nil {
+			v.logger.Debug("failed to flush firecracker metrics", "error", err)
+		}
+	}
+}
+
+// update adds a flush of the metrics to the totals and exports it.
+func (v *vmMetrics) update(line []byte) error {
+	var flush map[string]json.RawMessage
+	if err := json.Unmarshal(line, &flush); err != nil {
+		return err
+	}
+	deltas := parseFcMetrics(flush)
+
+	v.lock.Lock()
+	for c, delta := range deltas {
+		v.totals[c] += delta
+	}
+	v.lock.Unlock()
+
+	for c, delta := range deltas {
+		labels := v.labels
+		if c.Device != "" {
+			labels = append(append([]metrics.Label{}, v.labels...), metrics.Label{Name: c.group().Device, Value: c.Device})
+		}
+		metrics.IncrCounterWithLabels([]string{"firecracker", c.Group, c.Name}, float32(delta), labels)
+	}
+	return nil
+}
+
+// parseFcMetrics returns the counters of the groups in a flush. Fields that
+// aren't counters, like latencies in newer releases, are skipped.
+func parseFcMetrics(flush map[string]json.RawMessage) map[vmCounter]uint64 {
+	deltas := map[vmCounter]uint64{}
+	for key, raw := range flush {
+		for _, g := range fcMetricGroups {
+			device, ok := g.match(key)
+			if !ok {
+				continue
+			}
+			var fields map[string]json.RawMessage
+			if err := json.Unmarshal(raw, &fields); err != nil {
+				break
+			}
+			for field, name := range g.Fields {
+				var n uint64
+				if err := json.Unmarshal(fields[field], &n); err != nil || n == 0 {
+					continue
+				}
+				deltas[vmCounter{Group: g.Name, Device: device, Name: name}] = n
+			}
+			break
+		}
+	}
+	return deltas
+}
+
+func (c vmCounter) group() fcMetricGroup {
+	for _, g := range fcMetricGroups {
+		if g.Name == c.Group {
+			return g
+		}
+	}
+	return fcMetricGroup{}
+}
+
+// attributes returns the block and network totals as task driver
+// attributes, nomad only takes cpu and memory in the task stats.
+func (v *vmMetrics) attributes() map[string]string {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	attrs := map[string]string{}
+	for c, n := range v.totals {
+		if attr := c.group().Attr; attr != "" {
+			attrs[fmt.Sprintf("%s.%s.%s", attr, c.Device, c.Name)] = strconv.FormatUint(n, 10)
+		}
+	}
+	return attrs
+}
+
+func (v *vmMetrics) close() {
+	v.fifo.Close()
+}
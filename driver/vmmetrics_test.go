@@ -0,0 +1,92 @@
+/* Firecracker-task-driver is a task driver for Hashicorp's nomad that allows
+ * to create microvms using AWS Firecracker vmm
+ * Copyright (C) 2019  Carlos Neira cneirabustos@gmail.com
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ */
+
+package firevm
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestParseFcMetrics(t *testing.T) {
+	cases := []struct {
+		name  string
+		flush string
+		want  map[vmCounter]uint64
+	}{
+		{
+			name: "devices",
+			flush: `{
+				"block": {"read_bytes": 100},
+				"block_rootfs": {"read_bytes": 4096, "write_bytes": 0, "read_count": 2},
+				"net_eth0": {"rx_bytes_count": 1500, "tx_packets_count": 3},
+				"utc_timestamp_ms": 1700000000000
+			}`,
+			want: map[vmCounter]uint64{
+				{Group: "block", Device: "rootfs", Name: "read_bytes"}: 4096,
+				{Group: "block", Device: "rootfs", Name: "read_ops"}:   2,
+				{Group: "net", Device: "eth0", Name: "rx_bytes"}:       1500,
+				{Group: "net", Device: "eth0", Name: "tx_packets"}:     3,
+			},
+		},
+		{
+			name: "vm wide groups",
+			flush: `{
+				"vcpu": {"exit_io_in": 7, "exit_mmio_write": 1},
+				"vcpus": {"exit_io_in": 9},
+				"mmds": {"rx_accepted": 5, "rx_accepted_err": 1}
+			}`,
+			want: map[vmCounter]uint64{
+				{Group: "vcpu", Name: "exit_io_in"}:      7,
+				{Group: "vcpu", Name: "exit_mmio_write"}: 1,
+				{Group: "mmds", Name: "hits"}:            5,
+				{Group: "mmds", Name: "errors"}:          1,
+			},
+		},
+		{
+			name:  "not counters",
+			flush: `{"block_rootfs": {"read_bytes": {"min_us": 1}}, "net_eth0": 12}`,
+			want:  map[vmCounter]uint64{},
+		},
+	}
+	for _, c := range cases {
+		var flush map[string]json.RawMessage
+		if err := json.Unmarshal([]byte(c.flush), &flush); err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if got := parseFcMetrics(flush); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: got %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestFcMetricGroupMatch(t *testing.T) {
+	block, vcpu := fcMetricGroups[0], fcMetricGroups[2]
+	cases := []struct {
+		group  fcMetricGroup
+		key    string
+		device string
+		ok     bool
+	}{
+		{block, "block_rootfs", "rootfs", true},
+		{block, "block_", "", false},
+		{block, "block", "", false},
+		{vcpu, "vcpu", "", true},
+		{vcpu, "vcpu0", "", false},
+	}
+	for _, c := range cases {
+		device, ok := c.group.match(c.key)
+		if device != c.device || ok != c.ok {
+			t.Errorf("%s %q: got %q, %v, want %q, %v", c.group.Name, c.key, device, ok, c.device, c.ok)
+		}
+	}
+}
@@ -0,0 +1,216 @@
+/* Firecracker-task-driver is a task driver for Hashicorp's nomad that allows
+ * to create microvms using AWS Firecracker vmm
+ * Copyright (C) 2019  Carlos Neira cneirabustos@gmail.com
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ */
+
+package firevm
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/hashicorp/nomad/client/lib/fifo"
+	"github.com/hashicorp/nomad/client/logmon/logging"
+	"github.com/hashicorp/nomad/plugins/drivers"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultVMMLogLevel = "Info"
+
+	// rotation of the log files, nomad rotates the task stderr itself
+	defaultVMMLogMaxFiles  = 5
+	defaultVMMLogMaxFileMB = 10
+)
+
+// vmmLogLevels maps the log_level values to their rank, lower is more
+// severe. The names are the ones the firecracker logger api takes.
+var vmmLogLevels = map[string]int{
+	"Error":   0,
+	"Warning": 1,
+	"Info":    2,
+	"Debug":   3,
+}
+
+// fcLogLevels maps the levels firecracker prints to the log_level values.
+var fcLogLevels = map[string]string{
+	"ERROR": "Error",
+	"WARN":  "Warning",
+	"INFO":  "Info",
+	"DEBUG": "Debug",
+	"TRACE": "Debug",
+}
+
+// vmmLogPattern matches a firecracker log line printed with its level:
+// "<time> [<instance>:<thread>:<LEVEL>] <message>".
+var vmmLogPattern = regexp.MustCompile(`^(\S+) \[([^\]]*)\] ?(.*)$`)
+
+// vmmLogLine is a parsed line of the firecracker log.
+type vmmLogLine struct {
+	Time    string
+	Thread  string
+	Level   string
+	Message string
+}
+
+// parseVMMLogLine parses a line of the firecracker log, ok is false for
+// lines in another format like panics.
+func parseVMMLogLine(line string) (l vmmLogLine, ok bool) {
+	m := vmmLogPattern.FindStringSubmatch(line)
+	if m == nil {
+		return l, false
+	}
+	l.Time, l.Message = m[1], m[3]
+	for i, field := range strings.Split(m[2], ":") {
+		if level, found := fcLogLevels[field]; found {
+			l.Level = level
+		} else if i == 1 {
+			l.Thread = field
+		}
+	}
+	return l, l.Level != ""
+}
+
+// vmmLog is what the firecracker log fifo is copied to. It parses the lines,
+// drops the ones below the level of the task and writes the others to the
+// task stderr or a rotated file.
+type vmmLog struct {
+	level     int
+	levelName string
+	out       io.WriteCloser
+
+	lock sync.Mutex
+	buf  []byte
+
+	// fifo is the log fifo when the log is read by the plugin rather than
+	// the sdk, after a recovery
+	fifo io.Closer
+}
+
+func newVMMLog(level string, out io.WriteCloser) *vmmLog {
+	return &vmmLog{level: vmmLogLevels[level], levelName: level, out: out}
+}
+
+func (l *vmmLog) Write(p []byte) (int, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.buf = append(l.buf, p...)
+	for {
+		i := bytes.IndexByte(l.buf, '\n')
+		if i < 0 {
+			break
+		}
+		line := string(l.buf[:i])
+		l.buf = l.buf[i+1:]
+		if err := l.writeLine(line); err != nil {
+			return len(p), err
+		}
+	}
+	return len(p), nil
+}
+
+func (l *vmmLog) writeLine(line string) error {
+	parsed, ok := parseVMMLogLine(line)
+	if !ok {
+		_, err := fmt.Fprintf(l.out, "firecracker: %s\n", line)
+		return err
+	}
+	if vmmLogLevels[parsed.Level] > l.level {
+		return nil
+	}
+	_, err := fmt.Fprintf(l.out, "%s [%s] firecracker %s: %s\n",
+		parsed.Time, strings.ToUpper(parsed.Level), parsed.Thread, parsed.Message)
+	return err
+}
+
+// follow copies the log fifo of a running firecracker to the log, the sdk
+// copier of the fifo went away with the previous plugin process.
+func (l *vmmLog) follow(path string) error {
+	// firecracker keeps the fifo open, the read end doesn't wait for it
+	f, err := os.OpenFile(path, os.O_RDONLY|syscall.O_NONBLOCK, os.ModeNamedPipe)
+	if err != nil {
+		return fmt.Errorf("Fail to open the log fifo: %v", err)
+	}
+	l.fifo = f
+	go io.Copy(l, f)
+	return nil
+}
+
+func (l *vmmLog) Close() error {
+	if l.fifo != nil {
+		l.fifo.Close()
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if len(l.buf) > 0 {
+		l.writeLine(string(l.buf))
+		l.buf = nil
+	}
+	return l.out.Close()
+}
+
+// logrusLevel is the level of the sdk logger of the task.
+func (l *vmmLog) logrusLevel() log.Level {
+	if l.level >= vmmLogLevels["Debug"] {
+		return log.DebugLevel
+	}
+	return log.InfoLevel
+}
+
+// openVMMLog opens where the log of the task goes: the task stderr without
+// Log, a rotated file in alloc/logs for a relative Log and any host path
+// when the plugin allows it.
+func (d *Driver) openVMMLog(cfg *drivers.TaskConfig, taskConfig TaskConfig) (*vmmLog, error) {
+	level := taskConfig.LogLevel
+	if level == "" {
+		level = defaultVMMLogLevel
+	}
+	if _, ok := vmmLogLevels[level]; !ok {
+		return nil, errInvalidLogLevel
+	}
+
+	if taskConfig.Log == "" {
+		w, err := fifo.OpenWriter(cfg.StderrPath)
+		if err != nil {
+			return nil, fmt.Errorf("Fail to open the task stderr: %v", err)
+		}
+		return newVMMLog(level, w), nil
+	}
+
+	path := taskConfig.Log
+	logDir := cfg.TaskDir().LogDir
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(logDir, path)
+	}
+	path = filepath.Clean(path)
+	if filepath.Dir(path) != logDir && !d.config.AllowHostLogPaths {
+		return nil, errHostLogPath
+	}
+
+	maxFiles, maxFileMB := taskConfig.LogMaxFiles, taskConfig.LogMaxFileSizeMB
+	if maxFiles <= 0 {
+		maxFiles = defaultVMMLogMaxFiles
+	}
+	if maxFileMB <= 0 {
+		maxFileMB = defaultVMMLogMaxFileMB
+	}
+	w, err := logging.NewFileRotator(filepath.Dir(path), filepath.Base(path), maxFiles, maxFileMB*1024*1024,
+		d.logger.With("task_id", cfg.ID))
+	if err != nil {
+		return nil, fmt.Errorf("Fail to open log file %s: %v", path, err)
+	}
+	return newVMMLog(level, w), nil
+}
@@ -0,0 +1,165 @@
+/* Firecracker-task-driver is a task driver for Hashicorp's nomad that allows
+ * to create microvms using AWS Firecracker vmm
+ * Copyright (C) 2019  Carlos Neira cneirabustos@gmail.com
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ */
+
+package firevm
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+func TestParseVMMLogLine(t *testing.T) {
+	cases := []struct {
+		line string
+		want vmmLogLine
+		ok   bool
+	}{
+		{
+			"2024-05-01T10:00:00.000000001 [anonymous-instance:main:INFO:src/firecracker/src/main.rs:562] Running Firecracker v1.7.0",
+			vmmLogLine{Time: "2024-05-01T10:00:00.000000001", Thread: "main", Level: "Info", Message: "Running Firecracker v1.7.0"},
+			true,
+		},
+		{
+			"2024-05-01T10:00:01.000000001 [vm-1:fc_vcpu 0:WARN] vcpu exit",
+			vmmLogLine{Time: "2024-05-01T10:00:01.000000001", Thread: "fc_vcpu 0", Level: "Warning", Message: "vcpu exit"},
+			true,
+		},
+		{
+			"2024-05-01T10:00:02.000000001 [vm-1:fc_api:TRACE:src/api_server/src/lib.rs:10] request",
+			vmmLogLine{Time: "2024-05-01T10:00:02.000000001", Thread: "fc_api", Level: "Debug", Message: "request"},
+			true,
+		},
+		{"thread 'main' panicked at 'boom'", vmmLogLine{}, false},
+		{"2024-05-01T10:00:00 [vm-1:main] no level", vmmLogLine{}, false},
+		{"", vmmLogLine{}, false},
+	}
+	for _, c := range cases {
+		got, ok := parseVMMLogLine(c.line)
+		if ok != c.ok || (ok && got != c.want) {
+			t.Errorf("%q: got %+v, %v, want %+v, %v", c.line, got, ok, c.want, c.ok)
+		}
+	}
+}
+
+type nopWriteCloser struct{ bytes.Buffer }
+
+func (*nopWriteCloser) Close() error { return nil }
+
+// syncWriteCloser is written by the copier of a followed fifo.
+type syncWriteCloser struct {
+	lock sync.Mutex
+	buf  bytes.Buffer
+}
+
+func (w *syncWriteCloser) Write(p []byte) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.buf.Write(p)
+}
+
+func (w *syncWriteCloser) String() string {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.buf.String()
+}
+
+func (*syncWriteCloser) Close() error { return nil }
+
+func TestVMMLogLevel(t *testing.T) {
+	out := &nopWriteCloser{}
+	l := newVMMLog("Warning", out)
+	l.Write([]byte("2024-05-01T10:00:00 [vm-1:main:INFO] dropped\n2024-05-01T10:00:01 [vm-1:main:ERROR] kept\npanic: "))
+	l.Write([]byte("raw\n2024-05-01T10:00:02 [vm-1:fc_api:WARN] partial"))
+	l.Close()
+
+	want := "2024-05-01T10:00:01 [ERROR] firecracker main: kept\n" +
+		"firecracker: panic: raw\n" +
+		"2024-05-01T10:00:02 [WARNING] firecracker fc_api: partial\n"
+	if out.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", out.String(), want)
+	}
+}
+
+func TestOpenVMMLogDefault(t *testing.T) {
+	d := NewFirecrackerDriver(hclog.NewNullLogger()).(*Driver)
+	defer d.signalShutdown()
+	stderr := filepath.Join(t.TempDir(), "stderr")
+	if err := os.WriteFile(stderr, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfg := &drivers.TaskConfig{ID: "task", StderrPath: stderr}
+
+	// without Log nor log_level the log goes to the task stderr at Info
+	l, err := d.openVMMLog(cfg, TaskConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.levelName != defaultVMMLogLevel {
+		t.Errorf("got level %s, want %s", l.levelName, defaultVMMLogLevel)
+	}
+	l.Write([]byte("2024-05-01T10:00:00 [vm-1:main:DEBUG] dropped\n2024-05-01T10:00:01 [vm-1:main:INFO] kept\n"))
+	l.Close()
+
+	b, err := os.ReadFile(stderr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "2024-05-01T10:00:01 [INFO] firecracker main: kept\n"; string(b) != want {
+		t.Errorf("got %q, want %q", b, want)
+	}
+
+	if _, err := d.openVMMLog(cfg, TaskConfig{LogLevel: "Trace"}); err != errInvalidLogLevel {
+		t.Errorf("got error %v, want %v", err, errInvalidLogLevel)
+	}
+}
+
+func TestVMMLogFollow(t *testing.T) {
+	path := filepath.Join(t.TempDir(), runtimeLogFifo)
+	if err := syscall.Mkfifo(path, 0600); err != nil {
+		t.Skipf("can't create a fifo: %v", err)
+	}
+	// the running firecracker holds the write end before the plugin reads
+	w, err := os.OpenFile(path, os.O_RDWR, os.ModeNamedPipe)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	out := &syncWriteCloser{}
+	l := newVMMLog(defaultVMMLogLevel, out)
+	if err := l.follow(path); err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	w.Write([]byte("2024-05-01T10:00:00 [vm-1:main:WARN] after recovery\n"))
+
+	want := "2024-05-01T10:00:00 [WARNING] firecracker main: after recovery\n"
+	deadline := time.Now().Add(5 * time.Second)
+	for out.String() != want && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := out.String(); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	if err := l.follow(filepath.Join(t.TempDir(), "gone")); err == nil || !strings.Contains(err.Error(), "log fifo") {
+		t.Errorf("no error following a missing fifo: %v", err)
+	}
+}
@@ -0,0 +1,133 @@
+/* Firecracker-task-driver is a task driver for Hashicorp's nomad that allows
+ * to create microvms using AWS Firecracker vmm
+ * Copyright (C) 2019  Carlos Neira cneirabustos@gmail.com
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ */
+
+package firevm
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	firecracker "github.com/firecracker-microvm/firecracker-go-sdk"
+	models "github.com/firecracker-microvm/firecracker-go-sdk/client/models"
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+// volumeDrive is a nomad volume mount or device backed by a block device or
+// a disk image, attached to the micro-vm as is.
+type volumeDrive struct {
+	ID       string
+	HostPath string
+	TaskPath string
+	ReadOnly bool
+}
+
+func (v volumeDrive) drive() models.Drive {
+	return models.Drive{
+		DriveID:      firecracker.String(v.ID),
+		PathOnHost:   firecracker.String(v.HostPath),
+		IsReadOnly:   firecracker.Bool(v.ReadOnly),
+		IsRootDevice: firecracker.Bool(false),
+	}
+}
+
+// prepareVolumes turns the volume mounts and devices nomad hands to the
+// driver into drives. Host volumes and CSI volumes in block-device mode are
+// attached directly, directory backed host volumes are packed into a
+// read-only ext4 image like the task dirs. A copy can't grow past the size of
+// its image nor carry deletions back, so writable directory volumes are
+// refused.
+func prepareVolumes(cfg *drivers.TaskConfig) ([]volumeDrive, []taskDirDrive, error) {
+	var volumes []volumeDrive
+	var packed []taskDirDrive
+	ids := map[string]bool{}
+
+	for _, m := range cfg.Mounts {
+		fi, err := os.Stat(m.HostPath)
+		if err != nil {
+			return nil, nil, fmt.Errorf("volume mount %q: %v", m.TaskPath, err)
+		}
+		id := volumeDriveID("vol", m.TaskPath, ids)
+
+		if !fi.IsDir() {
+			volumes = append(volumes, volumeDrive{
+				ID:       id,
+				HostPath: m.HostPath,
+				TaskPath: m.TaskPath,
+				ReadOnly: m.Readonly,
+			})
+			continue
+		}
+
+		if !m.Readonly {
+			return nil, nil, fmt.Errorf("%w: %s", errWritableDirVolume, m.TaskPath)
+		}
+		imageDir, err := taskImageDir(cfg)
+		if err != nil {
+			return nil, nil, err
+		}
+		label := id
+		if len(label) > 16 {
+			label = label[:16]
+		}
+		t := taskDirDrive{
+			ID:        id,
+			Name:      label,
+			HostDir:   m.HostPath,
+			MountPath: m.TaskPath,
+			Image:     filepath.Join(imageDir, id+"."+taskDirFormatExt4),
+			Format:    taskDirFormatExt4,
+			ReadOnly:  m.Readonly,
+		}
+		if err := t.build(); err != nil {
+			return nil, nil, fmt.Errorf("Fail to pack volume %q: %v", m.TaskPath, err)
+		}
+		packed = append(packed, t)
+	}
+
+	for _, d := range cfg.Devices {
+		fi, err := os.Stat(d.HostPath)
+		if err != nil {
+			return nil, nil, fmt.Errorf("device %q: %v", d.TaskPath, err)
+		}
+		// only block devices make sense as drives, character devices
+		// handed out by device plugins can't be passed to the guest.
+		if fi.Mode()&os.ModeDevice == 0 || fi.Mode()&os.ModeCharDevice != 0 {
+			continue
+		}
+		volumes = append(volumes, volumeDrive{
+			ID:       volumeDriveID("dev", d.TaskPath, ids),
+			HostPath: d.HostPath,
+			TaskPath: d.TaskPath,
+			ReadOnly: !strings.Contains(d.Permissions, "w"),
+		})
+	}
+	return volumes, packed, nil
+}
+
+// volumeDriveID derives a drive id from the path the volume is mounted at in
+// the task, so the same job always gets the same ids.
+func volumeDriveID(prefix, taskPath string, used map[string]bool) string {
+	id := prefix + strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, "/"+strings.Trim(taskPath, "/"))
+
+	unique := id
+	for i := 2; used[unique]; i++ {
+		unique = fmt.Sprintf("%s_%d", id, i)
+	}
+	used[unique] = true
+	return unique
+}
@@ -0,0 +1,42 @@
+/* Firecracker-task-driver is a task driver for Hashicorp's nomad that allows
+ * to create microvms using AWS Firecracker vmm
+ * Copyright (C) 2019  Carlos Neira cneirabustos@gmail.com
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ */
+
+package firevm
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+func TestPrepareVolumesWritableDir(t *testing.T) {
+	cfg := &drivers.TaskConfig{Mounts: []*drivers.MountConfig{{
+		TaskPath: "/var/lib/db",
+		HostPath: t.TempDir(),
+	}}}
+	if _, _, err := prepareVolumes(cfg); !errors.Is(err, errWritableDirVolume) {
+		t.Errorf("got %v, want %v", err, errWritableDirVolume)
+	}
+}
+
+func TestVolumeDriveID(t *testing.T) {
+	used := map[string]bool{}
+	for _, c := range []struct{ path, id string }{
+		{"/var/lib/db", "vol_var_lib_db"},
+		{"var/lib/db/", "vol_var_lib_db_2"},
+		{"/data-1", "vol_data_1"},
+	} {
+		if id := volumeDriveID("vol", c.path, used); id != c.id {
+			t.Errorf("%s: got %s, want %s", c.path, id, c.id)
+		}
+	}
+}